@@ -0,0 +1,337 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-cid"
+
+	fc "github.com/jlogelin/wormhole/filecoin"
+)
+
+// Client talks to a running daemon's control API
+type Client struct {
+	baseURL string
+	http    *http.Client
+}
+
+func NewClient(addr string) *Client {
+	return &Client{
+		baseURL: "http://" + addr + RoutePrefix,
+		http:    &http.Client{},
+	}
+}
+
+// Dial returns a client for the daemon whose address is recorded in apiFile.
+// It returns a nil client and no error if no daemon is running.
+func Dial(ctx context.Context, apiFile string) (*Client, error) {
+	data, err := os.ReadFile(apiFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	c := NewClient(strings.TrimSpace(string(data)))
+
+	// A stale api file is left behind if the daemon didn't shut down cleanly
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	if _, err := c.Node(ctx); err != nil {
+		return nil, nil
+	}
+
+	return c, nil
+}
+
+func (c *Client) SubmitJob(ctx context.Context, req fc.GetRequest, priority int) (*fc.Job, error) {
+	var job fc.Job
+	if err := c.doJSON(ctx, http.MethodPost, "/jobs", SubmitJobRequest{Request: req, Priority: priority}, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (c *Client) ListJobs(ctx context.Context) ([]*fc.Job, error) {
+	var jobs []*fc.Job
+	if err := c.doJSON(ctx, http.MethodGet, "/jobs", nil, &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+func (c *Client) GetJob(ctx context.Context, id uint64) (*fc.Job, error) {
+	var job fc.Job
+	if err := c.doJSON(ctx, http.MethodGet, fmt.Sprintf("/jobs/%d", id), nil, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (c *Client) CancelJob(ctx context.Context, id uint64) (*fc.Job, error) {
+	var job fc.Job
+	if err := c.doJSON(ctx, http.MethodPost, fmt.Sprintf("/jobs/%d/cancel", id), nil, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// WaitJob polls a job until it is finished
+func (c *Client) WaitJob(ctx context.Context, id uint64) (*fc.Job, error) {
+	for {
+		job, err := c.GetJob(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+
+		if job.Finished() {
+			return job, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (c *Client) Add(ctx context.Context, r io.Reader, name string) (*AddResponse, error) {
+	path := "/add"
+	if name != "" {
+		path += "?name=" + url.QueryEscape(name)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	var res AddResponse
+	if err := c.do(req, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (c *Client) Pins(ctx context.Context) ([]*fc.Pin, error) {
+	var pins []*fc.Pin
+	if err := c.doJSON(ctx, http.MethodGet, "/pins", nil, &pins); err != nil {
+		return nil, err
+	}
+	return pins, nil
+}
+
+func (c *Client) Pin(ctx context.Context, root cid.Cid, name string, typ fc.PinType) (*fc.Pin, error) {
+	var pin fc.Pin
+	if err := c.doJSON(ctx, http.MethodPost, "/pins", PinRequest{Cid: root, Name: name, Type: typ}, &pin); err != nil {
+		return nil, err
+	}
+	return &pin, nil
+}
+
+func (c *Client) Unpin(ctx context.Context, root cid.Cid) error {
+	return c.doJSON(ctx, http.MethodDelete, "/pins/"+root.String(), nil, nil)
+}
+
+func (c *Client) VerifyPins(ctx context.Context, roots []cid.Cid) ([]*fc.PinStatus, error) {
+	query := url.Values{}
+	for _, root := range roots {
+		query.Add("cid", root.String())
+	}
+
+	var statuses []*fc.PinStatus
+	if err := c.doJSON(ctx, http.MethodGet, "/pins/verify?"+query.Encode(), nil, &statuses); err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+func (c *Client) Paychs(ctx context.Context) ([]*fc.PaychStatus, error) {
+	var statuses []*fc.PaychStatus
+	if err := c.doJSON(ctx, http.MethodGet, "/paych", nil, &statuses); err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+func (c *Client) PaychStatus(ctx context.Context, ch address.Address) (*fc.PaychStatus, error) {
+	var status fc.PaychStatus
+	if err := c.doJSON(ctx, http.MethodGet, "/paych/"+ch.String(), nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+func (c *Client) SettlePaych(ctx context.Context, ch address.Address) (cid.Cid, error) {
+	var res PaychMessageResponse
+	if err := c.doJSON(ctx, http.MethodPost, "/paych/"+ch.String()+"/settle", nil, &res); err != nil {
+		return cid.Undef, err
+	}
+	return res.Message, nil
+}
+
+func (c *Client) CollectPaych(ctx context.Context, ch address.Address) (cid.Cid, error) {
+	var res PaychMessageResponse
+	if err := c.doJSON(ctx, http.MethodPost, "/paych/"+ch.String()+"/collect", nil, &res); err != nil {
+		return cid.Undef, err
+	}
+	return res.Message, nil
+}
+
+func (c *Client) GC(ctx context.Context, target int64, policy fc.CachePolicy) (*fc.GCResult, error) {
+	var res fc.GCResult
+	if err := c.doJSON(ctx, http.MethodPost, "/gc", GCRequest{Target: target, Policy: policy}, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (c *Client) Query(ctx context.Context, req fc.QueryRequest) (*fc.QueryReport, error) {
+	var report fc.QueryReport
+	if err := c.doJSON(ctx, http.MethodPost, "/query", req, &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+func (c *Client) MakeDeal(ctx context.Context, req fc.DealRequest) (*fc.Deal, error) {
+	var deal fc.Deal
+	if err := c.doJSON(ctx, http.MethodPost, "/deals", req, &deal); err != nil {
+		return nil, err
+	}
+	return &deal, nil
+}
+
+func (c *Client) Deals(ctx context.Context) ([]*fc.Deal, error) {
+	var deals []*fc.Deal
+	if err := c.doJSON(ctx, http.MethodGet, "/deals", nil, &deals); err != nil {
+		return nil, err
+	}
+	return deals, nil
+}
+
+func (c *Client) Deal(ctx context.Context, id uint64) (*DealInfo, error) {
+	var info DealInfo
+	if err := c.doJSON(ctx, http.MethodGet, fmt.Sprintf("/deals/%d", id), nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (c *Client) Asks(ctx context.Context, miners []address.Address) ([]*fc.AskResult, error) {
+	var results []*fc.AskResult
+	if err := c.doJSON(ctx, http.MethodPost, "/asks", AsksRequest{Miners: miners}, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (c *Client) Policies(ctx context.Context) ([]*fc.ReplicationPolicy, error) {
+	var policies []*fc.ReplicationPolicy
+	if err := c.doJSON(ctx, http.MethodGet, "/replication", nil, &policies); err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+func (c *Client) SetPolicy(ctx context.Context, policy *fc.ReplicationPolicy) error {
+	return c.doJSON(ctx, http.MethodPost, "/replication", policy, nil)
+}
+
+func (c *Client) RemovePolicy(ctx context.Context, root cid.Cid) error {
+	return c.doJSON(ctx, http.MethodDelete, "/replication/"+root.String(), nil, nil)
+}
+
+func (c *Client) Staged(ctx context.Context) ([]*fc.StagedRoot, error) {
+	var staged []*fc.StagedRoot
+	if err := c.doJSON(ctx, http.MethodGet, "/staging", nil, &staged); err != nil {
+		return nil, err
+	}
+	return staged, nil
+}
+
+// Flush aggregates the staged files now, returning nil if none are staged
+func (c *Client) Flush(ctx context.Context) (*fc.Aggregate, error) {
+	var agg *fc.Aggregate
+	if err := c.doJSON(ctx, http.MethodPost, "/staging/flush", nil, &agg); err != nil {
+		return nil, err
+	}
+	return agg, nil
+}
+
+func (c *Client) Lookup(ctx context.Context, root cid.Cid) (*fc.AggregateEntry, error) {
+	var entry fc.AggregateEntry
+	if err := c.doJSON(ctx, http.MethodGet, "/aggregated/"+root.String(), nil, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (c *Client) Wallet(ctx context.Context) (*WalletInfo, error) {
+	var info WalletInfo
+	if err := c.doJSON(ctx, http.MethodGet, "/wallet", nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (c *Client) Node(ctx context.Context) (*NodeInfo, error) {
+	var info NodeInfo
+	if err := c.doJSON(ctx, http.MethodGet, "/node", nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (c *Client) doJSON(ctx context.Context, method, path string, body interface{}, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, r)
+	if err != nil {
+		return err
+	}
+	// The daemon refuses writes without it, even when there is no body
+	req.Header.Set("Content-Type", "application/json")
+
+	return c.do(req, out)
+}
+
+func (c *Client) do(req *http.Request, out interface{}) error {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var errResp errorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil || errResp.Error == "" {
+			return fmt.Errorf("daemon responded with status %v", resp.StatusCode)
+		}
+		return fmt.Errorf("daemon error: %s", errResp.Error)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
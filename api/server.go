@@ -0,0 +1,675 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	whypfs "github.com/application-research/whypfs-core"
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-cid"
+	"github.com/labstack/gommon/log"
+
+	fc "github.com/jlogelin/wormhole/filecoin"
+)
+
+// Server exposes the daemon's node, job queue and wallet over a local
+// HTTP/JSON API.
+type Server struct {
+	Node      *whypfs.Node
+	Retriever *fc.Retriever
+	Jobs      *fc.JobQueue
+	Pins      *fc.Pinset
+	Cache     *fc.Cache
+
+	// Looks up the providers to query when a query names no miners
+	Finder fc.CandidateFinder
+
+	Policies *fc.PolicyStore
+
+	// If set, small added files are staged and aggregated by it
+	Aggregator *fc.Aggregator
+
+	srv *http.Server
+}
+
+func NewServer(nd *whypfs.Node, r *fc.Retriever, jobs *fc.JobQueue, pins *fc.Pinset, cache *fc.Cache) *Server {
+	return &Server{
+		Node:      nd,
+		Retriever: r,
+		Jobs:      jobs,
+		Pins:      pins,
+		Cache:     cache,
+	}
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(RoutePrefix+"/jobs", s.handleJobs)
+	mux.HandleFunc(RoutePrefix+"/jobs/", s.handleJob)
+	mux.HandleFunc(RoutePrefix+"/add", s.handleAdd)
+	mux.HandleFunc(RoutePrefix+"/pins", s.handlePins)
+	mux.HandleFunc(RoutePrefix+"/pins/", s.handlePin)
+	mux.HandleFunc(RoutePrefix+"/gc", s.handleGC)
+	mux.HandleFunc(RoutePrefix+"/query", s.handleQuery)
+	mux.HandleFunc(RoutePrefix+"/deals", s.handleDeals)
+	mux.HandleFunc(RoutePrefix+"/deals/", s.handleDeal)
+	mux.HandleFunc(RoutePrefix+"/asks", s.handleAsks)
+	mux.HandleFunc(RoutePrefix+"/replication", s.handlePolicies)
+	mux.HandleFunc(RoutePrefix+"/replication/", s.handlePolicy)
+	mux.HandleFunc(RoutePrefix+"/staging", s.handleStaging)
+	mux.HandleFunc(RoutePrefix+"/staging/flush", s.handleFlush)
+	mux.HandleFunc(RoutePrefix+"/aggregated/", s.handleAggregated)
+	mux.HandleFunc(RoutePrefix+"/paych", s.handlePaychs)
+	mux.HandleFunc(RoutePrefix+"/paych/", s.handlePaych)
+	mux.HandleFunc(RoutePrefix+"/wallet", s.handleWallet)
+	mux.HandleFunc(RoutePrefix+"/node", s.handleNode)
+	return rejectBrowsers(mux)
+}
+
+// Only the CLI is meant to talk to the API. Like Kubo, refuse requests a web
+// page could make: anything carrying an Origin header, and writes that
+// aren't JSON (or the raw file body of an add), since a page can send form
+// and text bodies cross-origin without a preflight.
+func rejectBrowsers(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Origin") != "" {
+			writeError(w, http.StatusForbidden, errors.New("requests from browsers are not allowed"))
+			return
+		}
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			want := "application/json"
+			if r.URL.Path == RoutePrefix+"/add" {
+				want = "application/octet-stream"
+			}
+			if typ, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || typ != want {
+				writeError(w, http.StatusUnsupportedMediaType, fmt.Errorf("expected Content-Type %s", want))
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Start serves the API on listenAddr in the background and records the
+// address in apiFile so that CLI commands can find the daemon.
+func (s *Server) Start(listenAddr string, apiFile string) error {
+	ln, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(apiFile, []byte(ln.Addr().String()), 0644); err != nil {
+		ln.Close()
+		return err
+	}
+
+	s.srv = &http.Server{Handler: s.Handler()}
+	go func() {
+		if err := s.srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Errorf("API server stopped: %v", err)
+		}
+	}()
+
+	log.Infof("API server listening on %s", ln.Addr())
+
+	return nil
+}
+
+func (s *Server) Stop(ctx context.Context, apiFile string) error {
+	os.Remove(apiFile)
+
+	if s.srv == nil {
+		return nil
+	}
+	return s.srv.Shutdown(ctx)
+}
+
+func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		jobs, err := s.Jobs.List(r.Context())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, jobs)
+	case http.MethodPost:
+		var req SubmitJobRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid job request: %w", err))
+			return
+		}
+
+		job, err := s.Jobs.Enqueue(r.Context(), req.Request, req.Priority)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, job)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// Serves /jobs/<id> and /jobs/<id>/cancel
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, RoutePrefix+"/jobs/")
+	idStr, action, _ := strings.Cut(rest, "/")
+
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid job ID '%s'", idStr))
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+	case action == "cancel" && r.Method == http.MethodPost:
+		if err := s.Jobs.Cancel(r.Context(), id); err != nil {
+			writeJobError(w, err)
+			return
+		}
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("no route for %s %s", r.Method, r.URL.Path))
+		return
+	}
+
+	job, err := s.Jobs.Get(r.Context(), id)
+	if err != nil {
+		writeJobError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// Adds the request body to the node as a UnixFS file and pins it, named by
+// the optional name query parameter.
+func (s *Server) handleAdd(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	nd, err := s.Node.AddPinFile(r.Context(), r.Body, nil)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if _, err := s.Pins.Add(r.Context(), nd.Cid(), r.URL.Query().Get("name"), fc.PinRecursive); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := AddResponse{Cid: nd.Cid()}
+
+	if s.Aggregator != nil {
+		size, err := nd.Size()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		res.Staged, err = s.Retriever.Staging.Stage(r.Context(), nd.Cid(), size)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) handlePins(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		pins, err := s.Pins.List(r.Context())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, pins)
+	case http.MethodPost:
+		var req PinRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid pin request: %w", err))
+			return
+		}
+		if req.Type == "" {
+			req.Type = fc.PinRecursive
+		}
+
+		pin, err := s.Pins.Pin(r.Context(), s.Node.DAGService, req.Cid, req.Name, req.Type)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, pin)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// Serves /pins/verify and /pins/<cid>
+func (s *Server) handlePin(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, RoutePrefix+"/pins/")
+
+	if rest == "verify" {
+		s.handleVerifyPins(w, r)
+		return
+	}
+
+	c, err := cid.Decode(rest)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid CID '%s'", rest))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		pin, err := s.Pins.Get(r.Context(), c)
+		if err != nil {
+			writePinError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, pin)
+	case http.MethodDelete:
+		if err := s.Pins.Remove(r.Context(), c); err != nil {
+			writePinError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// Verifies the pins given as cid query parameters, or all pins
+func (s *Server) handleVerifyPins(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	var cids []cid.Cid
+	for _, cidStr := range r.URL.Query()["cid"] {
+		c, err := cid.Decode(cidStr)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid CID '%s'", cidStr))
+			return
+		}
+		cids = append(cids, c)
+	}
+
+	statuses, err := s.Pins.Verify(r.Context(), s.Node.Blockstore, cids)
+	if err != nil {
+		writePinError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+func (s *Server) handleGC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	var req GCRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid GC request: %w", err))
+		return
+	}
+
+	if req.Policy == "" {
+		req.Policy = s.Cache.Policy
+	}
+
+	res, err := s.Cache.GC(r.Context(), req.Target, req.Policy)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) handleQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	var req fc.QueryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid query request: %w", err))
+		return
+	}
+
+	report, err := s.Retriever.Query(r.Context(), req, s.Finder)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+func (s *Server) handleDeals(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		var req fc.DealRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid deal request: %w", err))
+			return
+		}
+
+		// The data transfer outlives the request
+		deal, err := s.Retriever.MakeDeal(s.Node.Ctx, req)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, deal)
+	case http.MethodGet:
+		deals, err := s.Retriever.Deals.List(r.Context())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, deals)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+func (s *Server) handleDeal(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	idStr := strings.TrimPrefix(r.URL.Path, RoutePrefix+"/deals/")
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid deal ID '%s'", idStr))
+		return
+	}
+
+	deal, err := s.Retriever.Deals.Get(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, fc.ErrDealNotFound) {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	events, err := s.Retriever.Deals.Events(r.Context(), id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &DealInfo{Deal: deal, Events: events})
+}
+
+func (s *Server) handleAsks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	var req AsksRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid asks request: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.Retriever.QueryAsks(r.Context(), req.Miners))
+}
+
+func (s *Server) handlePolicies(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		policies, err := s.Policies.List(r.Context())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, policies)
+	case http.MethodPost:
+		var policy fc.ReplicationPolicy
+		if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid replication policy: %w", err))
+			return
+		}
+
+		if err := s.Policies.Set(r.Context(), &policy); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, &policy)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+func (s *Server) handlePolicy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	cidStr := strings.TrimPrefix(r.URL.Path, RoutePrefix+"/replication/")
+	c, err := cid.Decode(cidStr)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid CID '%s': %w", cidStr, err))
+		return
+	}
+
+	if err := s.Policies.Remove(r.Context(), c); err != nil {
+		if errors.Is(err, fc.ErrPolicyNotFound) {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleStaging(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	staged, err := s.Retriever.Staging.Staged(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, staged)
+}
+
+// Aggregates the staged files now, responding with null if none are staged
+func (s *Server) handleFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	if s.Aggregator == nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("aggregation is not enabled in the daemon's config"))
+		return
+	}
+
+	// The data transfer of the deal outlives the request
+	agg, err := s.Aggregator.Flush(s.Node.Ctx, true)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, agg)
+}
+
+func (s *Server) handleAggregated(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	cidStr := strings.TrimPrefix(r.URL.Path, RoutePrefix+"/aggregated/")
+	c, err := cid.Decode(cidStr)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid CID '%s': %w", cidStr, err))
+		return
+	}
+
+	entry, err := s.Retriever.Staging.Lookup(r.Context(), c)
+	if err != nil {
+		if errors.Is(err, fc.ErrNotAggregated) {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, entry)
+}
+
+func (s *Server) handlePaychs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	statuses, err := s.Retriever.Paych.List(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+// Serves /paych/<addr>, /paych/<addr>/settle and /paych/<addr>/collect
+func (s *Server) handlePaych(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, RoutePrefix+"/paych/")
+	addrStr, action, _ := strings.Cut(rest, "/")
+
+	ch, err := address.NewFromString(addrStr)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid channel address '%s'", addrStr))
+		return
+	}
+
+	var msg cid.Cid
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		status, err := s.Retriever.Paych.Status(r.Context(), ch)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if status == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("channel %s is inbound", ch))
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+		return
+	case action == "settle" && r.Method == http.MethodPost:
+		msg, err = s.Retriever.Paych.Settle(r.Context(), ch)
+	case action == "collect" && r.Method == http.MethodPost:
+		msg, err = s.Retriever.Paych.Collect(r.Context(), ch)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("no route for %s %s", r.Method, r.URL.Path))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, PaychMessageResponse{Message: msg})
+}
+
+func (s *Server) handleWallet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	var info WalletInfo
+
+	info.Default = s.Retriever.ClientAddr
+
+	addrs, err := s.Retriever.Signer.WalletList(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	info.Addresses = addrs
+
+	balance, err := s.Retriever.FilClient.Balance(r.Context())
+	if err != nil {
+		info.BalanceError = err.Error()
+	} else {
+		info.Balance = balance
+	}
+
+	writeJSON(w, http.StatusOK, info)
+}
+
+func (s *Server) handleNode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	info := NodeInfo{
+		PeerID: s.Node.Host.ID(),
+		Peers:  s.Node.Host.Network().Peers(),
+	}
+	for _, addr := range s.Node.Host.Addrs() {
+		info.Addrs = append(info.Addrs, addr.String())
+	}
+
+	writeJSON(w, http.StatusOK, info)
+}
+
+func writeJobError(w http.ResponseWriter, err error) {
+	if errors.Is(err, fc.ErrJobNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeError(w, http.StatusBadRequest, err)
+}
+
+func writePinError(w http.ResponseWriter, err error) {
+	if errors.Is(err, fc.ErrPinNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Failed to write API response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
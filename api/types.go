@@ -0,0 +1,71 @@
+package api
+
+import (
+	"github.com/application-research/filclient"
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	fc "github.com/jlogelin/wormhole/filecoin"
+)
+
+// Prefix of every route served by the control API
+const RoutePrefix = "/api/v0"
+
+type SubmitJobRequest struct {
+	Request  fc.GetRequest `json:"request"`
+	Priority int           `json:"priority"`
+}
+
+type AddResponse struct {
+	Cid cid.Cid `json:"cid"`
+
+	// Whether the file was staged for aggregation
+	Staged bool `json:"staged,omitempty"`
+}
+
+type WalletInfo struct {
+	Default   address.Address   `json:"default"`
+	Addresses []address.Address `json:"addresses"`
+
+	// Balance is unset if the chain could not be reached, in which case
+	// BalanceError says why
+	Balance      *filclient.Balance `json:"balance,omitempty"`
+	BalanceError string             `json:"balanceError,omitempty"`
+}
+
+type NodeInfo struct {
+	PeerID peer.ID   `json:"peerId"`
+	Addrs  []string  `json:"addrs"`
+	Peers  []peer.ID `json:"peers"`
+}
+
+type PinRequest struct {
+	Cid  cid.Cid    `json:"cid"`
+	Name string     `json:"name,omitempty"`
+	Type fc.PinType `json:"type,omitempty"`
+}
+
+// The message sent to settle or collect a payment channel
+type PaychMessageResponse struct {
+	Message cid.Cid `json:"message"`
+}
+
+type GCRequest struct {
+	Target int64          `json:"target"`
+	Policy fc.CachePolicy `json:"policy"`
+}
+
+type AsksRequest struct {
+	Miners []address.Address `json:"miners"`
+}
+
+// DealInfo is a deal with its event log
+type DealInfo struct {
+	Deal   *fc.Deal        `json:"deal"`
+	Events []*fc.DealEvent `json:"events"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
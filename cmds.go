@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+	"github.com/urfave/cli/v2"
+
+	"github.com/jlogelin/wormhole/api"
+	fc "github.com/jlogelin/wormhole/filecoin"
+	"github.com/jlogelin/wormhole/gateway"
+)
+
+var daemonCmd = &cli.Command{
+	Name:  "daemon",
+	Usage: "Run the wormhole node and process the retrieval job queue until interrupted",
+	Flags: []cli.Flag{
+		flagWorkers,
+		flagAPIListen,
+		flagGatewayListen,
+		flagGatewayFilecoin,
+		flagFallbackBlockstore,
+		flagFallbackRemoteBudget,
+		flagFallbackRemoteRate,
+		flagCandidatesEndpoint,
+		flagProvide,
+		flagReprovideInterval,
+		flagCacheSize,
+		flagCachePolicy,
+		flagGCInterval,
+		flagSigner,
+		flagSignerAddress,
+		flagMaxPrice,
+	},
+	Action: func(cctx *cli.Context) error {
+		ctx, cancel := context.WithCancel(cctx.Context)
+		defer cancel()
+
+		BootstrapWhyPFS()
+
+		r, closer, err := parseRetriever(cctx)
+		if err != nil {
+			return err
+		}
+		defer closer()
+
+		provider, err := parseProvider(cctx)
+		if err != nil {
+			return err
+		}
+		r.Provider = provider
+		go provider.Run(ctx, cctx.Duration(flagReprovideInterval.Name))
+
+		// The cache has to manage the local blockstore, not the fallback one
+		cache, err := parseCache(cctx, r.Pins)
+		if err != nil {
+			return err
+		}
+		r.Cache = cache
+		go cache.Run(ctx, cctx.Duration(flagGCInterval.Name))
+
+		if r.QueryCache != nil {
+			go r.QueryCache.Run(ctx)
+		}
+
+		var fallback *fc.FallbackBlockstore
+		if cctx.Bool(flagFallbackBlockstore.Name) {
+			if cctx.String(flagCandidatesEndpoint.Name) == "" {
+				return fmt.Errorf("the %s profile has no candidates endpoint, set --%s to use the fallback blockstore", cfg.Chain.Profile, flagCandidatesEndpoint.Name)
+			}
+			fallback, err = parseFallbackBlockstore(cctx, r)
+			if err != nil {
+				return err
+			}
+			fc.ServeBlockstore(node, fallback)
+		}
+
+		go fc.NewDealTracker(r).Run(ctx)
+
+		policies := fc.NewPolicyStore(node.Datastore)
+		go fc.NewReplicator(r, policies).Run(ctx)
+
+		if cfg.Renewal.Enabled {
+			renewer, err := parseRenewer(r, policies)
+			if err != nil {
+				return err
+			}
+			go renewer.Run(ctx)
+		}
+
+		var aggregator *fc.Aggregator
+		if cfg.Aggregation.Enabled {
+			aggregator, err = parseAggregator(r)
+			if err != nil {
+				return err
+			}
+			go aggregator.Run(ctx)
+		}
+
+		queue := fc.NewJobQueue(node.Datastore, r, cctx.Int(flagWorkers.Name))
+		if err := queue.Start(ctx); err != nil {
+			return err
+		}
+
+		srv := api.NewServer(node, r, queue, r.Pins, cache)
+		srv.Finder = parseCandidateFinder(cctx)
+		srv.Policies = policies
+		srv.Aggregator = aggregator
+		if err := srv.Start(cctx.String(flagAPIListen.Name), apiFile); err != nil {
+			return err
+		}
+
+		if gwAddr := cctx.String(flagGatewayListen.Name); gwAddr != "" {
+			gw := gateway.New(node, r)
+			if cctx.Bool(flagGatewayFilecoin.Name) {
+				gw.Network = fc.NetworkAuto
+				// Blocks enclosed in other roots' deals can be found too
+				if fallback != nil {
+					gw.Blockstore = fallback
+				}
+			}
+			go func() {
+				if err := gw.Serve(ctx, gwAddr); err != nil {
+					fmt.Println("gateway stopped:", err)
+				}
+			}()
+		}
+
+		LoopForever()
+
+		return srv.Stop(context.Background(), apiFile)
+	},
+}
+
+var getCmd = &cli.Command{
+	Name:        "get",
+	Usage:       "Retrieve content by CID over IPFS or Filecoin",
+	Description: "Retrieve content by CID. If desired, multiple miners can be specified as fallbacks in case of a failure (comma-separated, no spaces). With --batch, every entry of a manifest file is retrieved instead.",
+	ArgsUsage:   "<cid>",
+	Flags: []cli.Flag{
+		flagMiners,
+		flagOutput,
+		flagNetwork,
+		flagDmPathSel,
+		flagBatch,
+		flagConcurrency,
+		flagResume,
+		flagReport,
+		flagProvide,
+		flagPin,
+		flagSigner,
+		flagSignerAddress,
+		flagMaxPrice,
+	},
+	Action: func(cctx *cli.Context) error {
+		if cctx.IsSet(flagBatch.Name) {
+			return getBatch(cctx)
+		}
+
+		req, err := parseGetRequest(cctx)
+		if err != nil {
+			return err
+		}
+		if req.Output == "" {
+			req.Output = req.Cid.String()
+		}
+
+		client, err := dialDaemon(cctx.Context)
+		if err != nil {
+			return err
+		}
+		if client != nil {
+			return getThroughDaemon(cctx, client, req)
+		}
+
+		provide, err := fc.ParseProvideStrategy(cctx.String(flagProvide.Name))
+		if err != nil {
+			return err
+		}
+
+		BootstrapWhyPFS()
+
+		r, closer, err := parseRetriever(cctx)
+		if err != nil {
+			return err
+		}
+		defer closer()
+		r.Provider = fc.NewProvider(node, provide)
+
+		// Only tracked, so that the daemon or 'wormhole gc' can evict it later
+		r.Cache = fc.NewCache(node.Datastore, node.Blockstore, r.Pins, fc.CacheLRU, 0)
+
+		stats, err := r.Retrieve(cctx.Context, req)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Retrieved %s: %d bytes in %v\n", req.Cid, stats.GetByteSize(), stats.GetDuration())
+
+		return nil
+	},
+}
+
+var queryCmd = &cli.Command{
+	Name:        "query",
+	Usage:       "Compare what retrieving a CID would cost from each provider",
+	Description: "Query the Filecoin providers of a CID for their retrieval terms and check whether it is available on IPFS, without retrieving or paying anything. The providers are the --miners given, or else looked up with the candidates endpoint. They are listed best first, in the order a retrieval would try them.",
+	ArgsUsage:   "<cid>",
+	Flags: []cli.Flag{
+		flagMiners,
+		flagCandidatesEndpoint,
+		flagMaxPrice,
+		flagJSON,
+		flagVerbose,
+	},
+	Action: func(cctx *cli.Context) error {
+		c, err := parseCidArg(cctx)
+		if err != nil {
+			return err
+		}
+
+		miners, err := parseMiners(cctx)
+		if err != nil {
+			return err
+		}
+
+		req := fc.QueryRequest{Cid: c, Miners: miners}
+
+		var report *fc.QueryReport
+
+		client, err := dialDaemon(cctx.Context)
+		if err != nil {
+			return err
+		}
+		if client != nil {
+			report, err = client.Query(cctx.Context, req)
+		} else {
+			report, err = queryLocally(cctx, req)
+		}
+		if err != nil {
+			return err
+		}
+
+		if cctx.Bool(flagJSON.Name) {
+			return printJSON(report)
+		}
+
+		fc.PrintQueryReport(report, cctx.Bool(flagVerbose.Name))
+
+		return nil
+	},
+}
+
+func queryLocally(cctx *cli.Context, req fc.QueryRequest) (*fc.QueryReport, error) {
+	BootstrapWhyPFS()
+
+	r, closer, err := parseRetriever(cctx)
+	if err != nil {
+		return nil, err
+	}
+	defer closer()
+
+	return r.Query(cctx.Context, req, parseCandidateFinder(cctx))
+}
+
+// Hand the retrieval to the running daemon as a job and wait for it to finish
+func getThroughDaemon(cctx *cli.Context, client *api.Client, req fc.GetRequest) error {
+	// The daemon may run from another directory
+	output, err := filepath.Abs(req.Output)
+	if err != nil {
+		return err
+	}
+	req.Output = output
+
+	job, err := client.SubmitJob(cctx.Context, req, 0)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Submitted job %d to the daemon, waiting for it to finish...\n", job.ID)
+
+	job, err = client.WaitJob(cctx.Context, job.ID)
+	if err != nil {
+		return err
+	}
+
+	if job.State == fc.JobFailed {
+		return fmt.Errorf("retrieval failed: %s", job.Error)
+	}
+
+	fmt.Println("Saved output to", req.Output)
+
+	return nil
+}
+
+var addCmd = &cli.Command{
+	Name:      "add",
+	Usage:     "Add a file to the node and pin it",
+	ArgsUsage: "<file path>",
+	Action: func(cctx *cli.Context) error {
+		if !cctx.Args().Present() {
+			return fmt.Errorf("please specify file to add")
+		}
+
+		fi, err := os.Open(cctx.Args().First())
+		if err != nil {
+			return err
+		}
+		defer fi.Close()
+
+		name := filepath.Base(fi.Name())
+
+		client, err := dialDaemon(cctx.Context)
+		if err != nil {
+			return err
+		}
+		if client != nil {
+			res, err := client.Add(cctx.Context, fi, name)
+			if err != nil {
+				return err
+			}
+
+			fmt.Println("File CID:", res.Cid)
+			if res.Staged {
+				fmt.Println("Staged for aggregation")
+			}
+			return nil
+		}
+
+		BootstrapWhyPFS()
+
+		nd, err := node.AddPinFile(cctx.Context, fi, nil)
+		if err != nil {
+			return err
+		}
+
+		if _, err := fc.NewPinset(node.Datastore).Add(cctx.Context, nd.Cid(), name, fc.PinRecursive); err != nil {
+			return err
+		}
+
+		fmt.Println("File CID:", nd.Cid())
+
+		// The daemon aggregates it once it runs
+		if cfg.Aggregation.Enabled {
+			size, err := nd.Size()
+			if err != nil {
+				return err
+			}
+
+			staging := fc.NewStaging(node.Datastore)
+			staging.MaxFileSize = uint64(cfg.Aggregation.MaxFileSize)
+			staged, err := staging.Stage(cctx.Context, nd.Cid(), size)
+			if err != nil {
+				return err
+			}
+			if staged {
+				fmt.Println("Staged for aggregation")
+			}
+		}
+
+		return nil
+	},
+}
+
+var gcCmd = &cli.Command{
+	Name:      "gc",
+	Usage:     "Evict retrieved content tracked by the cache that isn't pinned from the blockstore",
+	ArgsUsage: " ",
+	Flags: []cli.Flag{
+		flagGCTarget,
+		flagCachePolicy,
+	},
+	Action: func(cctx *cli.Context) error {
+		target, err := parseSize(cctx, flagGCTarget)
+		if err != nil {
+			return err
+		}
+
+		policy, err := fc.ParseCachePolicy(cctx.String(flagCachePolicy.Name))
+		if err != nil {
+			return err
+		}
+
+		var res *fc.GCResult
+
+		client, err := dialDaemon(cctx.Context)
+		if err != nil {
+			return err
+		}
+		if client != nil {
+			res, err = client.GC(cctx.Context, target, policy)
+		} else {
+			BootstrapWhyPFS()
+
+			cache := fc.NewCache(node.Datastore, node.Blockstore, fc.NewPinset(node.Datastore), policy, 0)
+			res, err = cache.GC(cctx.Context, target, policy)
+		}
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Evicted %d roots, removed %d blocks (%s), %s of cached content left\n",
+			len(res.Evicted), res.BlocksRemoved, humanize.IBytes(uint64(res.BytesFreed)), humanize.IBytes(uint64(res.Size)))
+
+		return nil
+	},
+}
+
+var infoCmd = &cli.Command{
+	Name:      "info",
+	Usage:     "Display node and wallet information of the running daemon",
+	ArgsUsage: " ",
+	Action: func(cctx *cli.Context) error {
+		client, err := dialDaemon(cctx.Context)
+		if err != nil {
+			return err
+		}
+		if client == nil {
+			return fmt.Errorf("no running daemon found, start one with 'wormhole %s'", daemonCmd.Name)
+		}
+
+		nodeInfo, err := client.Node(cctx.Context)
+		if err != nil {
+			return err
+		}
+
+		walletInfo, err := client.Wallet(cctx.Context)
+		if err != nil {
+			return err
+		}
+
+		return printJSON(struct {
+			Node   *api.NodeInfo   `json:"node"`
+			Wallet *api.WalletInfo `json:"wallet"`
+		}{nodeInfo, walletInfo})
+	},
+}
+
+// Connect to the running daemon's API, returning a nil client if there is no
+// daemon running.
+func dialDaemon(ctx context.Context) (*api.Client, error) {
+	return api.Dial(ctx, apiFile)
+}
+
+func getBatch(cctx *cli.Context) error {
+	provide, err := fc.ParseProvideStrategy(cctx.String(flagProvide.Name))
+	if err != nil {
+		return err
+	}
+
+	BootstrapWhyPFS()
+
+	r, closer, err := parseRetriever(cctx)
+	if err != nil {
+		return err
+	}
+	defer closer()
+	r.Provider = fc.NewProvider(node, provide)
+	r.Cache = fc.NewCache(node.Datastore, node.Blockstore, r.Pins, fc.CacheLRU, 0)
+
+	report, err := fc.GetBatch(cctx.Context, r, cctx.String(flagBatch.Name), fc.BatchOptions{
+		Concurrency: cctx.Int(flagConcurrency.Name),
+		Network:     parseNetwork(cctx),
+		Miners:      splitMiners(cctx.StringSlice(flagMiners.Name)),
+		Resume:      cctx.Bool(flagResume.Name),
+	})
+	if err != nil {
+		return err
+	}
+
+	if reportPath := cctx.String(flagReport.Name); reportPath != "" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		if err := os.WriteFile(reportPath, data, 0644); err != nil {
+			return err
+		}
+	}
+
+	if report.Failed > 0 {
+		return fmt.Errorf("%d of %d batch entries failed, rerun with --%s to retry them", report.Failed, len(report.Results), flagResume.Name)
+	}
+
+	return nil
+}
+
+func parseNetwork(cctx *cli.Context) string {
+	return strings.ToLower(strings.TrimSpace(cctx.String(flagNetwork.Name)))
+}
@@ -0,0 +1,563 @@
+package config
+
+import (
+	"bytes"
+	"encoding"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/dustin/go-humanize"
+	"github.com/labstack/gommon/log"
+	"github.com/mitchellh/go-homedir"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// Directory wormhole keeps its wallet and other state in
+	PathEnv = "WORMHOLE_PATH"
+
+	// Config file to use instead of config.toml in the wormhole directory
+	ConfigEnv = "WORMHOLE_CONFIG"
+
+	// Prefix of the variables overriding single settings, followed by the
+	// section and key, e.g. WORMHOLE_NODE_LISTEN_ADDRS
+	EnvPrefix = "WORMHOLE_"
+
+	DefaultPath = "~/.whypfs"
+
+	configFile = "config.toml"
+)
+
+type Config struct {
+	Node      Node      `toml:"node"`
+	Chain     Chain     `toml:"chain"`
+	Retrieval Retrieval `toml:"retrieval"`
+	Daemon    Daemon    `toml:"daemon"`
+	Renewal   Renewal   `toml:"renewal"`
+
+	Aggregation Aggregation `toml:"aggregation"`
+
+	// Network profiles defined in addition to the built in ones
+	Profiles map[string]Profile `toml:"profiles"`
+}
+
+// Node configures the libp2p host and storage of the WhyPFS node. Relative
+// paths are relative to the wormhole directory, see Dir.
+type Node struct {
+	Libp2pKeyFile string `toml:"libp2p-key-file"`
+	DatastoreDir  string `toml:"datastore-dir"`
+
+	// Directory WhyPFS keeps its flatfs blockstore in, under blocks/
+	Repo string `toml:"repo"`
+
+	ListenAddrs   []string `toml:"listen-addrs"`
+	AnnounceAddrs []string `toml:"announce-addrs"`
+
+	BitswapMaxOutstandingBytesPerPeer Size `toml:"bitswap-max-outstanding-bytes-per-peer"`
+	BitswapTargetMessageSize          Size `toml:"bitswap-target-message-size"`
+}
+
+type Chain struct {
+	// Network profile to use, see Profiles
+	Profile string `toml:"profile"`
+
+	// Lotus gateway used for chain state, messages and payment channels,
+	// the profile's if empty
+	APIURL string `toml:"api-url"`
+}
+
+type Retrieval struct {
+	// Network to retrieve from by default [fil|ipfs|auto]
+	Network string `toml:"network"`
+
+	// The profile's if empty
+	CandidatesEndpoint string `toml:"candidates-endpoint"`
+
+	// What to announce to the DHT after a Filecoin retrieval
+	Provide string `toml:"provide"`
+
+	// Batch entries retrieved at the same time
+	Concurrency int `toml:"concurrency"`
+
+	// Most a single Filecoin retrieval may cost in FIL, empty for no limit
+	MaxPrice string `toml:"max-price"`
+
+	// Storage providers queried at the same time, all at once if 0
+	QueryConcurrency int `toml:"query-concurrency"`
+
+	// How long a storage provider may take to answer a query, no limit if 0
+	QueryTimeout Duration `toml:"query-timeout"`
+
+	// How long query answers are reused for, not cached if 0
+	QueryCacheTTL Duration `toml:"query-cache-ttl"`
+}
+
+type Daemon struct {
+	APIListen     string `toml:"api-listen"`
+	GatewayListen string `toml:"gateway-listen"`
+	Workers       int    `toml:"workers"`
+	CacheSize     Size   `toml:"cache-size"`
+	CachePolicy   string `toml:"cache-policy"`
+}
+
+// Renewal configures how the daemon replaces deals before they expire
+type Renewal struct {
+	Enabled bool `toml:"enabled"`
+
+	// Epochs before the end of a deal its replacement is proposed
+	RenewBefore int `toml:"renew-before"`
+
+	// Miners to try after the one holding the deal, in order
+	Miners []string `toml:"miners"`
+
+	// Most a renewal may cost in FIL per GiB per epoch, empty for no limit
+	MaxPrice string `toml:"max-price"`
+
+	// Most all renewals may cost together in FIL, empty for no limit
+	Budget string `toml:"budget"`
+
+	// How often expiring deals are looked for
+	Interval Duration `toml:"interval"`
+}
+
+// Aggregation configures how the daemon bundles small added files into one
+// deal
+type Aggregation struct {
+	Enabled bool `toml:"enabled"`
+
+	// Added roots up to this size are staged
+	MaxFileSize Size `toml:"max-file-size"`
+
+	// Staged roots are aggregated once they add up to TargetSize, there are
+	// MaxFiles of them or the oldest was staged MaxAge ago
+	TargetSize Size     `toml:"target-size"`
+	MaxFiles   int      `toml:"max-files"`
+	MaxAge     Duration `toml:"max-age"`
+
+	// Miners to make aggregate deals with, the cheapest first
+	Miners []string `toml:"miners"`
+
+	// Length of aggregate deals in epochs
+	Duration int `toml:"duration"`
+
+	Verified      bool `toml:"verified"`
+	FastRetrieval bool `toml:"fast-retrieval"`
+
+	// Most an aggregate deal may cost in FIL per GiB per epoch, empty for no
+	// limit
+	MaxPrice string `toml:"max-price"`
+
+	// How often the staged roots are checked
+	Interval Duration `toml:"interval"`
+}
+
+// Size is a byte size written like "20MiB" in the config
+type Size uint64
+
+func (s Size) MarshalText() ([]byte, error) {
+	return []byte(humanize.IBytes(uint64(s))), nil
+}
+
+func (s *Size) UnmarshalText(text []byte) error {
+	n, err := humanize.ParseBytes(string(text))
+	if err != nil {
+		return fmt.Errorf("invalid size '%s': %w", text, err)
+	}
+	*s = Size(n)
+	return nil
+}
+
+// Duration is written like "30s" in the config
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	dur, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("invalid duration '%s': %w", text, err)
+	}
+	*d = Duration(dur)
+	return nil
+}
+
+// Default is the configuration used for anything the config file and
+// environment leave out
+func Default() *Config {
+	return &Config{
+		Node: Node{
+			Libp2pKeyFile:                     "libp2p.key",
+			DatastoreDir:                      "datastore",
+			Repo:                              ".",
+			ListenAddrs:                       []string{"/ip4/0.0.0.0/tcp/6746"},
+			BitswapMaxOutstandingBytesPerPeer: 20 << 20,
+			BitswapTargetMessageSize:          2 << 20,
+		},
+		Chain: Chain{
+			Profile: "mainnet",
+		},
+		Retrieval: Retrieval{
+			Network:     "auto",
+			Provide:     "roots",
+			Concurrency: 4,
+
+			QueryConcurrency: 8,
+			QueryTimeout:     Duration(30 * time.Second),
+			QueryCacheTTL:    Duration(30 * time.Minute),
+		},
+		Daemon: Daemon{
+			APIListen:     "127.0.0.1:6747",
+			GatewayListen: "127.0.0.1:8080",
+			Workers:       2,
+			CachePolicy:   "lru",
+		},
+		Renewal: Renewal{
+			RenewBefore: 7 * 2880,
+			Interval:    Duration(time.Hour),
+		},
+		Aggregation: Aggregation{
+			MaxFileSize:   4 << 20,
+			TargetSize:    1 << 30,
+			MaxFiles:      4096,
+			MaxAge:        Duration(24 * time.Hour),
+			Duration:      180 * 2880,
+			FastRetrieval: true,
+			Interval:      Duration(10 * time.Minute),
+		},
+	}
+}
+
+// Dir is the wormhole directory, $WORMHOLE_PATH or ~/.whypfs
+func Dir() (string, error) {
+	dir := os.Getenv(PathEnv)
+	if dir == "" {
+		dir = DefaultPath
+	}
+
+	return homedir.Expand(dir)
+}
+
+// Path is the config file to use, $WORMHOLE_CONFIG or config.toml in Dir
+func Path() (string, error) {
+	if path := os.Getenv(ConfigEnv); path != "" {
+		return homedir.Expand(path)
+	}
+
+	dir, err := Dir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, configFile), nil
+}
+
+// Load reads the config file at path over the defaults, then applies the
+// environment overrides. A missing file is the same as an empty one.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	md, err := toml.DecodeFile(path, cfg)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, xerrors.Errorf("reading config %s: %w", path, err)
+	}
+
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("unknown setting '%s' in config %s", undecoded[0], path)
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+
+	dir, err := Dir()
+	if err != nil {
+		return nil, err
+	}
+	cfg.resolvePaths(dir)
+
+	return cfg, nil
+}
+
+// Make the node's relative paths relative to dir. They used to be relative
+// to the directory wormhole was started in, with the blocks in .whypfs/blocks:
+// where nothing is at the new location but something is at the old one, the
+// old one is kept so that existing nodes keep their peer ID and content.
+func (cfg *Config) resolvePaths(dir string) {
+	repo := cfg.Node.Repo
+	if repo == Default().Node.Repo {
+		repo = ".whypfs"
+	}
+
+	for _, p := range []struct {
+		path *string
+		// What to look for at the new and the old location
+		sub    string
+		legacy string
+	}{
+		{&cfg.Node.Libp2pKeyFile, "", cfg.Node.Libp2pKeyFile},
+		{&cfg.Node.DatastoreDir, "", cfg.Node.DatastoreDir},
+		{&cfg.Node.Repo, "blocks", repo},
+	} {
+		if filepath.IsAbs(*p.path) {
+			continue
+		}
+
+		resolved := filepath.Join(dir, *p.path)
+		if !exists(filepath.Join(resolved, p.sub)) && exists(filepath.Join(p.legacy, p.sub)) {
+			if legacy, err := filepath.Abs(p.legacy); err == nil && legacy != resolved {
+				log.Warnf("Using %s from the current directory, move it to %s to use it from anywhere", legacy, resolved)
+				resolved = legacy
+			}
+		}
+
+		*p.path = resolved
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Override each setting from WORMHOLE_<SECTION>_<KEY> if it is set, lists
+// being comma separated
+func (cfg *Config) applyEnv() error {
+	sections := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		section := sections.Field(i)
+		sectionName := sections.Type().Field(i).Tag.Get("toml")
+
+		// Profiles are only defined in the file
+		if section.Kind() != reflect.Struct {
+			continue
+		}
+
+		for j := 0; j < section.NumField(); j++ {
+			key := section.Type().Field(j).Tag.Get("toml")
+
+			env := envName(sectionName, key)
+			val, ok := os.LookupEnv(env)
+			if !ok {
+				continue
+			}
+
+			if err := setField(section.Field(j), val); err != nil {
+				return xerrors.Errorf("%s: %w", env, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func envName(section, key string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(section+"_"+key, "-", "_"))
+}
+
+func setField(field reflect.Value, val string) error {
+	if u, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(val))
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(val)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case reflect.Slice:
+		var list []string
+		for _, s := range strings.Split(val, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				list = append(list, s)
+			}
+		}
+		field.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Type())
+	}
+
+	return nil
+}
+
+var defaultTemplate = template.Must(template.New("config").Funcs(template.FuncMap{
+	"list": func(l []string) string {
+		quoted := make([]string, len(l))
+		for i, s := range l {
+			quoted[i] = strconv.Quote(s)
+		}
+		return "[" + strings.Join(quoted, ", ") + "]"
+	},
+	"size": func(s Size) string {
+		return strconv.Quote(humanize.IBytes(uint64(s)))
+	},
+	"duration": func(d Duration) string {
+		return strconv.Quote(time.Duration(d).String())
+	},
+}).Parse(`# wormhole configuration
+#
+# Every setting can be overridden with an environment variable named after its
+# section and key, e.g. WORMHOLE_NODE_LISTEN_ADDRS or WORMHOLE_CHAIN_API_URL.
+# Lists are comma separated in the environment. Command line flags take
+# precedence over both.
+
+[node]
+# Relative paths are relative to the wormhole directory, $WORMHOLE_PATH or
+# ~/.whypfs
+libp2p-key-file = {{ printf "%q" .Node.Libp2pKeyFile }}
+datastore-dir = {{ printf "%q" .Node.DatastoreDir }}
+# Directory the blocks are kept in, under blocks/
+repo = {{ printf "%q" .Node.Repo }}
+
+listen-addrs = {{ list .Node.ListenAddrs }}
+# Addresses to announce instead of the listen addresses
+announce-addrs = {{ list .Node.AnnounceAddrs }}
+
+bitswap-max-outstanding-bytes-per-peer = {{ size .Node.BitswapMaxOutstandingBytesPerPeer }}
+bitswap-target-message-size = {{ size .Node.BitswapTargetMessageSize }}
+
+[chain]
+# Network profile bundling the chain gateway, bootstrap peers, address prefix
+# and candidates endpoint [mainnet|calibration|<one of the profiles below>]
+profile = {{ printf "%q" .Chain.Profile }}
+
+# Lotus gateway used for chain state, messages and payment channels, empty for
+# the profile's
+api-url = {{ printf "%q" .Chain.APIURL }}
+
+[retrieval]
+# Network to retrieve from unless --network is given [fil|ipfs|auto]
+network = {{ printf "%q" .Retrieval.Network }}
+
+# Where to look up Filecoin storage providers holding a CID, empty for the
+# profile's
+candidates-endpoint = {{ printf "%q" .Retrieval.CandidatesEndpoint }}
+
+# What to announce to the DHT after a Filecoin retrieval [roots|all|none]
+provide = {{ printf "%q" .Retrieval.Provide }}
+
+# Batch entries retrieved at the same time
+concurrency = {{ .Retrieval.Concurrency }}
+
+# Most a single Filecoin retrieval may cost, e.g. "0.01" FIL. Providers asking
+# for more are skipped. Empty for no limit.
+max-price = {{ printf "%q" .Retrieval.MaxPrice }}
+
+# Storage providers queried at the same time before a retrieval, 0 for all at
+# once
+query-concurrency = {{ .Retrieval.QueryConcurrency }}
+# How long a storage provider may take to answer a query, "0s" for no limit
+query-timeout = {{ duration .Retrieval.QueryTimeout }}
+# How long query answers are reused for, "0s" to always ask again
+query-cache-ttl = {{ duration .Retrieval.QueryCacheTTL }}
+
+[daemon]
+api-listen = {{ printf "%q" .Daemon.APIListen }}
+# Empty to disable the /ipfs/ HTTP gateway
+gateway-listen = {{ printf "%q" .Daemon.GatewayListen }}
+
+# Retrieval jobs processed at the same time
+workers = {{ .Daemon.Workers }}
+
+# Size the retrieved content is garbage collected down to, "0" for no limit
+cache-size = {{ size .Daemon.CacheSize }}
+# Which retrieved content to evict first [lru|lfu]
+cache-policy = {{ printf "%q" .Daemon.CachePolicy }}
+
+[renewal]
+# Propose replacement deals for the deals made through wormhole before they
+# expire, keeping their duration and verified status. Roots with a
+# replication policy are left to it.
+enabled = {{ .Renewal.Enabled }}
+
+# Epochs before the end of a deal its replacement is proposed, 2880 a day. New
+# deals start 20160 epochs (7 days) after they are proposed, so this can't be
+# less than that.
+renew-before = {{ .Renewal.RenewBefore }}
+
+# Miners to renew with if the one holding the deal doesn't take it, in order
+miners = {{ list .Renewal.Miners }}
+
+# Most a renewal may cost per GiB per epoch, e.g. "0.0000000001" FIL. Empty
+# for no limit.
+max-price = {{ printf "%q" .Renewal.MaxPrice }}
+# Most all renewals may cost together, e.g. "1" FIL. Empty for no limit.
+budget = {{ printf "%q" .Renewal.Budget }}
+
+# How often to look for expiring deals
+interval = {{ duration .Renewal.Interval }}
+
+[aggregation]
+# Stage small added files and store them in one deal once enough of them are
+# staged. Retrievals of a staged file from Filecoin go through the aggregate.
+enabled = {{ .Aggregation.Enabled }}
+
+# Files up to this size are staged, larger ones are left alone
+max-file-size = {{ size .Aggregation.MaxFileSize }}
+
+# The staged files are aggregated once they add up to target-size, there are
+# max-files of them or the oldest was staged max-age ago
+target-size = {{ size .Aggregation.TargetSize }}
+max-files = {{ .Aggregation.MaxFiles }}
+max-age = {{ duration .Aggregation.MaxAge }}
+
+# Miners to make aggregate deals with, the cheapest first
+miners = {{ list .Aggregation.Miners }}
+
+# Length of aggregate deals in epochs, 2880 a day
+duration = {{ .Aggregation.Duration }}
+
+verified = {{ .Aggregation.Verified }}
+fast-retrieval = {{ .Aggregation.FastRetrieval }}
+
+# Most an aggregate deal may cost per GiB per epoch, e.g. "0.0000000001" FIL.
+# Empty for no limit.
+max-price = {{ printf "%q" .Aggregation.MaxPrice }}
+
+# How often to check the staged files
+interval = {{ duration .Aggregation.Interval }}
+
+# Profiles for other networks, e.g. a local devnet
+#
+# [profiles.devnet]
+# api-url = "ws://127.0.0.1:1234"
+# bootstrap-peers = ["/ip4/127.0.0.1/tcp/6746/p2p/12D3KooW..."]
+# address-prefix = "t"
+# candidates-endpoint = ""
+`))
+
+// Init writes the default config, commented, to path
+func Init(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("config %s already exists", path)
+	}
+
+	var buf bytes.Buffer
+	if err := defaultTemplate.Execute(&buf, Default()); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
@@ -0,0 +1,342 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Point the wormhole directory at a fresh temporary one
+func testDir(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	t.Setenv(PathEnv, dir)
+
+	return dir
+}
+
+func writeConfig(t *testing.T, dir, content string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, configFile)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadDefaults(t *testing.T) {
+	dir := testDir(t)
+
+	cfg, err := Load(filepath.Join(dir, configFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Default()
+	want.resolvePaths(dir)
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("loaded %+v without a config file, want the defaults %+v", cfg, want)
+	}
+
+	if cfg.Node.Libp2pKeyFile != filepath.Join(dir, "libp2p.key") {
+		t.Errorf("libp2p key file %s isn't in the wormhole directory", cfg.Node.Libp2pKeyFile)
+	}
+	if cfg.Node.Repo != dir {
+		t.Errorf("repo %s isn't the wormhole directory", cfg.Node.Repo)
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	dir := testDir(t)
+
+	path := writeConfig(t, dir, `
+[node]
+listen-addrs = ["/ip4/127.0.0.1/tcp/1234"]
+datastore-dir = "/var/lib/wormhole/datastore"
+
+[retrieval]
+concurrency = 8
+query-timeout = "5s"
+
+[daemon]
+cache-size = "1GiB"
+`)
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"/ip4/127.0.0.1/tcp/1234"}; !reflect.DeepEqual(cfg.Node.ListenAddrs, want) {
+		t.Errorf("listen addrs %v, want %v", cfg.Node.ListenAddrs, want)
+	}
+	if cfg.Node.DatastoreDir != "/var/lib/wormhole/datastore" {
+		t.Errorf("absolute datastore dir changed to %s", cfg.Node.DatastoreDir)
+	}
+	if cfg.Retrieval.Concurrency != 8 {
+		t.Errorf("concurrency %d, want 8", cfg.Retrieval.Concurrency)
+	}
+	if time.Duration(cfg.Retrieval.QueryTimeout) != 5*time.Second {
+		t.Errorf("query timeout %v, want 5s", time.Duration(cfg.Retrieval.QueryTimeout))
+	}
+	if cfg.Daemon.CacheSize != 1<<30 {
+		t.Errorf("cache size %d, want 1GiB", cfg.Daemon.CacheSize)
+	}
+
+	// Left out of the file
+	if cfg.Daemon.Workers != Default().Daemon.Workers {
+		t.Errorf("workers %d, want the default %d", cfg.Daemon.Workers, Default().Daemon.Workers)
+	}
+}
+
+func TestLoadUnknownSetting(t *testing.T) {
+	dir := testDir(t)
+
+	path := writeConfig(t, dir, `
+[node]
+no-limiter = true
+`)
+
+	if _, err := Load(path); err == nil {
+		t.Error("loaded a config with an unknown setting")
+	}
+}
+
+func TestLoadEnvOverrides(t *testing.T) {
+	dir := testDir(t)
+
+	path := writeConfig(t, dir, `
+[retrieval]
+concurrency = 8
+`)
+
+	t.Setenv("WORMHOLE_NODE_LISTEN_ADDRS", "/ip4/127.0.0.1/tcp/1, /ip4/127.0.0.1/tcp/2,")
+	t.Setenv("WORMHOLE_RETRIEVAL_CONCURRENCY", "16")
+	t.Setenv("WORMHOLE_RETRIEVAL_QUERY_CACHE_TTL", "1m")
+	t.Setenv("WORMHOLE_DAEMON_CACHE_SIZE", "2GiB")
+	t.Setenv("WORMHOLE_RENEWAL_ENABLED", "true")
+	t.Setenv("WORMHOLE_CHAIN_PROFILE", "calibration")
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"/ip4/127.0.0.1/tcp/1", "/ip4/127.0.0.1/tcp/2"}; !reflect.DeepEqual(cfg.Node.ListenAddrs, want) {
+		t.Errorf("listen addrs %v, want %v", cfg.Node.ListenAddrs, want)
+	}
+	if cfg.Retrieval.Concurrency != 16 {
+		t.Errorf("concurrency %d, want the environment's 16 over the file's", cfg.Retrieval.Concurrency)
+	}
+	if time.Duration(cfg.Retrieval.QueryCacheTTL) != time.Minute {
+		t.Errorf("query cache TTL %v, want 1m", time.Duration(cfg.Retrieval.QueryCacheTTL))
+	}
+	if cfg.Daemon.CacheSize != 2<<30 {
+		t.Errorf("cache size %d, want 2GiB", cfg.Daemon.CacheSize)
+	}
+	if !cfg.Renewal.Enabled {
+		t.Error("renewal isn't enabled")
+	}
+	if cfg.Chain.Profile != "calibration" {
+		t.Errorf("profile %s, want calibration", cfg.Chain.Profile)
+	}
+}
+
+func TestLoadInvalidEnv(t *testing.T) {
+	dir := testDir(t)
+
+	for env, val := range map[string]string{
+		"WORMHOLE_RETRIEVAL_CONCURRENCY":   "many",
+		"WORMHOLE_RENEWAL_ENABLED":         "sometimes",
+		"WORMHOLE_DAEMON_CACHE_SIZE":       "big",
+		"WORMHOLE_RETRIEVAL_QUERY_TIMEOUT": "soon",
+	} {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv(env, val)
+
+			if _, err := Load(filepath.Join(dir, configFile)); err == nil {
+				t.Errorf("loaded %s=%s", env, val)
+			}
+		})
+	}
+}
+
+func TestResolveLegacyPaths(t *testing.T) {
+	dir := testDir(t)
+
+	// A node set up before paths were relative to the wormhole directory,
+	// started from cwd
+	cwd := t.TempDir()
+	for _, p := range []string{"datastore", filepath.Join(".whypfs", "blocks")} {
+		if err := os.MkdirAll(filepath.Join(cwd, p), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(cwd, "libp2p.key"), []byte("key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Already moved to the wormhole directory
+	if err := os.MkdirAll(filepath.Join(dir, "datastore"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	prev, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(cwd); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(prev) })
+
+	// cwd may be reached through a symlink, compare with what Abs makes of it
+	legacy, err := filepath.Abs(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := Default()
+	cfg.resolvePaths(dir)
+
+	if want := filepath.Join(legacy, "libp2p.key"); cfg.Node.Libp2pKeyFile != want {
+		t.Errorf("libp2p key file %s, want the existing %s", cfg.Node.Libp2pKeyFile, want)
+	}
+	if want := filepath.Join(dir, "datastore"); cfg.Node.DatastoreDir != want {
+		t.Errorf("datastore dir %s, want %s which exists at the new location", cfg.Node.DatastoreDir, want)
+	}
+	if want := filepath.Join(legacy, ".whypfs"); cfg.Node.Repo != want {
+		t.Errorf("repo %s, want the existing %s", cfg.Node.Repo, want)
+	}
+}
+
+func TestInitLoads(t *testing.T) {
+	dir := testDir(t)
+	path := filepath.Join(dir, "nested", configFile)
+
+	if err := Init(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := Init(path); err == nil {
+		t.Error("overwrote an existing config")
+	}
+
+	// Every setting written is one Load knows
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Default()
+	if cfg.Daemon.CacheSize != want.Daemon.CacheSize || cfg.Aggregation.TargetSize != want.Aggregation.TargetSize {
+		t.Errorf("sizes didn't survive the template")
+	}
+	if cfg.Renewal.Interval != want.Renewal.Interval || cfg.Retrieval.QueryTimeout != want.Retrieval.QueryTimeout {
+		t.Errorf("durations didn't survive the template")
+	}
+	if !reflect.DeepEqual(cfg.Node.ListenAddrs, want.Node.ListenAddrs) {
+		t.Errorf("listen addrs %v, want %v", cfg.Node.ListenAddrs, want.Node.ListenAddrs)
+	}
+}
+
+func TestProfile(t *testing.T) {
+	dir := testDir(t)
+
+	path := writeConfig(t, dir, `
+[profiles.devnet]
+api-url = "ws://127.0.0.1:1234"
+bootstrap-peers = ["/ip4/127.0.0.1/tcp/6746/p2p/12D3KooWNTiHg8eQsTRx8XV7TiJbq3379EgwG6Mo3V3MdwAfThsx"]
+
+[profiles.noapi]
+address-prefix = "f"
+
+[profiles.badprefix]
+api-url = "ws://127.0.0.1:1234"
+address-prefix = "x"
+`)
+
+	tests := []struct {
+		name    string
+		profile string
+		apiURL  string
+
+		want    Profile
+		wantErr bool
+	}{
+		{
+			name:    "built in",
+			profile: "mainnet",
+			want:    Profiles["mainnet"],
+		},
+		{
+			name:    "api url overridden",
+			profile: "calibration",
+			apiURL:  "wss://example.com",
+			want: Profile{
+				APIURL:         "wss://example.com",
+				BootstrapPeers: ipfsBootstrapPeers,
+				AddressPrefix:  "t",
+			},
+		},
+		{
+			name:    "custom with an empty prefix",
+			profile: "devnet",
+			want: Profile{
+				APIURL:         "ws://127.0.0.1:1234",
+				BootstrapPeers: []string{"/ip4/127.0.0.1/tcp/6746/p2p/12D3KooWNTiHg8eQsTRx8XV7TiJbq3379EgwG6Mo3V3MdwAfThsx"},
+				AddressPrefix:  "t",
+			},
+		},
+		{
+			name:    "custom without api url",
+			profile: "noapi",
+			wantErr: true,
+		},
+		{
+			name:    "invalid prefix",
+			profile: "badprefix",
+			wantErr: true,
+		},
+		{
+			name:    "unknown",
+			profile: "nowhere",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("WORMHOLE_CHAIN_PROFILE", tt.profile)
+			t.Setenv("WORMHOLE_CHAIN_API_URL", tt.apiURL)
+
+			cfg, err := Load(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			profile, err := cfg.Profile()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("resolved %+v, want an error", profile)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(profile, tt.want) {
+				t.Errorf("resolved %+v, want %+v", profile, tt.want)
+			}
+
+			if _, err := profile.AddrInfos(); err != nil {
+				t.Errorf("bootstrap peers don't parse: %v", err)
+			}
+		})
+	}
+}
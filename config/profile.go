@@ -0,0 +1,112 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// Profile bundles what differs between Filecoin networks
+type Profile struct {
+	// Lotus gateway used for chain state, messages and payment channels
+	APIURL string `toml:"api-url"`
+
+	// Peers the node connects to on startup
+	BootstrapPeers []string `toml:"bootstrap-peers"`
+
+	// Prefix of the network's addresses, "f" or "t"
+	AddressPrefix string `toml:"address-prefix"`
+
+	// Where to look up storage providers holding a CID, none if empty
+	CandidatesEndpoint string `toml:"candidates-endpoint"`
+}
+
+// IPFS bootstrap peers, the same as whypfs-core's defaults
+var ipfsBootstrapPeers = []string{
+	"/ip4/145.40.90.135/tcp/6746/p2p/12D3KooWNTiHg8eQsTRx8XV7TiJbq3379EgwG6Mo3V3MdwAfThsx",
+	"/dnsaddr/bootstrap.libp2p.io/p2p/QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN",
+	"/dnsaddr/bootstrap.libp2p.io/p2p/QmQCU2EcMqAqQPR2i9bChDtGNJchTbq5TbXJJ16u19uLTa",
+	"/dnsaddr/bootstrap.libp2p.io/p2p/QmbLHAnMoJPWSCR5Zhtx6BHJX9KiKNN6tpvbUcqanj75Nb",
+	"/dnsaddr/bootstrap.libp2p.io/p2p/QmcZf59bWwK5XFi76CZX8cbJ4BhTzzA3gU1ZjYZcYW3dwt",
+}
+
+// Profiles built into wormhole
+var Profiles = map[string]Profile{
+	"mainnet": {
+		APIURL:             "wss://api.chain.love",
+		BootstrapPeers:     ipfsBootstrapPeers,
+		AddressPrefix:      "f",
+		CandidatesEndpoint: "https://api.estuary.tech/retrieval-candidates",
+	},
+	// There is no candidates endpoint for calibration, pass --miners
+	"calibration": {
+		APIURL:         "https://api.calibration.node.glif.io",
+		BootstrapPeers: ipfsBootstrapPeers,
+		AddressPrefix:  "t",
+	},
+}
+
+// Profile resolves the selected profile, with the api-url and
+// candidates-endpoint settings overriding the profile's own if set
+func (cfg *Config) Profile() (Profile, error) {
+	name := cfg.Chain.Profile
+
+	profile, ok := cfg.Profiles[name]
+	if !ok {
+		profile, ok = Profiles[name]
+	}
+	if !ok {
+		return Profile{}, fmt.Errorf("unknown network profile '%s', known profiles: %v", name, cfg.profileNames())
+	}
+
+	if profile.AddressPrefix == "" {
+		profile.AddressPrefix = "t"
+	}
+	if profile.AddressPrefix != "f" && profile.AddressPrefix != "t" {
+		return Profile{}, fmt.Errorf("invalid address prefix '%s' of profile '%s', must be f or t", profile.AddressPrefix, name)
+	}
+
+	if cfg.Chain.APIURL != "" {
+		profile.APIURL = cfg.Chain.APIURL
+	}
+	if cfg.Retrieval.CandidatesEndpoint != "" {
+		profile.CandidatesEndpoint = cfg.Retrieval.CandidatesEndpoint
+	}
+
+	if profile.APIURL == "" {
+		return Profile{}, fmt.Errorf("profile '%s' has no api-url", name)
+	}
+
+	return profile, nil
+}
+
+func (cfg *Config) profileNames() []string {
+	var names []string
+	for name := range Profiles {
+		names = append(names, name)
+	}
+	for name := range cfg.Profiles {
+		if _, ok := Profiles[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// AddrInfos parses the profile's bootstrap peers
+func (p Profile) AddrInfos() ([]peer.AddrInfo, error) {
+	var addrs []multiaddr.Multiaddr
+	for _, s := range p.BootstrapPeers {
+		ma, err := multiaddr.NewMultiaddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bootstrap peer '%s': %w", s, err)
+		}
+		addrs = append(addrs, ma)
+	}
+
+	return peer.AddrInfosFromP2pAddrs(addrs...)
+}
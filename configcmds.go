@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/dustin/go-humanize"
+	"github.com/filecoin-project/go-address"
+	"github.com/urfave/cli/v2"
+
+	"github.com/jlogelin/wormhole/config"
+	fc "github.com/jlogelin/wormhole/filecoin"
+)
+
+var initCmd = &cli.Command{
+	Name:      "init",
+	Usage:     "Write a commented default config file",
+	ArgsUsage: " ",
+	Action: func(cctx *cli.Context) error {
+		path, err := configPath(cctx)
+		if err != nil {
+			return err
+		}
+
+		if err := config.Init(path); err != nil {
+			return err
+		}
+
+		fmt.Printf("Wrote default config to %s\n", path)
+
+		return nil
+	},
+}
+
+func configPath(cctx *cli.Context) (string, error) {
+	if path := cctx.String(flagConfig.Name); path != "" {
+		return path, nil
+	}
+
+	return config.Path()
+}
+
+// Load the config before any command runs, and make its settings the
+// defaults of the flags covering the same ground.
+func loadConfig(cctx *cli.Context) error {
+	path, err := configPath(cctx)
+	if err != nil {
+		return err
+	}
+
+	cfg, err = config.Load(path)
+	if err != nil {
+		return err
+	}
+
+	if cctx.IsSet(flagChain.Name) {
+		cfg.Chain.Profile = cctx.String(flagChain.Name)
+	}
+
+	profile, err = cfg.Profile()
+	if err != nil {
+		return err
+	}
+
+	if profile.AddressPrefix == "t" {
+		address.CurrentNetwork = address.Testnet
+	} else {
+		address.CurrentNetwork = address.Mainnet
+	}
+
+	dir, err := config.Dir()
+	if err != nil {
+		return err
+	}
+	fc.DataDir = dir
+	apiFile = filepath.Join(dir, "api")
+	fc.ApiURL = profile.APIURL
+
+	flagNetwork.Value = cfg.Retrieval.Network
+	flagNetwork.DefaultText = cfg.Retrieval.Network
+	flagCandidatesEndpoint.Value = profile.CandidatesEndpoint
+	flagProvide.Value = cfg.Retrieval.Provide
+	flagConcurrency.Value = cfg.Retrieval.Concurrency
+	flagMaxPrice.Value = cfg.Retrieval.MaxPrice
+
+	flagAPIListen.Value = cfg.Daemon.APIListen
+	flagGatewayListen.Value = cfg.Daemon.GatewayListen
+	flagWorkers.Value = cfg.Daemon.Workers
+	flagCacheSize.Value = humanize.IBytes(uint64(cfg.Daemon.CacheSize))
+	flagCachePolicy.Value = cfg.Daemon.CachePolicy
+
+	return nil
+}
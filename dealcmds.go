@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/builtin"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/urfave/cli/v2"
+
+	"github.com/jlogelin/wormhole/api"
+	fc "github.com/jlogelin/wormhole/filecoin"
+)
+
+var dealCmd = &cli.Command{
+	Name:  "deal",
+	Usage: "Store content held by the node on Filecoin",
+	Subcommands: []*cli.Command{
+		dealMakeCmd,
+		dealListCmd,
+		dealStatusCmd,
+	},
+}
+
+var dealMakeCmd = &cli.Command{
+	Name:        "make",
+	Usage:       "Propose a storage deal for a CID",
+	Description: "Propose a storage deal for content added to the node, e.g. with 'wormhole add', and push the data to the provider. Without a running daemon, the command waits for the transfer to finish.",
+	ArgsUsage:   "<cid>",
+	Flags: []cli.Flag{
+		flagDealMiner,
+		flagDealDuration,
+		flagDealPrice,
+		flagVerified,
+		flagFastRetrieval,
+	},
+	Action: func(cctx *cli.Context) error {
+		req, err := parseDealRequest(cctx)
+		if err != nil {
+			return err
+		}
+
+		client, err := dialDaemon(cctx.Context)
+		if err != nil {
+			return err
+		}
+		if client != nil {
+			deal, err := client.MakeDeal(cctx.Context, req)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("Proposed deal %d, the daemon is transferring the data\n", deal.ID)
+
+			return nil
+		}
+
+		BootstrapWhyPFS()
+
+		r, err := fc.NewRetriever(node)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		deal, err := r.MakeDeal(cctx.Context, req)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Proposed deal %d for piece %s (%s), transferring the data...\n", deal.ID, deal.PieceCid, types.FIL(deal.TotalPrice))
+
+		if err := r.WaitTransfer(cctx.Context, deal); err != nil {
+			return err
+		}
+
+		fmt.Printf("Transferred the data of deal %d to %s\n", deal.ID, deal.Miner)
+
+		return nil
+	},
+}
+
+var dealListCmd = &cli.Command{
+	Name:      "list",
+	Usage:     "List the deals made through wormhole",
+	ArgsUsage: " ",
+	Flags: []cli.Flag{
+		flagJSON,
+	},
+	Action: func(cctx *cli.Context) error {
+		var deals []*fc.Deal
+
+		client, err := dialDaemon(cctx.Context)
+		if err != nil {
+			return err
+		}
+		if client != nil {
+			deals, err = client.Deals(cctx.Context)
+		} else {
+			BootstrapWhyPFS()
+			deals, err = fc.NewDealStore(node.Datastore).List(cctx.Context)
+		}
+		if err != nil {
+			return err
+		}
+
+		if cctx.Bool(flagJSON.Name) {
+			return printJSON(deals)
+		}
+
+		fc.PrintDeals(deals)
+
+		return nil
+	},
+}
+
+var dealStatusCmd = &cli.Command{
+	Name:        "status",
+	Usage:       "Show a deal and its event log",
+	Description: "Show the state of a deal and every state it went through. The daemon keeps the states of unfinished deals up to date, without one the deal is polled before it is shown.",
+	ArgsUsage:   "<deal ID>",
+	Flags: []cli.Flag{
+		flagJSON,
+	},
+	Action: func(cctx *cli.Context) error {
+		id, err := parseDealID(cctx)
+		if err != nil {
+			return err
+		}
+
+		client, err := dialDaemon(cctx.Context)
+		if err != nil {
+			return err
+		}
+
+		var info *api.DealInfo
+		if client != nil {
+			info, err = client.Deal(cctx.Context, id)
+		} else {
+			info, err = pollDeal(cctx, id)
+		}
+		if err != nil {
+			return err
+		}
+
+		if cctx.Bool(flagJSON.Name) {
+			return printJSON(info)
+		}
+
+		fc.PrintDeal(info.Deal, info.Events)
+
+		return nil
+	},
+}
+
+// Poll an unfinished deal on a local node, returning it with its events
+func pollDeal(cctx *cli.Context, id uint64) (*api.DealInfo, error) {
+	BootstrapWhyPFS()
+
+	r, err := fc.NewRetriever(node)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	deal, err := r.Deals.Get(cctx.Context, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if !deal.Finished() {
+		if err := fc.NewDealTracker(r).Poll(cctx.Context, deal); err != nil {
+			fmt.Printf("Could not poll deal %d: %v\n", id, err)
+		}
+	}
+
+	events, err := r.Deals.Events(cctx.Context, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.DealInfo{Deal: deal, Events: events}, nil
+}
+
+var askCmd = &cli.Command{
+	Name:        "ask",
+	Usage:       "Compare the storage asks of miners",
+	Description: "Query the storage asks of the given miners in parallel and compare their prices, piece sizes and how quickly they answered.",
+	ArgsUsage:   "<miner...>",
+	Flags: []cli.Flag{
+		flagAskSort,
+		flagJSON,
+		flagVerbose,
+	},
+	Action: func(cctx *cli.Context) error {
+		by, err := fc.ParseAskSort(cctx.String(flagAskSort.Name))
+		if err != nil {
+			return err
+		}
+
+		if !cctx.Args().Present() {
+			return fmt.Errorf("please specify at least one miner")
+		}
+
+		var miners []address.Address
+		for _, arg := range splitMiners(cctx.Args().Slice()) {
+			miner, err := address.NewFromString(arg)
+			if err != nil {
+				return fmt.Errorf("failed to parse miner %s: %w", arg, err)
+			}
+			miners = append(miners, miner)
+		}
+
+		var results []*fc.AskResult
+
+		client, err := dialDaemon(cctx.Context)
+		if err != nil {
+			return err
+		}
+		if client != nil {
+			results, err = client.Asks(cctx.Context, miners)
+			if err != nil {
+				return err
+			}
+		} else {
+			BootstrapWhyPFS()
+
+			r, err := fc.NewRetriever(node)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			r.QueryConcurrency = cfg.Retrieval.QueryConcurrency
+			r.QueryTimeout = time.Duration(cfg.Retrieval.QueryTimeout)
+
+			results = r.QueryAsks(cctx.Context, miners)
+		}
+
+		fc.SortAsks(results, by)
+
+		if cctx.Bool(flagJSON.Name) {
+			return printJSON(results)
+		}
+
+		fc.PrintAsks(results, cctx.Bool(flagVerbose.Name))
+
+		return nil
+	},
+}
+
+func parseDealRequest(cctx *cli.Context) (fc.DealRequest, error) {
+	c, err := parseCidArg(cctx)
+	if err != nil {
+		return fc.DealRequest{}, err
+	}
+
+	miner, err := address.NewFromString(cctx.String(flagDealMiner.Name))
+	if err != nil {
+		return fc.DealRequest{}, fmt.Errorf("failed to parse miner %s: %w", cctx.String(flagDealMiner.Name), err)
+	}
+
+	req := fc.DealRequest{
+		Cid:           c,
+		Miner:         miner,
+		Duration:      abi.ChainEpoch(cctx.Int(flagDealDuration.Name)) * builtin.EpochsInDay,
+		Verified:      cctx.Bool(flagVerified.Name),
+		FastRetrieval: cctx.Bool(flagFastRetrieval.Name),
+	}
+
+	if s := cctx.String(flagDealPrice.Name); s != "" {
+		price, err := types.ParseFIL(s)
+		if err != nil {
+			return fc.DealRequest{}, fmt.Errorf("invalid --%s: %w", flagDealPrice.Name, err)
+		}
+		amount := abi.TokenAmount(price)
+		req.Price = &amount
+	}
+
+	return req, nil
+}
@@ -0,0 +1,596 @@
+package filecoin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	ipldformat "github.com/ipfs/go-ipld-format"
+	ft "github.com/ipfs/go-unixfs"
+	"github.com/labstack/gommon/log"
+	"golang.org/x/xerrors"
+)
+
+var ErrNotAggregated = fmt.Errorf("not aggregated")
+
+var (
+	stagingPrefix    = datastore.NewKey("/wormhole/staging")
+	aggregatedPrefix = datastore.NewKey("/wormhole/aggregated")
+	aggregatesPrefix = datastore.NewKey("/wormhole/aggregates")
+)
+
+// A StagedRoot is a small added root waiting to be aggregated
+type StagedRoot struct {
+	Cid    cid.Cid   `json:"cid"`
+	Size   uint64    `json:"size"`
+	Staged time.Time `json:"staged"`
+}
+
+// An AggregateEntry locates a root inside the aggregate it was stored with
+type AggregateEntry struct {
+	Cid  cid.Cid `json:"cid"`
+	Root cid.Cid `json:"root"`
+
+	// Datamodel path selector of Cid under Root
+	Path string `json:"path"`
+
+	// The deal made for Root, 0 until one is
+	DealID uint64 `json:"dealId"`
+
+	Created time.Time `json:"created"`
+}
+
+// An Aggregate is a UnixFS directory linking to staged roots by their CIDs,
+// stored with one deal. DealID is 0 until the deal is made.
+type Aggregate struct {
+	Root    cid.Cid           `json:"root"`
+	Size    uint64            `json:"size"`
+	DealID  uint64            `json:"dealId"`
+	Entries []*AggregateEntry `json:"entries"`
+}
+
+// Staging keeps the roots waiting to be aggregated and the index of the
+// aggregated ones in the node's datastore
+type Staging struct {
+	ds datastore.Batching
+	lk sync.Mutex
+
+	// Larger roots aren't staged, no limit if 0
+	MaxFileSize uint64
+}
+
+func NewStaging(ds datastore.Batching) *Staging {
+	return &Staging{ds: ds}
+}
+
+func stagingKey(c cid.Cid) datastore.Key {
+	return stagingPrefix.ChildString(c.String())
+}
+
+func aggregatedKey(c cid.Cid) datastore.Key {
+	return aggregatedPrefix.ChildString(c.String())
+}
+
+func aggregateKey(root cid.Cid) datastore.Key {
+	return aggregatesPrefix.ChildString(root.String())
+}
+
+// Stage adds c of the given DAG size to the staged roots, returning whether
+// it was staged. Roots above MaxFileSize and roots already staged or
+// aggregated are left alone.
+func (s *Staging) Stage(ctx context.Context, c cid.Cid, size uint64) (bool, error) {
+	if s.MaxFileSize > 0 && size > s.MaxFileSize {
+		return false, nil
+	}
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	for _, key := range []datastore.Key{stagingKey(c), aggregatedKey(c)} {
+		has, err := s.ds.Has(ctx, key)
+		if err != nil {
+			return false, err
+		}
+		if has {
+			return false, nil
+		}
+	}
+
+	data, err := json.Marshal(&StagedRoot{
+		Cid:    c,
+		Size:   size,
+		Staged: time.Now(),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if err := s.ds.Put(ctx, stagingKey(c), data); err != nil {
+		return false, err
+	}
+
+	return true, s.ds.Sync(ctx, stagingPrefix)
+}
+
+// Staged lists the staged roots, oldest first
+func (s *Staging) Staged(ctx context.Context) ([]*StagedRoot, error) {
+	res, err := s.ds.Query(ctx, query.Query{Prefix: stagingPrefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	var staged []*StagedRoot
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+
+		var root StagedRoot
+		if err := json.Unmarshal(r.Value, &root); err != nil {
+			return nil, xerrors.Errorf("could not decode staged root %s: %w", r.Key, err)
+		}
+
+		staged = append(staged, &root)
+	}
+
+	sort.Slice(staged, func(i, j int) bool {
+		return staged[i].Staged.Before(staged[j].Staged)
+	})
+
+	return staged, nil
+}
+
+// Lookup returns where c was aggregated
+func (s *Staging) Lookup(ctx context.Context, c cid.Cid) (*AggregateEntry, error) {
+	data, err := s.ds.Get(ctx, aggregatedKey(c))
+	if err != nil {
+		if err == datastore.ErrNotFound {
+			return nil, ErrNotAggregated
+		}
+		return nil, err
+	}
+
+	var entry AggregateEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, xerrors.Errorf("could not decode aggregate entry of %s: %w", c, err)
+	}
+
+	return &entry, nil
+}
+
+// Unstage drops roots from the staged ones
+func (s *Staging) Unstage(ctx context.Context, roots []cid.Cid) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	batch, err := s.ds.Batch(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range roots {
+		if err := batch.Delete(ctx, stagingKey(c)); err != nil {
+			return err
+		}
+	}
+
+	if err := batch.Commit(ctx); err != nil {
+		return err
+	}
+
+	return s.ds.Sync(ctx, stagingPrefix)
+}
+
+// Aggregates lists the aggregates made so far
+func (s *Staging) Aggregates(ctx context.Context) ([]*Aggregate, error) {
+	res, err := s.ds.Query(ctx, query.Query{Prefix: aggregatesPrefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	var aggs []*Aggregate
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+
+		var agg Aggregate
+		if err := json.Unmarshal(r.Value, &agg); err != nil {
+			return nil, xerrors.Errorf("could not decode aggregate %s: %w", r.Key, err)
+		}
+
+		aggs = append(aggs, &agg)
+	}
+
+	return aggs, nil
+}
+
+// Record agg and move its entries from the staged roots to the index
+func (s *Staging) index(ctx context.Context, agg *Aggregate) error {
+	return s.write(ctx, agg, true)
+}
+
+// Record that agg is stored with the deal of the given ID
+func (s *Staging) setDeal(ctx context.Context, agg *Aggregate, dealID uint64) error {
+	agg.DealID = dealID
+	for _, entry := range agg.Entries {
+		entry.DealID = dealID
+	}
+
+	return s.write(ctx, agg, false)
+}
+
+func (s *Staging) write(ctx context.Context, agg *Aggregate, unstage bool) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	batch, err := s.ds.Batch(ctx)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(agg)
+	if err != nil {
+		return err
+	}
+	if err := batch.Put(ctx, aggregateKey(agg.Root), data); err != nil {
+		return err
+	}
+
+	for _, entry := range agg.Entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+
+		if err := batch.Put(ctx, aggregatedKey(entry.Cid), data); err != nil {
+			return err
+		}
+		if unstage {
+			if err := batch.Delete(ctx, stagingKey(entry.Cid)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := batch.Commit(ctx); err != nil {
+		return err
+	}
+
+	for _, prefix := range []datastore.Key{aggregatesPrefix, aggregatedPrefix, stagingPrefix} {
+		if err := s.ds.Sync(ctx, prefix); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Aggregator bundles the staged roots into aggregates once enough of them
+// are staged, making one deal for each aggregate
+type Aggregator struct {
+	retriever *Retriever
+	lk        sync.Mutex
+
+	// Staged roots are aggregated once they add up to TargetSize, there are
+	// MaxFiles of them or the oldest was staged MaxAge ago
+	TargetSize uint64
+	MaxFiles   int
+	MaxAge     time.Duration
+
+	// Miners to make aggregate deals with, the cheapest first
+	Miners []address.Address
+
+	Duration      abi.ChainEpoch
+	Verified      bool
+	FastRetrieval bool
+
+	// Most to pay per GiB per epoch, no limit if nil
+	MaxPrice *abi.TokenAmount
+
+	// How often the staged roots are checked
+	Interval time.Duration
+}
+
+func NewAggregator(r *Retriever) *Aggregator {
+	return &Aggregator{
+		retriever:     r,
+		TargetSize:    1 << 30,
+		MaxFiles:      4096,
+		MaxAge:        24 * time.Hour,
+		Duration:      MinDealDuration,
+		FastRetrieval: true,
+		Interval:      10 * time.Minute,
+	}
+}
+
+// Run aggregates the staged roots every Interval until ctx is done, never if
+// Interval isn't positive
+func (a *Aggregator) Run(ctx context.Context) {
+	if a.Interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(a.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := a.RetryDeals(ctx); err != nil {
+			log.Errorf("Retrying aggregate deals failed: %v", err)
+		}
+
+		// A large backlog makes several aggregates
+		for {
+			agg, err := a.Flush(ctx, false)
+			if err != nil {
+				log.Errorf("Aggregating staged roots failed: %v", err)
+			}
+			if agg == nil {
+				break
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Flush aggregates the oldest staged roots and makes a deal for them,
+// returning nil if nothing was aggregated. Unless force is set, the staged
+// roots have to reach one of the thresholds first. Staged roots that were
+// unpinned meanwhile are dropped.
+//
+// The aggregate is recorded before the deal is made. If no deal can be made,
+// the aggregate is returned with the error and RetryDeals makes one later.
+func (a *Aggregator) Flush(ctx context.Context, force bool) (*Aggregate, error) {
+	a.lk.Lock()
+	defer a.lk.Unlock()
+
+	r := a.retriever
+
+	staged, err := r.Staging.Staged(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var batch []*StagedRoot
+	var unpinned []cid.Cid
+	var size uint64
+	for _, root := range staged {
+		if _, err := r.Pins.Get(ctx, root.Cid); err != nil {
+			if err == ErrPinNotFound {
+				unpinned = append(unpinned, root.Cid)
+				continue
+			}
+			return nil, err
+		}
+
+		if len(batch) > 0 && (size+root.Size > a.TargetSize || len(batch) == a.MaxFiles) {
+			break
+		}
+		batch = append(batch, root)
+		size += root.Size
+	}
+
+	if len(unpinned) > 0 {
+		if err := r.Staging.Unstage(ctx, unpinned); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(batch) == 0 {
+		return nil, nil
+	}
+
+	due := size >= a.TargetSize || len(batch) == a.MaxFiles || time.Since(batch[0].Staged) >= a.MaxAge
+	if !force && !due {
+		return nil, nil
+	}
+
+	agg, err := a.build(ctx, batch)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := r.Pins.Add(ctx, agg.Root, "aggregate", PinRecursive); err != nil {
+		return nil, err
+	}
+
+	if err := r.Staging.index(ctx, agg); err != nil {
+		return nil, err
+	}
+
+	log.Infof("Aggregated %d staged roots of %d bytes into %s", len(batch), size, agg.Root)
+
+	deal, err := a.makeDeal(ctx, agg.Root)
+	if err != nil {
+		return agg, xerrors.Errorf("making a deal for aggregate %s: %w", agg.Root, err)
+	}
+
+	if err := r.Staging.setDeal(ctx, agg, deal.ID); err != nil {
+		return agg, err
+	}
+
+	return agg, nil
+}
+
+// RetryDeals makes a deal for every aggregate without one, or whose deal
+// failed. A deal made for an aggregate but not recorded with it, by a Flush
+// that was interrupted, is recorded instead of making another one.
+func (a *Aggregator) RetryDeals(ctx context.Context) error {
+	a.lk.Lock()
+	defer a.lk.Unlock()
+
+	r := a.retriever
+
+	aggs, err := r.Staging.Aggregates(ctx)
+	if err != nil {
+		return err
+	}
+	if len(aggs) == 0 {
+		return nil
+	}
+
+	deals, err := r.Deals.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	// The latest deal of each root that didn't fail
+	current := make(map[cid.Cid]*Deal)
+	for _, deal := range deals {
+		if !dealFailed(deal) {
+			current[deal.Cid] = deal
+		}
+	}
+
+	for _, agg := range aggs {
+		if deal, ok := current[agg.Root]; ok {
+			if deal.ID != agg.DealID {
+				log.Infof("Recording deal %d for aggregate %s", deal.ID, agg.Root)
+				if err := r.Staging.setDeal(ctx, agg, deal.ID); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if agg.DealID != 0 {
+			log.Infof("Deal %d for aggregate %s failed, making another one", agg.DealID, agg.Root)
+		}
+
+		deal, err := a.makeDeal(ctx, agg.Root)
+		if err != nil {
+			log.Warnf("Making a deal for aggregate %s failed: %v", agg.Root, err)
+			continue
+		}
+
+		if err := r.Staging.setDeal(ctx, agg, deal.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Add a directory linking to the roots of batch, named by their CIDs, to
+// the node
+func (a *Aggregator) build(ctx context.Context, batch []*StagedRoot) (*Aggregate, error) {
+	dir := ft.EmptyDirNode()
+	for _, root := range batch {
+		if err := dir.AddRawLink(root.Cid.String(), &ipldformat.Link{Cid: root.Cid, Size: root.Size}); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := a.retriever.Node.DAGService.Add(ctx, dir); err != nil {
+		return nil, xerrors.Errorf("adding aggregate: %w", err)
+	}
+
+	size, err := dir.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	agg := &Aggregate{
+		Root: dir.Cid(),
+		Size: size,
+	}
+
+	// Links are sorted by name, their index is known only now
+	now := time.Now()
+	for i, link := range dir.Links() {
+		agg.Entries = append(agg.Entries, &AggregateEntry{
+			Cid:     link.Cid,
+			Root:    agg.Root,
+			Path:    fmt.Sprintf("Links/%d/Hash", i),
+			Created: now,
+		})
+	}
+
+	return agg, nil
+}
+
+// Make a deal for root with the cheapest miner that takes it
+func (a *Aggregator) makeDeal(ctx context.Context, root cid.Cid) (*Deal, error) {
+	r := a.retriever
+
+	if len(a.Miners) == 0 {
+		return nil, fmt.Errorf("no aggregation miners are configured")
+	}
+
+	asks := r.QueryAsks(ctx, a.Miners)
+	if a.Verified {
+		SortAsks(asks, AskSortVerifiedPrice)
+	} else {
+		SortAsks(asks, AskSortPrice)
+	}
+
+	for _, ask := range asks {
+		if ask.Ask == nil {
+			log.Debugf("Skipping %s for aggregate %s: %s", ask.Miner, root, ask.Error)
+			continue
+		}
+
+		price := ask.Ask.Price
+		if a.Verified {
+			price = ask.Ask.VerifiedPrice
+		}
+		if a.MaxPrice != nil && price.GreaterThan(*a.MaxPrice) {
+			log.Debugf("Skipping %s for aggregate %s: asks %s, more than %s", ask.Miner, root, types.FIL(price), types.FIL(*a.MaxPrice))
+			continue
+		}
+
+		deal, err := r.MakeDeal(ctx, DealRequest{
+			Cid:           root,
+			Miner:         ask.Miner,
+			Duration:      a.Duration,
+			Price:         &price,
+			Verified:      a.Verified,
+			FastRetrieval: a.FastRetrieval,
+		})
+		if err != nil {
+			log.Warnf("Deal for aggregate %s with %s failed: %v", root, ask.Miner, err)
+			continue
+		}
+
+		log.Infof("Made deal %d for aggregate %s with %s", deal.ID, root, ask.Miner)
+		return deal, nil
+	}
+
+	return nil, fmt.Errorf("no miner took the deal")
+}
+
+// The miners holding or about to hold a deal for root
+func (r *Retriever) aggregateMiners(ctx context.Context, root cid.Cid) ([]address.Address, error) {
+	deals, err := r.Deals.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[address.Address]bool)
+	var miners []address.Address
+	for _, deal := range deals {
+		if deal.Cid != root || deal.Finished() || seen[deal.Miner] {
+			continue
+		}
+		seen[deal.Miner] = true
+		miners = append(miners, deal.Miner)
+	}
+
+	return miners, nil
+}
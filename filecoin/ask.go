@@ -0,0 +1,135 @@
+package filecoin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+)
+
+// AskSort is what asks are compared by
+type AskSort string
+
+const (
+	AskSortPrice         AskSort = "price"
+	AskSortVerifiedPrice AskSort = "verified-price"
+	AskSortMinPieceSize  AskSort = "min-size"
+	AskSortMaxPieceSize  AskSort = "max-size"
+	AskSortLatency       AskSort = "latency"
+)
+
+func ParseAskSort(s string) (AskSort, error) {
+	switch by := AskSort(s); by {
+	case AskSortPrice, AskSortVerifiedPrice, AskSortMinPieceSize, AskSortMaxPieceSize, AskSortLatency:
+		return by, nil
+	default:
+		return "", fmt.Errorf("unknown ask sort '%s' (expected price, verified-price, min-size, max-size or latency)", s)
+	}
+}
+
+// AskResult is the storage ask of a miner, Error being set instead of Ask if
+// it could not be queried
+type AskResult struct {
+	Miner address.Address           `json:"miner"`
+	Ask   *storagemarket.StorageAsk `json:"ask,omitempty"`
+	Error string                    `json:"error,omitempty"`
+
+	// How long the miner took to answer
+	Latency time.Duration `json:"latency"`
+}
+
+// QueryAsks gets the storage asks of miners in parallel, at most
+// QueryConcurrency at a time and each within QueryTimeout. The results are
+// in the order of miners.
+func (r *Retriever) QueryAsks(ctx context.Context, miners []address.Address) []*AskResult {
+	concurrency := r.QueryConcurrency
+	if concurrency <= 0 {
+		concurrency = len(miners)
+	}
+	sem := make(chan struct{}, concurrency)
+
+	results := make([]*AskResult, len(miners))
+
+	var wg sync.WaitGroup
+	wg.Add(len(miners))
+
+	for i, miner := range miners {
+		i, miner := i, miner
+
+		go func() {
+			defer wg.Done()
+
+			results[i] = &AskResult{Miner: miner}
+
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				results[i].Error = ctx.Err().Error()
+				return
+			}
+
+			ask, latency, err := r.queryAsk(ctx, miner)
+			results[i].Latency = latency
+			if err != nil {
+				results[i].Error = err.Error()
+				return
+			}
+			results[i].Ask = ask
+		}()
+	}
+
+	wg.Wait()
+
+	return results
+}
+
+func (r *Retriever) queryAsk(ctx context.Context, miner address.Address) (*storagemarket.StorageAsk, time.Duration, error) {
+	if r.QueryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.QueryTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	resp, err := r.FilClient.GetAsk(ctx, miner)
+	latency := time.Since(start)
+	if err != nil {
+		return nil, latency, err
+	}
+
+	if resp.Ask == nil || resp.Ask.Ask == nil {
+		return nil, latency, fmt.Errorf("%s has no storage ask", miner)
+	}
+
+	return resp.Ask.Ask, latency, nil
+}
+
+// SortAsks orders asks from best to worst by, lower prices, piece sizes and
+// latencies first except for larger maximum piece sizes. Failed queries go
+// last.
+func SortAsks(results []*AskResult, by AskSort) {
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i].Ask, results[j].Ask
+		if a == nil || b == nil {
+			return b == nil && a != nil
+		}
+
+		switch by {
+		case AskSortVerifiedPrice:
+			return a.VerifiedPrice.LessThan(b.VerifiedPrice)
+		case AskSortMinPieceSize:
+			return a.MinPieceSize < b.MinPieceSize
+		case AskSortMaxPieceSize:
+			return a.MaxPieceSize > b.MaxPieceSize
+		case AskSortLatency:
+			return results[i].Latency < results[j].Latency
+		default:
+			return a.Price.LessThan(b.Price)
+		}
+	})
+}
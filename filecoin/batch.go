@@ -0,0 +1,349 @@
+package filecoin
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/labstack/gommon/log"
+	"golang.org/x/xerrors"
+)
+
+// A BatchEntry is a single retrieval listed in a batch manifest. Miners and
+// Network fall back to the batch-wide defaults when left empty.
+type BatchEntry struct {
+	Cid      string   `json:"cid"`
+	Miners   []string `json:"miners,omitempty"`
+	Selector string   `json:"selector,omitempty"`
+	Output   string   `json:"output,omitempty"`
+	Network  string   `json:"network,omitempty"`
+}
+
+// Key used to recognize an entry across runs of the same manifest.
+func (entry *BatchEntry) key() string {
+	return strings.Join([]string{entry.Cid, entry.Selector, entry.Output}, "|")
+}
+
+type BatchOptions struct {
+	// Number of retrievals to run at the same time
+	Concurrency int
+
+	// Defaults for entries that don't specify their own
+	Network string
+	Miners  []string
+
+	// Skip entries that already succeeded in a previous run of the manifest
+	Resume bool
+}
+
+type BatchResult struct {
+	Entry    BatchEntry    `json:"entry"`
+	Skipped  bool          `json:"skipped,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Size     uint64        `json:"size"`
+	Duration time.Duration `json:"duration"`
+}
+
+type BatchReport struct {
+	Results   []BatchResult `json:"results"`
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+	Skipped   int           `json:"skipped"`
+	Duration  time.Duration `json:"duration"`
+}
+
+// GetBatch retrieves every entry of the manifest at manifestPath with r,
+// using a pool of opts.Concurrency workers. Progress is journaled next to
+// the manifest so that a failed batch can be continued with opts.Resume.
+func GetBatch(ctx context.Context, r *Retriever, manifestPath string, opts BatchOptions) (*BatchReport, error) {
+	entries, err := ParseManifest(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+
+	report, err := r.RetrieveBatch(ctx, entries, progressPath(manifestPath), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	printBatchReport(report)
+
+	return report, nil
+}
+
+// RetrieveBatch runs the retrievals for entries, recording each completed
+// entry in the journal at progressFile.
+func (r *Retriever) RetrieveBatch(ctx context.Context, entries []BatchEntry, progressFile string, opts BatchOptions) (*BatchReport, error) {
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	done := make(map[string]bool)
+	if opts.Resume {
+		prev, err := loadProgress(progressFile)
+		if err != nil {
+			return nil, err
+		}
+		done = prev
+	}
+
+	journal, err := os.OpenFile(progressFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, xerrors.Errorf("could not open batch progress file: %w", err)
+	}
+	defer journal.Close()
+	var journalLk sync.Mutex
+
+	startTime := time.Now()
+	results := make([]BatchResult, len(entries))
+
+	work := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer wg.Done()
+
+			for idx := range work {
+				result := r.retrieveEntry(ctx, entries[idx], opts)
+				results[idx] = result
+
+				journalLk.Lock()
+				if err := json.NewEncoder(journal).Encode(&result); err != nil {
+					log.Errorf("Failed to record batch progress for %s: %v", result.Entry.Cid, err)
+				}
+				journalLk.Unlock()
+			}
+		}()
+	}
+
+	for idx, entry := range entries {
+		if done[entry.key()] {
+			results[idx] = BatchResult{Entry: entry, Skipped: true}
+			continue
+		}
+
+		select {
+		case work <- idx:
+		case <-ctx.Done():
+			results[idx] = BatchResult{Entry: entry, Error: ctx.Err().Error()}
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	report := &BatchReport{
+		Results:  results,
+		Duration: time.Since(startTime),
+	}
+	for _, result := range results {
+		switch {
+		case result.Skipped:
+			report.Skipped++
+		case result.Error != "":
+			report.Failed++
+		default:
+			report.Succeeded++
+		}
+	}
+
+	return report, nil
+}
+
+func (r *Retriever) retrieveEntry(ctx context.Context, entry BatchEntry, opts BatchOptions) BatchResult {
+	result := BatchResult{Entry: entry}
+
+	if err := ctx.Err(); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	c, err := cid.Decode(entry.Cid)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	minerStrings := entry.Miners
+	if len(minerStrings) == 0 {
+		minerStrings = opts.Miners
+	}
+	miners, err := parseMiners(minerStrings)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	network := entry.Network
+	if network == "" {
+		network = opts.Network
+	}
+
+	log.Infof("Retrieving %s", entry.Cid)
+
+	stats, err := r.Retrieve(ctx, GetRequest{
+		Cid:      c,
+		Network:  network,
+		Selector: entry.Selector,
+		Miners:   miners,
+		Output:   entry.Output,
+	})
+	if err != nil {
+		log.Errorf("Retrieval of %s failed: %v", entry.Cid, err)
+		result.Error = err.Error()
+		return result
+	}
+
+	result.Size = stats.GetByteSize()
+	result.Duration = stats.GetDuration()
+
+	return result
+}
+
+// ParseManifest reads a batch manifest. The format is picked from the file
+// extension:
+//
+//	.txt  - one CID per line, optionally followed by an output path
+//	.csv  - cid,miners,selector,output columns with an optional header row,
+//	        miners separated by spaces or semicolons
+//	.json - an array of BatchEntry objects
+//
+// Blank lines and lines starting with # are ignored in txt and csv manifests.
+func ParseManifest(manifestPath string) ([]BatchEntry, error) {
+	f, err := os.Open(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []BatchEntry
+	switch ext := strings.ToLower(filepath.Ext(manifestPath)); ext {
+	case ".txt":
+		entries, err = parseTxtManifest(f)
+	case ".csv":
+		entries, err = parseCsvManifest(f)
+	case ".json":
+		err = json.NewDecoder(f).Decode(&entries)
+	default:
+		return nil, fmt.Errorf("unsupported manifest format '%s' (expected .txt, .csv or .json)", ext)
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("failed to parse manifest %s: %w", manifestPath, err)
+	}
+
+	for i, entry := range entries {
+		if entry.Cid == "" {
+			return nil, fmt.Errorf("manifest entry %d has no CID", i+1)
+		}
+	}
+
+	return entries, nil
+}
+
+func parseTxtManifest(r io.Reader) ([]BatchEntry, error) {
+	var entries []BatchEntry
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		entry := BatchEntry{Cid: fields[0]}
+		if len(fields) > 1 {
+			entry.Output = fields[1]
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+func parseCsvManifest(r io.Reader) ([]BatchEntry, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []BatchEntry
+	for i, record := range records {
+		column := func(n int) string {
+			if n < len(record) {
+				return strings.TrimSpace(record[n])
+			}
+			return ""
+		}
+
+		if i == 0 && strings.EqualFold(column(0), "cid") {
+			continue
+		}
+
+		if column(0) == "" {
+			continue
+		}
+
+		entries = append(entries, BatchEntry{
+			Cid: column(0),
+			Miners: strings.FieldsFunc(column(1), func(r rune) bool {
+				return r == ';' || r == ' '
+			}),
+			Selector: column(2),
+			Output:   column(3),
+		})
+	}
+
+	return entries, nil
+}
+
+func progressPath(manifestPath string) string {
+	return manifestPath + ".progress"
+}
+
+// Load the keys of the entries that were successfully retrieved by previous
+// runs from the batch progress journal.
+func loadProgress(progressFile string) (map[string]bool, error) {
+	done := make(map[string]bool)
+
+	f, err := os.Open(progressFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return done, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	for {
+		var result BatchResult
+		if err := dec.Decode(&result); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, xerrors.Errorf("corrupt batch progress file %s: %w", progressFile, err)
+		}
+
+		done[result.Entry.key()] = result.Error == ""
+	}
+
+	return done, nil
+}
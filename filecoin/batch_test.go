@@ -0,0 +1,179 @@
+package filecoin
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeManifest(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestParseManifest(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    []BatchEntry
+		wantErr bool
+	}{
+		{
+			name:    "txt",
+			file:    "manifest.txt",
+			content: "# comment\nbafyone\n\n  bafytwo out/two  \n",
+			want: []BatchEntry{
+				{Cid: "bafyone"},
+				{Cid: "bafytwo", Output: "out/two"},
+			},
+		},
+		{
+			name:    "csv with header",
+			file:    "manifest.csv",
+			content: "cid,miners,selector,output\n# comment\nbafyone,f01000;f01001,,/tmp/one\nbafytwo\n,f01000\n",
+			want: []BatchEntry{
+				{Cid: "bafyone", Miners: []string{"f01000", "f01001"}, Output: "/tmp/one"},
+				{Cid: "bafytwo", Miners: []string{}},
+			},
+		},
+		{
+			name:    "csv without header",
+			file:    "manifest.csv",
+			content: "bafyone,f01000 f01001,sel\n",
+			want: []BatchEntry{
+				{Cid: "bafyone", Miners: []string{"f01000", "f01001"}, Selector: "sel"},
+			},
+		},
+		{
+			name:    "json",
+			file:    "manifest.json",
+			content: `[{"cid": "bafyone", "network": "ipfs"}, {"cid": "bafytwo", "miners": ["f01000"]}]`,
+			want: []BatchEntry{
+				{Cid: "bafyone", Network: "ipfs"},
+				{Cid: "bafytwo", Miners: []string{"f01000"}},
+			},
+		},
+		{
+			name:    "json entry without cid",
+			file:    "manifest.json",
+			content: `[{"cid": "bafyone"}, {"output": "two"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "malformed json",
+			file:    "manifest.json",
+			content: `[{"cid": `,
+			wantErr: true,
+		},
+		{
+			name:    "unsupported extension",
+			file:    "manifest.yaml",
+			content: "bafyone\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := ParseManifest(writeManifest(t, tt.file, tt.content))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parsed %v, want an error", entries)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(entries, tt.want) {
+				t.Errorf("parsed %+v, want %+v", entries, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetrieveBatchResume(t *testing.T) {
+	progressFile := filepath.Join(t.TempDir(), "manifest.txt.progress")
+
+	done := BatchEntry{Cid: "bafydone", Output: "done"}
+	failed := BatchEntry{Cid: "not a cid"}
+	retried := BatchEntry{Cid: "bafyretried"}
+
+	// A previous run that retrieved done, failed on failed, and failed on
+	// retried before a later run succeeded with it
+	f, err := os.Create(progressFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := json.NewEncoder(f)
+	for _, result := range []BatchResult{
+		{Entry: done, Size: 10},
+		{Entry: failed, Error: "transfer failed"},
+		{Entry: retried, Error: "transfer failed"},
+		{Entry: retried, Size: 20},
+	} {
+		if err := enc.Encode(&result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	progress, err := loadProgress(progressFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{done.key(): true, failed.key(): false, retried.key(): true}
+	if !reflect.DeepEqual(progress, want) {
+		t.Fatalf("loaded progress %v, want %v", progress, want)
+	}
+
+	// Entries that already succeeded are skipped without touching the
+	// retriever, failed ones are attempted again
+	var r Retriever
+	report, err := r.RetrieveBatch(context.Background(), []BatchEntry{done, failed, retried}, progressFile, BatchOptions{Resume: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Skipped != 2 || report.Failed != 1 || report.Succeeded != 0 {
+		t.Errorf("skipped %d, failed %d, succeeded %d, want 2, 1, 0", report.Skipped, report.Failed, report.Succeeded)
+	}
+	if !report.Results[0].Skipped || !report.Results[2].Skipped || report.Results[1].Error == "" {
+		t.Errorf("unexpected results %+v", report.Results)
+	}
+
+	// The retry is journaled after the previous results
+	progress, err = loadProgress(progressFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(progress, want) {
+		t.Errorf("progress after resuming %v, want %v", progress, want)
+	}
+}
+
+func TestLoadProgressMissing(t *testing.T) {
+	progress, err := loadProgress(filepath.Join(t.TempDir(), "missing.progress"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(progress) != 0 {
+		t.Errorf("loaded progress %v from a missing journal", progress)
+	}
+}
+
+func TestLoadProgressCorrupt(t *testing.T) {
+	if _, err := loadProgress(writeManifest(t, "manifest.txt.progress", "{\"entry\":")); err == nil {
+		t.Error("loaded a corrupt journal")
+	}
+}
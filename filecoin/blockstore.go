@@ -0,0 +1,377 @@
+package filecoin
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	whypfs "github.com/application-research/whypfs-core"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/ipfs/go-bitswap"
+	bsnet "github.com/ipfs/go-bitswap/network"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	ipldformat "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/labstack/gommon/log"
+	"golang.org/x/sync/singleflight"
+)
+
+// A CandidateFinder looks up the FIL retrieval candidates holding a CID. The
+// candidates' RootCid is the root of the deal enclosing the CID, which may
+// be the CID itself.
+type CandidateFinder interface {
+	FindCandidates(ctx context.Context, c cid.Cid) ([]FILRetrievalCandidate, error)
+}
+
+// EndpointCandidateFinder finds candidates with a retrieval candidates HTTP
+// endpoint, see GetRetrievalCandidates
+type EndpointCandidateFinder string
+
+func (endpoint EndpointCandidateFinder) FindCandidates(ctx context.Context, c cid.Cid) ([]FILRetrievalCandidate, error) {
+	return GetRetrievalCandidates(ctx, string(endpoint), c)
+}
+
+// FallbackBlockstore wraps a local blockstore, retrieving blocks that are
+// missing locally from Filecoin. On a miss, the enclosing root of the block
+// is looked up with a CandidateFinder and retrieved in full into the local
+// blockstore. Concurrent misses for the same root share one retrieval, and
+// blocks that could not be retrieved aren't tried again for
+// NegativeCacheTTL.
+//
+// It is only meant for serving, see ServeBlockstore: the node keeps reading
+// its local blockstore so that lookups like pin verification don't turn
+// into paid retrievals. Misses of blocks other peers want are only
+// retrieved within RemoteBudget and RemoteRate.
+type FallbackBlockstore struct {
+	blockstore.Blockstore
+
+	retriever *Retriever
+	finder    CandidateFinder
+
+	// How long to remember that a block could not be retrieved
+	NegativeCacheTTL time.Duration
+
+	// How long a single retrieval may take
+	RetrievalTimeout time.Duration
+
+	// Most the retrievals for other peers may cost together, never
+	// retrieving for them if nil
+	RemoteBudget *abi.TokenAmount
+
+	// Most lookups and retrievals for other peers per hour, no limit if 0
+	RemoteRate int
+
+	fetches singleflight.Group
+
+	missesLk sync.Mutex
+	misses   map[cid.Cid]time.Time
+
+	remoteLk      sync.Mutex
+	remoteSpent   abi.TokenAmount
+	remoteLookups []time.Time
+}
+
+// NewFallbackBlockstore wraps local, which must be the blockstore the
+// retriever's filclient writes to.
+func NewFallbackBlockstore(local blockstore.Blockstore, r *Retriever, finder CandidateFinder) *FallbackBlockstore {
+	return &FallbackBlockstore{
+		Blockstore:       local,
+		retriever:        r,
+		finder:           finder,
+		NegativeCacheTTL: 10 * time.Minute,
+		RetrievalTimeout: 30 * time.Minute,
+		RemoteRate:       10,
+		misses:           make(map[cid.Cid]time.Time),
+		remoteSpent:      big.Zero(),
+	}
+}
+
+func (bs *FallbackBlockstore) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	return bs.has(ctx, c, false)
+}
+
+func (bs *FallbackBlockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	return bs.get(ctx, c, false)
+}
+
+func (bs *FallbackBlockstore) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	return bs.getSize(ctx, c, false)
+}
+
+func (bs *FallbackBlockstore) has(ctx context.Context, c cid.Cid, remote bool) (bool, error) {
+	has, err := bs.Blockstore.Has(ctx, c)
+	if err != nil || has {
+		return has, err
+	}
+
+	if !bs.fetch(ctx, c, remote) {
+		return false, nil
+	}
+
+	return bs.Blockstore.Has(ctx, c)
+}
+
+func (bs *FallbackBlockstore) get(ctx context.Context, c cid.Cid, remote bool) (blocks.Block, error) {
+	blk, err := bs.Blockstore.Get(ctx, c)
+	if !ipldformat.IsNotFound(err) {
+		return blk, err
+	}
+
+	if !bs.fetch(ctx, c, remote) {
+		return nil, err
+	}
+
+	return bs.Blockstore.Get(ctx, c)
+}
+
+func (bs *FallbackBlockstore) getSize(ctx context.Context, c cid.Cid, remote bool) (int, error) {
+	size, err := bs.Blockstore.GetSize(ctx, c)
+	if !ipldformat.IsNotFound(err) {
+		return size, err
+	}
+
+	if !bs.fetch(ctx, c, remote) {
+		return size, err
+	}
+
+	return bs.Blockstore.GetSize(ctx, c)
+}
+
+// remoteView is the FallbackBlockstore as Bitswap sees it, its misses being
+// the wants of other peers
+type remoteView struct {
+	*FallbackBlockstore
+}
+
+func (v remoteView) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	return v.has(ctx, c, true)
+}
+
+func (v remoteView) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	return v.get(ctx, c, true)
+}
+
+func (v remoteView) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	return v.getSize(ctx, c, true)
+}
+
+// Try to retrieve the DAG enclosing c from Filecoin, returning whether c is
+// now available locally. remote is whether another peer wants c.
+func (bs *FallbackBlockstore) fetch(ctx context.Context, c cid.Cid, remote bool) bool {
+	if bs.recentlyMissed(c) {
+		return false
+	}
+
+	if remote && !bs.allowRemote() {
+		return false
+	}
+
+	candidates, err := bs.finder.FindCandidates(ctx, c)
+	if err != nil {
+		log.Debugf("Failed to find retrieval candidates for %s: %v", c, err)
+	}
+
+	// Group the candidates by the root that has to be retrieved
+	var roots []cid.Cid
+	byRoot := make(map[cid.Cid][]FILRetrievalCandidate)
+	for _, candidate := range candidates {
+		if _, ok := byRoot[candidate.RootCid]; !ok {
+			roots = append(roots, candidate.RootCid)
+		}
+		byRoot[candidate.RootCid] = append(byRoot[candidate.RootCid], candidate)
+	}
+
+	for _, root := range roots {
+		if err := bs.retrieveRoot(ctx, root, byRoot[root], remote); err != nil {
+			log.Debugf("Fallback retrieval of root %s for %s failed: %v", root, c, err)
+			continue
+		}
+
+		if has, err := bs.Blockstore.Has(ctx, c); err == nil && has {
+			return true
+		}
+	}
+
+	bs.missed(c)
+	return false
+}
+
+// Whether a miss of another peer may be looked up
+func (bs *FallbackBlockstore) allowRemote() bool {
+	bs.remoteLk.Lock()
+	defer bs.remoteLk.Unlock()
+
+	if bs.RemoteBudget == nil {
+		return false
+	}
+
+	if big.Sub(*bs.RemoteBudget, bs.remoteSpent).LessThanEqual(big.Zero()) {
+		return false
+	}
+
+	if bs.RemoteRate > 0 {
+		recent := bs.remoteLookups[:0]
+		for _, t := range bs.remoteLookups {
+			if time.Since(t) < time.Hour {
+				recent = append(recent, t)
+			}
+		}
+		bs.remoteLookups = recent
+
+		if len(recent) >= bs.RemoteRate {
+			return false
+		}
+		bs.remoteLookups = append(bs.remoteLookups, time.Now())
+	}
+
+	return true
+}
+
+// Reserve the most a retrieval for another peer may cost from what is left
+// of RemoteBudget, so that concurrent retrievals can't overspend it together
+func (bs *FallbackBlockstore) reserveRemote() (abi.TokenAmount, bool) {
+	bs.remoteLk.Lock()
+	defer bs.remoteLk.Unlock()
+
+	if bs.RemoteBudget == nil {
+		return abi.TokenAmount{}, false
+	}
+
+	left := big.Sub(*bs.RemoteBudget, bs.remoteSpent)
+	if left.LessThanEqual(big.Zero()) {
+		return abi.TokenAmount{}, false
+	}
+
+	reserved := bs.retriever.MaxPrice
+	if reserved.Nil() || left.LessThan(reserved) {
+		reserved = left
+	}
+	bs.remoteSpent = big.Add(bs.remoteSpent, reserved)
+
+	return reserved, true
+}
+
+// Give back what a reservation didn't end up paying
+func (bs *FallbackBlockstore) settleRemote(reserved abi.TokenAmount, paid abi.TokenAmount) {
+	bs.remoteLk.Lock()
+	defer bs.remoteLk.Unlock()
+
+	bs.remoteSpent = big.Add(big.Sub(bs.remoteSpent, reserved), paid)
+}
+
+// Retrieve root, charging it to RemoteBudget if remote
+func (bs *FallbackBlockstore) retrieveRoot(ctx context.Context, root cid.Cid, candidates []FILRetrievalCandidate, remote bool) error {
+	if err := bs.retriever.checkFIL(ctx); err != nil {
+		return err
+	}
+
+	ch := bs.fetches.DoChan(root.KeyString(), func() (interface{}, error) {
+		// Not tied to the caller, others may be waiting on the same
+		// retrieval
+		ctx, cancel := context.WithTimeout(context.Background(), bs.RetrievalTimeout)
+		defer cancel()
+
+		// What a retrieval for another peer may cost is reserved up front
+		// and what it didn't pay given back, nothing if it failed
+		maxPrice := bs.retriever.MaxPrice
+		paid := big.Zero()
+		if remote {
+			reserved, ok := bs.reserveRemote()
+			if !ok {
+				return nil, errors.New("the budget for retrievals for other peers is spent")
+			}
+			defer func() { bs.settleRemote(reserved, paid) }()
+
+			maxPrice = reserved
+		}
+
+		log.Infof("Fetching %s from Filecoin to fill a blockstore miss", root)
+
+		attempt := &FILRetrievalAttempt{
+			Client:     bs.retriever.FilClient,
+			Cid:        root,
+			Candidates: candidates,
+			MaxPrice:   maxPrice,
+
+			QueryConcurrency: bs.retriever.QueryConcurrency,
+			QueryTimeout:     bs.retriever.QueryTimeout,
+			QueryCache:       bs.retriever.QueryCache,
+		}
+		stats, err := attempt.Retrieve(ctx, bs.retriever.Node)
+		if err != nil {
+			return nil, err
+		}
+
+		if fstats, ok := stats.(*FILRetrievalStats); ok && remote && !fstats.TotalPayment.Nil() {
+			paid = fstats.TotalPayment
+		}
+
+		bs.retriever.touchCache(ctx, root)
+		bs.retriever.provideRetrieved(ctx, root)
+
+		return stats, nil
+	})
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case res := <-ch:
+		return res.Err
+	}
+}
+
+func (bs *FallbackBlockstore) recentlyMissed(c cid.Cid) bool {
+	bs.missesLk.Lock()
+	defer bs.missesLk.Unlock()
+
+	missedAt, ok := bs.misses[c]
+	if !ok {
+		return false
+	}
+
+	if time.Since(missedAt) > bs.NegativeCacheTTL {
+		delete(bs.misses, c)
+		return false
+	}
+
+	return true
+}
+
+func (bs *FallbackBlockstore) missed(c cid.Cid) {
+	bs.missesLk.Lock()
+	defer bs.missesLk.Unlock()
+
+	bs.misses[c] = time.Now()
+}
+
+// ServeBlockstore restarts the node's Bitswap on top of fb, so that blocks
+// other peers want are served from it and, within its limits, retrieved from
+// Filecoin. The node's own blockstore and DAG service stay local.
+func ServeBlockstore(nd *whypfs.Node, fb *FallbackBlockstore) {
+	// Stop the old Bitswap first, it owns the protocol handlers on the host
+	nd.Bitswap.Close()
+
+	bsopts := []bitswap.Option{
+		bitswap.EngineBlockstoreWorkerCount(600),
+		bitswap.TaskWorkerCount(600),
+	}
+	if peerwork := nd.Config.BitswapConfig.MaxOutstandingBytesPerPeer; peerwork != 0 {
+		bsopts = append(bsopts, bitswap.MaxOutstandingBytesPerPeer(int(peerwork)))
+	}
+	if tms := nd.Config.BitswapConfig.TargetMessageSize; tms != 0 {
+		bsopts = append(bsopts, bitswap.WithTargetMessageSize(tms))
+	}
+
+	// Misses of blocks other peers want are limited, see FallbackBlockstore
+	bswap := bitswap.New(nd.Ctx, bsnet.NewFromIpfsHost(nd.Host, nd.Dht), remoteView{fb}, bsopts...)
+
+	nd.Bitswap = bswap
+	nd.Exchange = bswap
+	nd.Blockservice = blockservice.New(nd.Blockstore, bswap)
+	nd.DAGService = merkledag.NewDAGService(nd.Blockservice)
+}
@@ -0,0 +1,460 @@
+package filecoin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	ipldformat "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/labstack/gommon/log"
+	"golang.org/x/xerrors"
+)
+
+// CachePolicy decides which cached roots are evicted first
+type CachePolicy string
+
+const (
+	// Evict the least recently used roots first
+	CacheLRU CachePolicy = "lru"
+
+	// Evict the least frequently used roots first
+	CacheLFU CachePolicy = "lfu"
+)
+
+func ParseCachePolicy(s string) (CachePolicy, error) {
+	switch policy := CachePolicy(s); policy {
+	case CacheLRU, CacheLFU:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown cache policy '%s' (expected lru or lfu)", s)
+	}
+}
+
+var cachePrefix = datastore.NewKey("/wormhole/cache")
+
+// A CacheEntry tracks the use of a retrieved root
+type CacheEntry struct {
+	Root       cid.Cid   `json:"root"`
+	Accesses   uint64    `json:"accesses"`
+	LastAccess time.Time `json:"lastAccess"`
+	Added      time.Time `json:"added"`
+}
+
+type GCResult struct {
+	Evicted       []cid.Cid `json:"evicted"`
+	BlocksRemoved int       `json:"blocksRemoved"`
+	BytesFreed    int64     `json:"bytesFreed"`
+
+	// Size of the cached content left after the GC
+	Size int64 `json:"size"`
+}
+
+// Cache bounds the space taken by retrieved content in the blockstore. It
+// tracks the accesses to each retrieved root and evicts unpinned roots by
+// policy, only removing blocks that no other cached or pinned DAG
+// references.
+type Cache struct {
+	ds   datastore.Batching
+	bs   blockstore.Blockstore
+	pins *Pinset
+
+	Policy CachePolicy
+
+	// Maximum size of the cached content in bytes, 0 for no limit
+	MaxSize int64
+
+	// Background GC starts once the cache is above HighWater of MaxSize
+	// and evicts until it is below LowWater
+	HighWater float64
+	LowWater  float64
+
+	lk   sync.Mutex
+	gcLk sync.Mutex
+}
+
+// NewCache manages the content of bs, which should be the node's local
+// blockstore and not one that fetches blocks on a miss
+func NewCache(ds datastore.Batching, bs blockstore.Blockstore, pins *Pinset, policy CachePolicy, maxSize int64) *Cache {
+	return &Cache{
+		ds:        ds,
+		bs:        bs,
+		pins:      pins,
+		Policy:    policy,
+		MaxSize:   maxSize,
+		HighWater: 0.9,
+		LowWater:  0.7,
+	}
+}
+
+func cacheKey(root cid.Cid) datastore.Key {
+	return cachePrefix.ChildString(root.String())
+}
+
+// Touch records an access to root, tracking it if it isn't yet. Pinned
+// roots are tracked too, GC skips them for as long as they stay pinned.
+func (c *Cache) Touch(ctx context.Context, root cid.Cid) error {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	now := time.Now()
+
+	entry, err := c.get(ctx, root)
+	switch {
+	case err == datastore.ErrNotFound:
+		entry = &CacheEntry{Root: root, Added: now}
+	case err != nil:
+		return err
+	}
+
+	entry.Accesses++
+	entry.LastAccess = now
+
+	return c.put(ctx, entry)
+}
+
+// List returns the tracked roots
+func (c *Cache) List(ctx context.Context) ([]*CacheEntry, error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	return c.list(ctx)
+}
+
+// Size returns the size of the evictable cached content, counting shared
+// blocks once and leaving out the blocks pins keep
+func (c *Cache) Size(ctx context.Context) (int64, error) {
+	scan, err := c.scan(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return scan.size, nil
+}
+
+// GC evicts unpinned roots in the order of policy until the cached content
+// takes at most target bytes
+func (c *Cache) GC(ctx context.Context, target int64, policy CachePolicy) (*GCResult, error) {
+	c.gcLk.Lock()
+	defer c.gcLk.Unlock()
+
+	// No pin may be added between counting the references to blocks and
+	// deleting them
+	c.pins.lk.Lock()
+	defer c.pins.lk.Unlock()
+
+	scan, err := c.scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &GCResult{Size: scan.size}
+	if scan.size <= target {
+		return res, nil
+	}
+
+	var candidates []*CacheEntry
+	for _, entry := range scan.entries {
+		if !scan.pinned[entry.Root] {
+			candidates = append(candidates, entry)
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if policy == CacheLFU && a.Accesses != b.Accesses {
+			return a.Accesses < b.Accesses
+		}
+		return a.LastAccess.Before(b.LastAccess)
+	})
+
+	for _, entry := range candidates {
+		if res.Size <= target {
+			break
+		}
+
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+
+		evicted, err := c.untrack(ctx, entry)
+		if err != nil {
+			return res, err
+		}
+		if !evicted {
+			// Used while we were scanning
+			continue
+		}
+
+		res.Evicted = append(res.Evicted, entry.Root)
+
+		for _, blk := range scan.blocks[entry.Root] {
+			scan.refs[blk]--
+			if scan.refs[blk] > 0 {
+				continue
+			}
+
+			if err := c.bs.DeleteBlock(ctx, blk); err != nil {
+				return res, xerrors.Errorf("failed to delete block %s: %w", blk, err)
+			}
+
+			res.BlocksRemoved++
+			res.BytesFreed += scan.sizes[blk]
+			res.Size -= scan.sizes[blk]
+		}
+
+		log.Infof("Evicted %s from the cache", entry.Root)
+	}
+
+	return res, nil
+}
+
+// Run collects garbage every interval whenever the cache is above its high
+// watermark, until ctx is done. Without a MaxSize or a positive interval,
+// it doesn't.
+func (c *Cache) Run(ctx context.Context, interval time.Duration) {
+	if c.MaxSize <= 0 || interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		size, err := c.Size(ctx)
+		if err != nil {
+			log.Errorf("Failed to compute cache size: %v", err)
+			continue
+		}
+
+		if float64(size) <= c.HighWater*float64(c.MaxSize) {
+			continue
+		}
+
+		log.Infof("Cache is %d of %d bytes, collecting garbage", size, c.MaxSize)
+
+		res, err := c.GC(ctx, int64(c.LowWater*float64(c.MaxSize)), c.Policy)
+		if err != nil {
+			log.Errorf("Cache GC failed: %v", err)
+			continue
+		}
+
+		log.Infof("Cache GC evicted %d roots, freeing %d bytes", len(res.Evicted), res.BytesFreed)
+	}
+}
+
+type cacheScan struct {
+	entries []*CacheEntry
+
+	// Recursively pinned roots
+	pinned map[cid.Cid]bool
+
+	// Blocks of each tracked root
+	blocks map[cid.Cid][]cid.Cid
+
+	// Number of tracked and pinned roots referencing each block
+	refs  map[cid.Cid]int
+	sizes map[cid.Cid]int64
+
+	// Blocks kept by pins
+	held map[cid.Cid]bool
+
+	// Size of the blocks referenced by tracked roots and not kept by pins
+	size int64
+}
+
+// Walk the tracked and pinned DAGs, counting the references to each block
+func (c *Cache) scan(ctx context.Context) (*cacheScan, error) {
+	entries, err := c.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pins, err := c.pins.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	scan := &cacheScan{
+		entries: entries,
+		pinned:  make(map[cid.Cid]bool),
+		blocks:  make(map[cid.Cid][]cid.Cid),
+		refs:    make(map[cid.Cid]int),
+		sizes:   make(map[cid.Cid]int64),
+		held:    make(map[cid.Cid]bool),
+	}
+
+	for _, entry := range entries {
+		blks, err := c.walk(ctx, entry.Root)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to walk cached root %s: %w", entry.Root, err)
+		}
+
+		scan.blocks[entry.Root] = blks
+		for _, blk := range blks {
+			scan.refs[blk]++
+		}
+	}
+
+	for _, pin := range pins {
+		// A direct pin keeps its root block but doesn't stop the rest of a
+		// cached DAG from being evicted
+		if !pin.Recursive() {
+			scan.refs[pin.Cid]++
+			scan.held[pin.Cid] = true
+			continue
+		}
+
+		scan.pinned[pin.Cid] = true
+
+		blks, err := c.walk(ctx, pin.Cid)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to walk pinned root %s: %w", pin.Cid, err)
+		}
+
+		for _, blk := range blks {
+			scan.refs[blk]++
+			scan.held[blk] = true
+		}
+	}
+
+	// Only the blocks GC could remove count towards the cache size
+	for _, blks := range scan.blocks {
+		for _, blk := range blks {
+			if _, ok := scan.sizes[blk]; ok || scan.held[blk] {
+				continue
+			}
+
+			size, err := c.bs.GetSize(ctx, blk)
+			if err != nil {
+				return nil, err
+			}
+			scan.sizes[blk] = int64(size)
+			scan.size += int64(size)
+		}
+	}
+
+	return scan, nil
+}
+
+// Collect the locally available blocks of the DAG under root
+func (c *Cache) walk(ctx context.Context, root cid.Cid) ([]cid.Cid, error) {
+	dserv := merkledag.NewDAGService(blockservice.New(c.bs, offline.Exchange(c.bs)))
+
+	var blks []cid.Cid
+	cset := cid.NewSet()
+	err := merkledag.Walk(ctx, func(ctx context.Context, blk cid.Cid) ([]*ipldformat.Link, error) {
+		node, err := dserv.Get(ctx, blk)
+		if err != nil {
+			// Partially retrieved DAGs are fine, the missing blocks take up
+			// no space
+			if ipldformat.IsNotFound(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+
+		blks = append(blks, blk)
+		return node.Links(), nil
+	}, root, cset.Visit)
+	if err != nil {
+		return nil, err
+	}
+
+	return blks, nil
+}
+
+// Stop tracking entry unless it was accessed since it was read, returning
+// whether it was removed
+func (c *Cache) untrack(ctx context.Context, entry *CacheEntry) (bool, error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	current, err := c.get(ctx, entry.Root)
+	if err != nil {
+		if err == datastore.ErrNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if !current.LastAccess.Equal(entry.LastAccess) {
+		return false, nil
+	}
+
+	if err := c.ds.Delete(ctx, cacheKey(entry.Root)); err != nil {
+		return false, err
+	}
+
+	// Evicted content can't be served anymore, stop announcing it
+	if err := c.ds.Delete(ctx, providedKey(entry.Root)); err != nil {
+		return false, err
+	}
+
+	return true, c.ds.Sync(ctx, cachePrefix)
+}
+
+func (c *Cache) get(ctx context.Context, root cid.Cid) (*CacheEntry, error) {
+	data, err := c.ds.Get(ctx, cacheKey(root))
+	if err != nil {
+		return nil, err
+	}
+
+	var entry CacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, xerrors.Errorf("could not decode cache entry for %s: %w", root, err)
+	}
+
+	return &entry, nil
+}
+
+func (c *Cache) put(ctx context.Context, entry *CacheEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if err := c.ds.Put(ctx, cacheKey(entry.Root), data); err != nil {
+		return err
+	}
+
+	return c.ds.Sync(ctx, cachePrefix)
+}
+
+func (c *Cache) list(ctx context.Context) ([]*CacheEntry, error) {
+	res, err := c.ds.Query(ctx, query.Query{Prefix: cachePrefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	var entries []*CacheEntry
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+
+		var entry CacheEntry
+		if err := json.Unmarshal(r.Value, &entry); err != nil {
+			return nil, xerrors.Errorf("could not decode cache entry %s: %w", r.Key, err)
+		}
+
+		entries = append(entries, &entry)
+	}
+
+	return entries, nil
+}
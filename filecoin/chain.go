@@ -0,0 +1,34 @@
+package filecoin
+
+import (
+	"context"
+
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/api/client"
+	cliutil "github.com/filecoin-project/lotus/cli/util"
+	"golang.org/x/xerrors"
+)
+
+// Chain is the chain state and message pool access retrievals, payment
+// channels and the wallet need. It is the lotus gateway API, implemented by a
+// remote lotus gateway, and by MemChain in tests.
+type Chain interface {
+	api.Gateway
+}
+
+// GatewayAPI connects to the lotus gateway at ApiURL
+func GatewayAPI() (Chain, func(), error) {
+	info := cliutil.ParseApiInfo(ApiURL)
+
+	addr, err := info.DialArgs("v1")
+	if err != nil {
+		return nil, nil, xerrors.Errorf("invalid chain API URL '%s': %w", ApiURL, err)
+	}
+
+	gw, closer, err := client.NewGatewayRPCV1(context.Background(), addr, info.AuthHeader())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return gw, closer, nil
+}
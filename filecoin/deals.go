@@ -0,0 +1,526 @@
+package filecoin
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/application-research/filclient"
+	"github.com/filecoin-project/go-address"
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	datatransfer "github.com/filecoin-project/go-data-transfer"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/labstack/gommon/log"
+	"golang.org/x/xerrors"
+)
+
+// Bounds the built-in market actor puts on deal durations
+const (
+	MinDealDuration = 180 * builtin.EpochsInDay
+	MaxDealDuration = 540 * builtin.EpochsInDay
+)
+
+// filclient starts deals this many epochs after the chain head
+const DealStartDelay = 7 * builtin.EpochsInDay
+
+var ErrDealNotFound = fmt.Errorf("deal not found")
+
+var (
+	dealsPrefix      = datastore.NewKey("/wormhole/deals")
+	dealsNextID      = datastore.NewKey("/wormhole/next-deal-id")
+	dealEventsPrefix = datastore.NewKey("/wormhole/deal-events")
+)
+
+// DealRequest asks a storage provider to store content held by the node
+type DealRequest struct {
+	Cid   cid.Cid         `json:"cid"`
+	Miner address.Address `json:"miner"`
+
+	// Length of the deal in epochs
+	Duration abi.ChainEpoch `json:"duration"`
+
+	// Price per GiB per epoch, the provider's ask if nil
+	Price *abi.TokenAmount `json:"price,omitempty"`
+
+	Verified      bool `json:"verified,omitempty"`
+	FastRetrieval bool `json:"fastRetrieval,omitempty"`
+}
+
+// A Deal records a storage deal proposed through wormhole
+type Deal struct {
+	ID      uint64          `json:"id"`
+	Cid     cid.Cid         `json:"cid"`
+	Miner   address.Address `json:"miner"`
+	Client  address.Address `json:"client"`
+	Created time.Time       `json:"created"`
+	Updated time.Time       `json:"updated"`
+
+	ProposalCid   cid.Cid                         `json:"proposalCid"`
+	PieceCid      cid.Cid                         `json:"pieceCid"`
+	PieceSize     abi.PaddedPieceSize             `json:"pieceSize"`
+	PayloadSize   uint64                          `json:"payloadSize"`
+	Verified      bool                            `json:"verified"`
+	FastRetrieval bool                            `json:"fastRetrieval"`
+	StartEpoch    abi.ChainEpoch                  `json:"startEpoch"`
+	EndEpoch      abi.ChainEpoch                  `json:"endEpoch"`
+	PricePerEpoch abi.TokenAmount                 `json:"pricePerEpoch"`
+	TotalPrice    abi.TokenAmount                 `json:"totalPrice"`
+	TransferID    string                          `json:"transferId,omitempty"`
+	Status        storagemarket.StorageDealStatus `json:"status"`
+	State         string                          `json:"state"`
+	Message       string                          `json:"message,omitempty"`
+
+	// Known once the deal is published on chain
+	DealID     abi.DealID `json:"dealId,omitempty"`
+	PublishCid *cid.Cid   `json:"publishCid,omitempty"`
+
+	// The last state the provider reported
+	ProviderState *storagemarket.ProviderDealState `json:"providerState,omitempty"`
+
+	// The deal this one replaces and the deal replacing it, if renewed
+	RenewalOf uint64 `json:"renewalOf,omitempty"`
+	RenewedBy uint64 `json:"renewedBy,omitempty"`
+}
+
+// Whether the deal ended, successfully or not. Active deals aren't finished
+// until they expire.
+func (deal *Deal) Finished() bool {
+	switch deal.Status {
+	case storagemarket.StorageDealError,
+		storagemarket.StorageDealFailing,
+		storagemarket.StorageDealProposalRejected,
+		storagemarket.StorageDealProposalNotFound,
+		storagemarket.StorageDealSlashed,
+		storagemarket.StorageDealExpired:
+		return true
+	}
+	return false
+}
+
+// A DealEvent records a deal entering a state
+type DealEvent struct {
+	Time    time.Time                       `json:"time"`
+	Status  storagemarket.StorageDealStatus `json:"status"`
+	State   string                          `json:"state"`
+	Message string                          `json:"message,omitempty"`
+}
+
+// DealStore keeps the deals made through wormhole in the node's datastore
+type DealStore struct {
+	ds datastore.Batching
+	lk sync.Mutex
+}
+
+func NewDealStore(ds datastore.Batching) *DealStore {
+	return &DealStore{ds: ds}
+}
+
+// Get returns the deal with the given ID
+func (s *DealStore) Get(ctx context.Context, id uint64) (*Deal, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	return s.get(ctx, id)
+}
+
+// List returns all deals ordered by ID
+func (s *DealStore) List(ctx context.Context) ([]*Deal, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	res, err := s.ds.Query(ctx, query.Query{Prefix: dealsPrefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	var deals []*Deal
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+
+		var deal Deal
+		if err := json.Unmarshal(r.Value, &deal); err != nil {
+			return nil, xerrors.Errorf("could not decode deal %s: %w", r.Key, err)
+		}
+
+		deals = append(deals, &deal)
+	}
+
+	sort.Slice(deals, func(i, j int) bool {
+		return deals[i].ID < deals[j].ID
+	})
+
+	return deals, nil
+}
+
+// Add records a new deal, assigning it an ID
+func (s *DealStore) Add(ctx context.Context, deal *Deal) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	id, err := s.nextID(ctx)
+	if err != nil {
+		return err
+	}
+
+	deal.ID = id
+	deal.Created = time.Now()
+
+	return s.put(ctx, deal)
+}
+
+// Modify applies modify to the stored deal with the given ID and stores the
+// result, so that changes made to other fields meanwhile aren't overwritten
+func (s *DealStore) Modify(ctx context.Context, id uint64, modify func(*Deal)) (*Deal, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	deal, err := s.get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	modify(deal)
+
+	if err := s.put(ctx, deal); err != nil {
+		return nil, err
+	}
+
+	return deal, nil
+}
+
+func dealKey(id uint64) datastore.Key {
+	return dealsPrefix.ChildString(strconv.FormatUint(id, 10))
+}
+
+func (s *DealStore) nextID(ctx context.Context) (uint64, error) {
+	var id uint64 = 1
+
+	data, err := s.ds.Get(ctx, dealsNextID)
+	switch {
+	case err == nil:
+		id = binary.BigEndian.Uint64(data)
+	case err != datastore.ErrNotFound:
+		return 0, err
+	}
+
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, id+1)
+	if err := s.ds.Put(ctx, dealsNextID, buf); err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+func (s *DealStore) get(ctx context.Context, id uint64) (*Deal, error) {
+	data, err := s.ds.Get(ctx, dealKey(id))
+	if err != nil {
+		if err == datastore.ErrNotFound {
+			return nil, ErrDealNotFound
+		}
+		return nil, err
+	}
+
+	var deal Deal
+	if err := json.Unmarshal(data, &deal); err != nil {
+		return nil, xerrors.Errorf("could not decode deal %d: %w", id, err)
+	}
+
+	return &deal, nil
+}
+
+// Store deal, logging an event if its state or message changed
+func (s *DealStore) put(ctx context.Context, deal *Deal) error {
+	deal.Updated = time.Now()
+	deal.State = storagemarket.DealStates[deal.Status]
+
+	prev, err := s.get(ctx, deal.ID)
+	switch {
+	case err == ErrDealNotFound:
+	case err != nil:
+		return err
+	case prev.Status == deal.Status && prev.Message == deal.Message:
+		prev = deal
+	}
+
+	data, err := json.Marshal(deal)
+	if err != nil {
+		return err
+	}
+
+	if err := s.ds.Put(ctx, dealKey(deal.ID), data); err != nil {
+		return err
+	}
+
+	if prev != deal {
+		if err := s.logEvent(ctx, deal); err != nil {
+			return err
+		}
+	}
+
+	return s.ds.Sync(ctx, dealsPrefix)
+}
+
+func (s *DealStore) logEvent(ctx context.Context, deal *Deal) error {
+	data, err := json.Marshal(&DealEvent{
+		Time:    deal.Updated,
+		Status:  deal.Status,
+		State:   deal.State,
+		Message: deal.Message,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Zero padded, so that the keys sort by time
+	key := dealEventsKey(deal.ID).ChildString(fmt.Sprintf("%020d", deal.Updated.UnixNano()))
+	if err := s.ds.Put(ctx, key, data); err != nil {
+		return err
+	}
+
+	return s.ds.Sync(ctx, dealEventsPrefix)
+}
+
+func dealEventsKey(id uint64) datastore.Key {
+	return dealEventsPrefix.ChildString(strconv.FormatUint(id, 10))
+}
+
+// Events returns the event log of a deal, oldest first
+func (s *DealStore) Events(ctx context.Context, id uint64) ([]*DealEvent, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	res, err := s.ds.Query(ctx, query.Query{
+		Prefix: dealEventsKey(id).String(),
+		Orders: []query.Order{query.OrderByKey{}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	var events []*DealEvent
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+
+		var event DealEvent
+		if err := json.Unmarshal(r.Value, &event); err != nil {
+			return nil, xerrors.Errorf("could not decode deal event %s: %w", r.Key, err)
+		}
+
+		events = append(events, &event)
+	}
+
+	return events, nil
+}
+
+// MakeDeal proposes a storage deal for req.Cid, which must be held by the
+// node, and starts pushing the data to the provider. The deal is recorded
+// once it is proposed, failed proposals included. The transfer runs in the
+// background, see WaitTransfer.
+//
+// Only providers speaking deal protocol v1.1.0 are supported, the data being
+// pushed over graphsync.
+func (r *Retriever) MakeDeal(ctx context.Context, req DealRequest) (*Deal, error) {
+	if r.Signer != Signer(r.Wallet) {
+		return nil, xerrors.Errorf("deal proposals are signed by filclient: %w", ErrSignerNotLocal)
+	}
+
+	if req.Duration < MinDealDuration || req.Duration > MaxDealDuration {
+		return nil, fmt.Errorf("deal duration of %d epochs is not between %d and %d", req.Duration, MinDealDuration, MaxDealDuration)
+	}
+
+	has, err := r.Node.Blockstore.Has(ctx, req.Cid)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return nil, fmt.Errorf("%s is not held by the node, add it first", req.Cid)
+	}
+
+	if err := r.checkDealProtocol(ctx, req.Miner); err != nil {
+		return nil, err
+	}
+
+	ask, err := r.FilClient.GetAsk(ctx, req.Miner)
+	if err != nil {
+		return nil, xerrors.Errorf("getting the ask of %s: %w", req.Miner, err)
+	}
+	if ask.Ask == nil || ask.Ask.Ask == nil {
+		return nil, fmt.Errorf("%s has no storage ask", req.Miner)
+	}
+	askPrice := ask.Ask.Ask.Price
+	if req.Verified {
+		askPrice = ask.Ask.Ask.VerifiedPrice
+	}
+
+	price := askPrice
+	if req.Price != nil {
+		price = *req.Price
+	}
+	if price.LessThan(askPrice) {
+		return nil, fmt.Errorf("%s asks %s per GiB per epoch, more than the price of %s", req.Miner, types.FIL(askPrice), types.FIL(price))
+	}
+
+	log.Infof("Computing the piece commitment of %s...", req.Cid)
+
+	prop, err := r.FilClient.MakeDeal(ctx, req.Miner, req.Cid, price, ask.Ask.Ask.MinPieceSize, req.Duration, req.Verified)
+	if err != nil {
+		return nil, xerrors.Errorf("creating the deal proposal: %w", err)
+	}
+	prop.FastRetrieval = req.FastRetrieval
+
+	proposal := prop.DealProposal.Proposal
+	if proposal.PieceSize > ask.Ask.Ask.MaxPieceSize {
+		return nil, fmt.Errorf("piece of %d bytes is larger than the maximum of %d bytes %s accepts", proposal.PieceSize, ask.Ask.Ask.MaxPieceSize, req.Miner)
+	}
+
+	total := big.Mul(proposal.StoragePricePerEpoch, big.NewInt(int64(req.Duration)))
+	if !req.Verified {
+		if err := r.checkEscrow(ctx, total); err != nil {
+			return nil, err
+		}
+	}
+
+	propNd, err := cborutil.AsIpld(prop.DealProposal)
+	if err != nil {
+		return nil, err
+	}
+
+	deal := &Deal{
+		Cid:           req.Cid,
+		Miner:         req.Miner,
+		Client:        r.ClientAddr,
+		ProposalCid:   propNd.Cid(),
+		PieceCid:      proposal.PieceCID,
+		PieceSize:     proposal.PieceSize,
+		PayloadSize:   prop.Piece.RawBlockSize,
+		Verified:      req.Verified,
+		FastRetrieval: req.FastRetrieval,
+		StartEpoch:    proposal.StartEpoch,
+		EndEpoch:      proposal.EndEpoch,
+		PricePerEpoch: proposal.StoragePricePerEpoch,
+		TotalPrice:    total,
+		Status:        storagemarket.StorageDealUnknown,
+	}
+	if err := r.Deals.Add(ctx, deal); err != nil {
+		return nil, err
+	}
+
+	log.Infof("Proposing deal %d to %s for piece %s (%s)", deal.ID, req.Miner, deal.PieceCid, types.FIL(total))
+
+	if _, err := r.FilClient.SendProposalV110(ctx, *prop, deal.ProposalCid); err != nil {
+		return deal, r.failDeal(ctx, deal, xerrors.Errorf("proposing deal: %w", err))
+	}
+	accepted, err := r.Deals.Modify(ctx, deal.ID, func(deal *Deal) {
+		deal.Status = storagemarket.StorageDealProposalAccepted
+	})
+	if err != nil {
+		return deal, err
+	}
+	deal = accepted
+
+	chanid, err := r.FilClient.StartDataTransfer(ctx, req.Miner, deal.ProposalCid, req.Cid)
+	if err != nil {
+		return deal, r.failDeal(ctx, deal, xerrors.Errorf("starting the data transfer: %w", err))
+	}
+
+	return r.Deals.Modify(ctx, deal.ID, func(deal *Deal) {
+		deal.TransferID = chanid.String()
+		deal.Status = storagemarket.StorageDealTransferring
+	})
+}
+
+// WaitTransfer waits for the data of a deal to be pushed to the provider
+func (r *Retriever) WaitTransfer(ctx context.Context, deal *Deal) error {
+	if deal.TransferID == "" {
+		return fmt.Errorf("deal %d has no data transfer", deal.ID)
+	}
+
+	for {
+		st, err := r.FilClient.TransferStatusByID(ctx, deal.TransferID)
+		if err != nil {
+			return err
+		}
+
+		switch st.Status {
+		case datatransfer.Completed:
+			return nil
+		case datatransfer.Failed, datatransfer.Cancelled:
+			return r.failDeal(ctx, deal, fmt.Errorf("data transfer %s: %s", st.StatusStr, st.Message))
+		}
+
+		printProgress(st.Sent)
+
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Record that a deal failed with err, returning err
+func (r *Retriever) failDeal(ctx context.Context, deal *Deal, err error) error {
+	fail := func(deal *Deal) {
+		deal.Status = storagemarket.StorageDealError
+		deal.Message = err.Error()
+	}
+
+	fail(deal)
+	if _, err := r.Deals.Modify(ctx, deal.ID, fail); err != nil {
+		log.Errorf("Failed to record that deal %d failed: %v", deal.ID, err)
+	}
+
+	return err
+}
+
+// The data is pushed over graphsync, which only deal protocol v1.1.0 supports
+func (r *Retriever) checkDealProtocol(ctx context.Context, miner address.Address) error {
+	pid, err := r.FilClient.ConnectToMiner(ctx, miner)
+	if err != nil {
+		return xerrors.Errorf("connecting to %s: %w", miner, err)
+	}
+
+	protos, err := r.Node.Host.Peerstore().SupportsProtocols(pid, filclient.DealProtocolv110)
+	if err != nil {
+		return err
+	}
+	if len(protos) == 0 {
+		return fmt.Errorf("%s does not support deal protocol %s", miner, filclient.DealProtocolv110)
+	}
+
+	return nil
+}
+
+// Check that the client's market escrow can pay for a deal
+func (r *Retriever) checkEscrow(ctx context.Context, cost abi.TokenAmount) error {
+	bal, err := r.Chain.StateMarketBalance(ctx, r.ClientAddr, types.EmptyTSK)
+	if err != nil {
+		return xerrors.Errorf("getting the market balance of %s: %w", r.ClientAddr, err)
+	}
+
+	available := big.Sub(bal.Escrow, bal.Locked)
+	if available.LessThan(cost) {
+		return fmt.Errorf("the deal costs %s but only %s of the market escrow of %s is available", types.FIL(cost), types.FIL(available), r.ClientAddr)
+	}
+
+	return nil
+}
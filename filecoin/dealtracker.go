@@ -0,0 +1,143 @@
+package filecoin
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	"github.com/labstack/gommon/log"
+	"golang.org/x/xerrors"
+)
+
+// DealTracker follows the deals in a DealStore until they finish, asking
+// their providers for the state of deals that aren't on chain yet and the
+// chain for the ones that are
+type DealTracker struct {
+	retriever *Retriever
+
+	// How often unfinished deals are polled
+	Interval time.Duration
+}
+
+func NewDealTracker(r *Retriever) *DealTracker {
+	return &DealTracker{
+		retriever: r,
+		Interval:  5 * time.Minute,
+	}
+}
+
+// Run polls the unfinished deals every Interval until ctx is done, never if
+// Interval isn't positive
+func (dt *DealTracker) Run(ctx context.Context) {
+	if dt.Interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(dt.Interval)
+	defer ticker.Stop()
+
+	for {
+		dt.pollAll(ctx)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (dt *DealTracker) pollAll(ctx context.Context) {
+	deals, err := dt.retriever.Deals.List(ctx)
+	if err != nil {
+		log.Errorf("Failed to list deals: %v", err)
+		return
+	}
+
+	for _, deal := range deals {
+		if deal.Finished() {
+			continue
+		}
+
+		if err := dt.Poll(ctx, deal); err != nil {
+			log.Warnf("Failed to poll deal %d: %v", deal.ID, err)
+		}
+	}
+}
+
+// Poll updates the state of deal and stores it. Providers that can't be
+// reached leave the deal as it was.
+func (dt *DealTracker) Poll(ctx context.Context, deal *Deal) error {
+	r := dt.retriever
+	prev := deal.Status
+	prevMessage := deal.Message
+
+	if deal.Status != storagemarket.StorageDealActive {
+		state, err := r.FilClient.DealStatus(ctx, deal.Miner, deal.ProposalCid, nil)
+		if err != nil {
+			log.Debugf("Could not get the state of deal %d from %s: %v", deal.ID, deal.Miner, err)
+		} else {
+			deal.ProviderState = state
+			deal.Status = state.State
+			deal.Message = state.Message
+			if state.DealID != 0 {
+				deal.DealID = state.DealID
+			}
+			if state.PublishCid != nil {
+				deal.PublishCid = state.PublishCid
+			}
+		}
+	}
+
+	head, err := r.Chain.ChainHead(ctx)
+	if err != nil {
+		return xerrors.Errorf("getting chain head: %w", err)
+	}
+
+	switch {
+	case deal.Finished():
+	case deal.DealID != 0:
+		found, md, err := r.FilClient.CheckChainDeal(ctx, deal.DealID)
+		if err != nil {
+			return xerrors.Errorf("checking deal %d on chain: %w", deal.DealID, err)
+		}
+
+		// Expired deals may be gone from the chain
+		switch {
+		case found && md.State.SlashEpoch > -1:
+			deal.Status = storagemarket.StorageDealSlashed
+			deal.Message = fmt.Sprintf("slashed at epoch %d", md.State.SlashEpoch)
+		case head.Height() >= deal.EndEpoch:
+			deal.Status = storagemarket.StorageDealExpired
+			deal.Message = ""
+		case found && md.State.SectorStartEpoch > -1:
+			deal.Status = storagemarket.StorageDealActive
+			deal.Message = ""
+		}
+	case head.Height() >= deal.StartEpoch:
+		deal.Status = storagemarket.StorageDealError
+		deal.Message = fmt.Sprintf("not published before its start epoch %d", deal.StartEpoch)
+	}
+
+	if deal.Status != prev {
+		if deal.Finished() && deal.Status != storagemarket.StorageDealExpired {
+			log.Warnf("Deal %d with %s failed: %s (%s)", deal.ID, deal.Miner, storagemarket.DealStates[deal.Status], deal.Message)
+		} else {
+			log.Infof("Deal %d with %s is now %s", deal.ID, deal.Miner, storagemarket.DealStates[deal.Status])
+		}
+	}
+
+	// Only what was polled is stored, the deal may have changed meanwhile
+	_, err = r.Deals.Modify(ctx, deal.ID, func(d *Deal) {
+		d.ProviderState = deal.ProviderState
+		d.DealID = deal.DealID
+		d.PublishCid = deal.PublishCid
+		if deal.Status != prev || deal.Message != prevMessage {
+			d.Status = deal.Status
+			d.Message = deal.Message
+		}
+	})
+
+	return err
+}
@@ -0,0 +1,182 @@
+package filecoin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/application-research/filclient"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/ipfs/go-cid"
+)
+
+// FakeMiner scripts how a storage provider answers a FakeRetrievalClient
+type FakeMiner struct {
+	// Answer to queries, unless QueryErr is set. Queries fail if neither is.
+	Query      *retrievalmarket.QueryResponse
+	QueryErr   error
+	QueryDelay time.Duration
+
+	// Retrievals report Query.Size bytes of progress, then fail with
+	// RetrieveErr if it is set
+	RetrieveErr   error
+	RetrieveDelay time.Duration
+}
+
+// FakeQuery is a query response for size bytes at pricePerByte, with an
+// unseal price if the data is sealed
+func FakeQuery(size uint64, pricePerByte abi.TokenAmount, unsealPrice abi.TokenAmount) *retrievalmarket.QueryResponse {
+	return &retrievalmarket.QueryResponse{
+		Status:                     retrievalmarket.QueryResponseAvailable,
+		Size:                       size,
+		MinPricePerByte:            pricePerByte,
+		UnsealPrice:                unsealPrice,
+		MaxPaymentInterval:         1 << 20,
+		MaxPaymentIntervalIncrease: 1 << 20,
+	}
+}
+
+// FakeRetrievalClient is a RetrievalClient answering from scripted miners
+// and recording the calls made to it. Miners that weren't added fail queries.
+type FakeRetrievalClient struct {
+	lk         sync.Mutex
+	miners     map[address.Address]*FakeMiner
+	queried    []address.Address
+	retrievals []address.Address
+
+	// Queries running now, and the most that ran at the same time
+	querying    int
+	maxQuerying int
+}
+
+func NewFakeRetrievalClient() *FakeRetrievalClient {
+	return &FakeRetrievalClient{
+		miners: make(map[address.Address]*FakeMiner),
+	}
+}
+
+func (fc *FakeRetrievalClient) AddMiner(miner address.Address, fm *FakeMiner) {
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+
+	fc.miners[miner] = fm
+}
+
+// Queried lists the miners queried so far, in the order the queries started
+func (fc *FakeRetrievalClient) Queried() []address.Address {
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+
+	return append([]address.Address(nil), fc.queried...)
+}
+
+// MaxConcurrentQueries is the most queries that ran at the same time so far
+func (fc *FakeRetrievalClient) MaxConcurrentQueries() int {
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+
+	return fc.maxQuerying
+}
+
+// Retrieved lists the miners retrievals were attempted with so far, in order
+func (fc *FakeRetrievalClient) Retrieved() []address.Address {
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+
+	return append([]address.Address(nil), fc.retrievals...)
+}
+
+func (fc *FakeRetrievalClient) miner(miner address.Address, calls *[]address.Address) (*FakeMiner, error) {
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+
+	*calls = append(*calls, miner)
+
+	fm, ok := fc.miners[miner]
+	if !ok {
+		return nil, fmt.Errorf("failed to dial miner %s", miner)
+	}
+
+	return fm, nil
+}
+
+func (fc *FakeRetrievalClient) RetrievalQuery(ctx context.Context, miner address.Address, c cid.Cid) (*retrievalmarket.QueryResponse, error) {
+	fm, err := fc.miner(miner, &fc.queried)
+	if err != nil {
+		return nil, err
+	}
+
+	fc.lk.Lock()
+	fc.querying++
+	if fc.querying > fc.maxQuerying {
+		fc.maxQuerying = fc.querying
+	}
+	fc.lk.Unlock()
+
+	defer func() {
+		fc.lk.Lock()
+		fc.querying--
+		fc.lk.Unlock()
+	}()
+
+	if err := sleep(ctx, fm.QueryDelay); err != nil {
+		return nil, err
+	}
+
+	if fm.QueryErr != nil {
+		return nil, fm.QueryErr
+	}
+	if fm.Query == nil {
+		return nil, fmt.Errorf("miner %s has no answer to queries for %s", miner, c)
+	}
+
+	query := *fm.Query
+	return &query, nil
+}
+
+func (fc *FakeRetrievalClient) RetrieveContentWithProgressCallback(ctx context.Context, miner address.Address, proposal *retrievalmarket.DealProposal, progress func(bytesReceived uint64)) (*filclient.RetrievalStats, error) {
+	fm, err := fc.miner(miner, &fc.retrievals)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+
+	if err := sleep(ctx, fm.RetrieveDelay); err != nil {
+		return nil, err
+	}
+
+	var size uint64
+	if fm.Query != nil {
+		size = fm.Query.Size
+	}
+	progress(size)
+
+	if fm.RetrieveErr != nil {
+		return nil, fm.RetrieveErr
+	}
+
+	return &filclient.RetrievalStats{
+		Size:         size,
+		Duration:     time.Since(start),
+		TotalPayment: big.Add(big.Mul(proposal.PricePerByte, big.NewIntUnsigned(size)), proposal.UnsealPrice),
+		AskPrice:     proposal.PricePerByte,
+	}, nil
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d == 0 {
+		return nil
+	}
+
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
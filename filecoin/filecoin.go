@@ -17,6 +17,7 @@ import (
 	whypfs "github.com/application-research/whypfs-core"
 	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/lotus/chain/types"
 	"github.com/ipfs/go-cid"
 	"github.com/ipld/go-ipld-prime"
@@ -40,14 +41,36 @@ func (stats *FILRetrievalStats) GetAverageBytesPerSecond() uint64 {
 	return stats.AverageSpeed
 }
 
+// RetrievalClient queries storage providers and retrieves from them, as
+// *filclient.FilClient does
+type RetrievalClient interface {
+	RetrievalQuery(ctx context.Context, miner address.Address, c cid.Cid) (*retrievalmarket.QueryResponse, error)
+	RetrieveContentWithProgressCallback(ctx context.Context, miner address.Address, proposal *retrievalmarket.DealProposal, progress func(bytesReceived uint64)) (*filclient.RetrievalStats, error)
+}
+
 type FILRetrievalAttempt struct {
-	FilClient  *filclient.FilClient
+	Client     RetrievalClient
 	Cid        cid.Cid
 	Candidates []FILRetrievalCandidate
 	SelNode    ipld.Node
 
 	// Disable sorting of candidates based on preferability
 	NoSort bool
+
+	// Skip candidates asking for more than this, no limit if nil
+	MaxPrice abi.TokenAmount
+
+	// Candidates queried at the same time, all at once if 0
+	QueryConcurrency int
+
+	// How long a candidate may take to answer a query, no limit if 0
+	QueryTimeout time.Duration
+
+	// If set, candidates that were queried recently aren't asked again
+	QueryCache *QueryCache
+
+	// Called with the number of bytes received so far during the transfer
+	OnProgress func(bytesReceived uint64)
 }
 
 func (attempt *FILRetrievalAttempt) Retrieve(ctx context.Context, node *whypfs.Node) (RetrievalStats, error) {
@@ -62,73 +85,43 @@ func (attempt *FILRetrievalAttempt) Retrieve(ctx context.Context, node *whypfs.N
 
 	log.Info("Querying FIL retrieval candidates...")
 
-	type CandidateQuery struct {
-		Candidate FILRetrievalCandidate
-		Response  *retrievalmarket.QueryResponse
-	}
-	checked := 0
 	var queries []CandidateQuery
-	var queriesLk sync.Mutex
-
-	var wg sync.WaitGroup
-	wg.Add(len(attempt.Candidates))
-
-	for _, candidate := range attempt.Candidates {
-
-		// Copy into loop, cursed go
-		candidate := candidate
-
-		go func() {
-			defer wg.Done()
-
-			query, err := attempt.FilClient.RetrievalQuery(ctx, candidate.Miner, candidate.RootCid)
-			if err != nil {
-				log.Debugf("Retrieval query for miner %s failed: %v", candidate.Miner, err)
-				return
-			}
-
-			queriesLk.Lock()
-			queries = append(queries, CandidateQuery{Candidate: candidate, Response: query})
-			checked++
-			fmt.Fprintf(os.Stderr, "%v/%v\r", checked, len(attempt.Candidates))
-			queriesLk.Unlock()
-		}()
+	for _, query := range attempt.queryCandidates(ctx) {
+		if query.Response == nil {
+			log.Debugf("Retrieval query for miner %s failed: %s", query.Candidate.Miner, query.Error)
+			continue
+		}
+		queries = append(queries, query)
 	}
 
-	wg.Wait()
-
 	log.Infof("Got back %v retrieval query results of a total of %v candidates", len(queries), len(attempt.Candidates))
 
 	if len(queries) == 0 {
 		return nil, xerrors.Errorf("retrieval failed: queries failed for all miners")
 	}
 
+	if !attempt.MaxPrice.Nil() {
+		affordable := queries[:0]
+		for _, query := range queries {
+			if totalCost(query.Response).GreaterThan(attempt.MaxPrice) {
+				log.Infof("Skipping miner %s asking %s, more than the maximum price of %s", query.Candidate.Miner, types.FIL(totalCost(query.Response)), types.FIL(attempt.MaxPrice))
+				continue
+			}
+			affordable = append(affordable, query)
+		}
+		queries = affordable
+
+		if len(queries) == 0 {
+			return nil, xerrors.Errorf("retrieval failed: all miners ask for more than the maximum price of %s", types.FIL(attempt.MaxPrice))
+		}
+	}
+
 	// After we got the query results, sort them with respect to the candidate
 	// selection config as long as noSort isn't requested (TODO - more options)
 
 	if !attempt.NoSort {
 		sort.Slice(queries, func(i, j int) bool {
-			a := queries[i].Response
-			b := queries[i].Response
-
-			// Always prefer unsealed to sealed, no matter what
-			if a.UnsealPrice.IsZero() && !b.UnsealPrice.IsZero() {
-				return true
-			}
-
-			// Select lower price, or continue if equal
-			aTotalPrice := totalCost(a)
-			bTotalPrice := totalCost(b)
-			if !aTotalPrice.Equals(bTotalPrice) {
-				return aTotalPrice.LessThan(bTotalPrice)
-			}
-
-			// Select smaller size, or continue if equal
-			if a.Size != b.Size {
-				return a.Size < b.Size
-			}
-
-			return false
+			return preferQuery(queries[i].Response, queries[j].Response)
 		})
 	}
 
@@ -150,13 +143,16 @@ func (attempt *FILRetrievalAttempt) Retrieve(ctx context.Context, node *whypfs.N
 		}
 
 		var bytesReceived uint64
-		stats_, err := attempt.FilClient.RetrieveContentWithProgressCallback(
+		stats_, err := attempt.Client.RetrieveContentWithProgressCallback(
 			ctx,
 			query.Candidate.Miner,
 			proposal,
 			func(bytesReceived_ uint64) {
 				bytesReceived = bytesReceived_
 				printProgress(bytesReceived)
+				if attempt.OnProgress != nil {
+					attempt.OnProgress(bytesReceived)
+				}
 			},
 		)
 		if err != nil {
@@ -177,13 +173,125 @@ func (attempt *FILRetrievalAttempt) Retrieve(ctx context.Context, node *whypfs.N
 	return stats, nil
 }
 
+// CandidateQuery is the answer of a candidate to a retrieval query, Error
+// being set instead of Response if the query failed
+type CandidateQuery struct {
+	Candidate FILRetrievalCandidate          `json:"candidate"`
+	Response  *retrievalmarket.QueryResponse `json:"response,omitempty"`
+	Error     string                         `json:"error,omitempty"`
+}
+
+// Query all the candidates in parallel, at most QueryConcurrency at a time
+func (attempt *FILRetrievalAttempt) queryCandidates(ctx context.Context) []CandidateQuery {
+	checked := 0
+	queries := make([]CandidateQuery, len(attempt.Candidates))
+	var queriesLk sync.Mutex
+
+	concurrency := attempt.QueryConcurrency
+	if concurrency <= 0 {
+		concurrency = len(attempt.Candidates)
+	}
+	sem := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+	wg.Add(len(attempt.Candidates))
+
+	for i, candidate := range attempt.Candidates {
+
+		// Copy into loop, cursed go
+		i, candidate := i, candidate
+
+		go func() {
+			defer wg.Done()
+
+			queries[i].Candidate = candidate
+
+			query, err := attempt.query(ctx, candidate, sem)
+			if err != nil {
+				queries[i].Error = err.Error()
+			} else {
+				queries[i].Response = query
+			}
+
+			queriesLk.Lock()
+			checked++
+			fmt.Fprintf(os.Stderr, "%v/%v\r", checked, len(attempt.Candidates))
+			queriesLk.Unlock()
+		}()
+	}
+
+	wg.Wait()
+
+	return queries
+}
+
+// Whether response a is preferable to b
+func preferQuery(a, b *retrievalmarket.QueryResponse) bool {
+	// Always prefer unsealed to sealed, no matter what
+	if a.UnsealPrice.IsZero() != b.UnsealPrice.IsZero() {
+		return a.UnsealPrice.IsZero()
+	}
+
+	// Select lower price, or continue if equal
+	aTotalPrice := totalCost(a)
+	bTotalPrice := totalCost(b)
+	if !aTotalPrice.Equals(bTotalPrice) {
+		return aTotalPrice.LessThan(bTotalPrice)
+	}
+
+	// Select smaller size, or continue if equal
+	if a.Size != b.Size {
+		return a.Size < b.Size
+	}
+
+	return false
+}
+
+// Query a candidate, unless its answer is cached, once a slot in sem is free
+func (attempt *FILRetrievalAttempt) query(ctx context.Context, candidate FILRetrievalCandidate, sem chan struct{}) (*retrievalmarket.QueryResponse, error) {
+	if attempt.QueryCache != nil {
+		if query, ok := attempt.QueryCache.Get(ctx, candidate.Miner, candidate.RootCid); ok {
+			return query, nil
+		}
+	}
+
+	select {
+	case sem <- struct{}{}:
+		defer func() { <-sem }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if attempt.QueryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, attempt.QueryTimeout)
+		defer cancel()
+	}
+
+	query, err := attempt.Client.RetrievalQuery(ctx, candidate.Miner, candidate.RootCid)
+	if err != nil {
+		return nil, err
+	}
+
+	if attempt.QueryCache != nil {
+		if err := attempt.QueryCache.Put(ctx, candidate.Miner, candidate.RootCid, query); err != nil {
+			log.Warnf("Could not cache query of %s for %s: %v", candidate.Miner, candidate.RootCid, err)
+		}
+	}
+
+	return query, nil
+}
+
 type FILRetrievalCandidate struct {
 	Miner   address.Address
 	RootCid cid.Cid
 	DealID  uint
 }
 
-func GetRetrievalCandidates(endpoint string, c cid.Cid) ([]FILRetrievalCandidate, error) {
+// How long the retrieval candidates endpoint may take to answer
+var CandidatesTimeout = 30 * time.Second
+
+func GetRetrievalCandidates(ctx context.Context, endpoint string, c cid.Cid) ([]FILRetrievalCandidate, error) {
 
 	endpointURL, err := url.Parse(endpoint)
 	if err != nil {
@@ -191,7 +299,15 @@ func GetRetrievalCandidates(endpoint string, c cid.Cid) ([]FILRetrievalCandidate
 	}
 	endpointURL.Path = path.Join(endpointURL.Path, c.String())
 
-	resp, err := http.Get(endpointURL.String())
+	ctx, cancel := context.WithTimeout(ctx, CandidatesTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpointURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,420 @@
+package filecoin
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipfs/go-merkledag"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+)
+
+func TestFILRetrievalAttempt(t *testing.T) {
+	errRetrieve := errors.New("transfer failed")
+
+	failing := func(fm *FakeMiner) *FakeMiner {
+		fm.RetrieveErr = errRetrieve
+		return fm
+	}
+	answering := func(size uint64, pricePerByte, unsealPrice int64) *FakeMiner {
+		return &FakeMiner{Query: FakeQuery(size, big.NewInt(pricePerByte), big.NewInt(unsealPrice))}
+	}
+
+	tests := []struct {
+		name   string
+		miners []*FakeMiner
+
+		maxPrice         abi.TokenAmount
+		queryConcurrency int
+		queryTimeout     time.Duration
+
+		// Miners retrievals are attempted with, in order
+		retrieved []int
+		// Whether the last of them succeeds
+		succeeds bool
+		// Most queries that may run at the same time, not checked if 0
+		maxConcurrent int
+	}{
+		{
+			name: "unsealed first, then cheaper, then smaller",
+			miners: []*FakeMiner{
+				failing(answering(10, 0, 1)),
+				failing(answering(100, 2, 0)),
+				failing(answering(100, 1, 0)),
+				failing(answering(50, 2, 0)),
+			},
+			retrieved: []int{3, 2, 1, 0},
+		},
+		{
+			name: "over max price skipped",
+			miners: []*FakeMiner{
+				failing(answering(100, 2, 0)),
+				failing(answering(50, 1, 0)),
+				failing(answering(100, 1, 0)),
+			},
+			maxPrice:  big.NewInt(100),
+			retrieved: []int{1, 2},
+		},
+		{
+			name: "all over max price",
+			miners: []*FakeMiner{
+				answering(100, 2, 0),
+				answering(100, 3, 0),
+			},
+			maxPrice: big.NewInt(100),
+		},
+		{
+			name: "failed queries skipped",
+			miners: []*FakeMiner{
+				{QueryErr: errors.New("unreachable")},
+				{},
+				nil,
+				answering(100, 1, 0),
+			},
+			retrieved: []int{3},
+			succeeds:  true,
+		},
+		{
+			name: "timed out queries skipped",
+			miners: []*FakeMiner{
+				{Query: FakeQuery(100, big.Zero(), big.Zero()), QueryDelay: time.Minute},
+				answering(100, 1, 0),
+			},
+			queryTimeout: 50 * time.Millisecond,
+			retrieved:    []int{1},
+			succeeds:     true,
+		},
+		{
+			name: "all queries failed",
+			miners: []*FakeMiner{
+				{QueryErr: errors.New("unreachable")},
+				nil,
+			},
+		},
+		{
+			name: "next miner after a failed retrieval",
+			miners: []*FakeMiner{
+				failing(answering(100, 1, 0)),
+				answering(100, 2, 0),
+				answering(100, 3, 0),
+			},
+			retrieved: []int{0, 1},
+			succeeds:  true,
+		},
+		{
+			name: "query concurrency bounded",
+			miners: []*FakeMiner{
+				{Query: FakeQuery(100, big.NewInt(1), big.Zero()), QueryDelay: 20 * time.Millisecond},
+				{Query: FakeQuery(100, big.NewInt(2), big.Zero()), QueryDelay: 20 * time.Millisecond},
+				{Query: FakeQuery(100, big.NewInt(3), big.Zero()), QueryDelay: 20 * time.Millisecond},
+				{Query: FakeQuery(100, big.NewInt(4), big.Zero()), QueryDelay: 20 * time.Millisecond},
+				{Query: FakeQuery(100, big.NewInt(5), big.Zero()), QueryDelay: 20 * time.Millisecond},
+			},
+			queryConcurrency: 2,
+			retrieved:        []int{0},
+			succeeds:         true,
+			maxConcurrent:    2,
+		},
+	}
+
+	root := blocks.NewBlock([]byte("root")).Cid()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := NewFakeRetrievalClient()
+
+			var miners []address.Address
+			var candidates []FILRetrievalCandidate
+			for i, fm := range tt.miners {
+				miner, err := address.NewIDAddress(uint64(1000 + i))
+				if err != nil {
+					t.Fatal(err)
+				}
+				miners = append(miners, miner)
+
+				// Leaving a miner out makes its queries fail to dial
+				if fm != nil {
+					client.AddMiner(miner, fm)
+				}
+				candidates = append(candidates, FILRetrievalCandidate{Miner: miner, RootCid: root})
+			}
+
+			attempt := &FILRetrievalAttempt{
+				Client:           client,
+				Cid:              root,
+				Candidates:       candidates,
+				MaxPrice:         tt.maxPrice,
+				QueryConcurrency: tt.queryConcurrency,
+				QueryTimeout:     tt.queryTimeout,
+			}
+
+			stats, err := attempt.Retrieve(context.Background(), nil)
+			if tt.succeeds {
+				if err != nil {
+					t.Fatalf("retrieval failed: %v", err)
+				}
+
+				want := tt.miners[tt.retrieved[len(tt.retrieved)-1]].Query.Size
+				if stats.GetByteSize() != want {
+					t.Errorf("retrieved %d bytes, want %d", stats.GetByteSize(), want)
+				}
+			} else if err == nil {
+				t.Fatal("retrieval succeeded, want it to fail")
+			}
+
+			var want []address.Address
+			for _, i := range tt.retrieved {
+				want = append(want, miners[i])
+			}
+			if got := client.Retrieved(); !reflect.DeepEqual(got, want) {
+				t.Errorf("retrieved from %v, want %v", got, want)
+			}
+
+			if got := len(client.Queried()); got != len(miners) {
+				t.Errorf("queried %d miners, want %d", got, len(miners))
+			}
+
+			if tt.maxConcurrent > 0 {
+				if got := client.MaxConcurrentQueries(); got > tt.maxConcurrent {
+					t.Errorf("%d queries ran at the same time, want at most %d", got, tt.maxConcurrent)
+				}
+			}
+		})
+	}
+}
+
+func TestQueryCache(t *testing.T) {
+	ctx := context.Background()
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	qc := NewQueryCache(ds, 100*time.Millisecond)
+
+	miner, err := address.NewIDAddress(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := blocks.NewBlock([]byte("root")).Cid()
+	other := blocks.NewBlock([]byte("other")).Cid()
+
+	if _, ok := qc.Get(ctx, miner, root); ok {
+		t.Fatal("got a query that was never put")
+	}
+
+	put := FakeQuery(100, big.NewInt(2), big.NewInt(3))
+	if err := qc.Put(ctx, miner, root, put); err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok := qc.Get(ctx, miner, root)
+	if !ok {
+		t.Fatal("didn't get the query just put")
+	}
+	if got.Size != put.Size || !got.MinPricePerByte.Equals(put.MinPricePerByte) || !got.UnsealPrice.Equals(put.UnsealPrice) {
+		t.Errorf("got %+v, want %+v", got, put)
+	}
+	if _, ok := qc.Get(ctx, miner, other); ok {
+		t.Error("got a query for another root")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	if err := qc.Put(ctx, miner, other, put); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := qc.Get(ctx, miner, root); ok {
+		t.Error("got a query older than the TTL")
+	}
+	if has, err := ds.Has(ctx, queryKey(miner, root)); err != nil || has {
+		t.Errorf("expired query is still in the datastore (err %v)", err)
+	}
+
+	// Expired without being read
+	if err := qc.Put(ctx, miner, root, put); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if err := qc.Put(ctx, miner, other, put); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := qc.Prune(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("pruned %d queries, want 1", n)
+	}
+	if _, ok := qc.Get(ctx, miner, other); !ok {
+		t.Error("pruned a query younger than the TTL")
+	}
+}
+
+func TestFILRetrievalAttemptQueryCache(t *testing.T) {
+	ctx := context.Background()
+	qc := NewQueryCache(dssync.MutexWrap(datastore.NewMapDatastore()), time.Hour)
+	root := blocks.NewBlock([]byte("root")).Cid()
+
+	answering, err := address.NewIDAddress(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failing, err := address.NewIDAddress(1001)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewFakeRetrievalClient()
+	client.AddMiner(answering, &FakeMiner{Query: FakeQuery(100, big.NewInt(1), big.Zero())})
+	client.AddMiner(failing, &FakeMiner{QueryErr: errors.New("query refused")})
+
+	attempt := &FILRetrievalAttempt{
+		Client: client,
+		Cid:    root,
+		Candidates: []FILRetrievalCandidate{
+			{Miner: answering, RootCid: root},
+			{Miner: failing, RootCid: root},
+		},
+		MaxPrice:   big.NewInt(1000),
+		QueryCache: qc,
+	}
+
+	if _, err := attempt.Retrieve(ctx, nil); err != nil {
+		t.Fatalf("retrieval failed: %v", err)
+	}
+
+	if _, ok := qc.Get(ctx, answering, root); !ok {
+		t.Error("successful query wasn't cached")
+	}
+	if _, ok := qc.Get(ctx, failing, root); ok {
+		t.Error("failed query was cached")
+	}
+
+	// Only the miner that failed is asked again
+	if _, err := attempt.Retrieve(ctx, nil); err != nil {
+		t.Fatalf("retrieval failed: %v", err)
+	}
+
+	want := []address.Address{answering, failing, failing}
+	got := client.Queried()
+	if len(got) != len(want) {
+		t.Fatalf("queried %v, want %v in any order", got, want)
+	}
+	count := map[address.Address]int{}
+	for _, miner := range got {
+		count[miner]++
+	}
+	if count[answering] != 1 || count[failing] != 2 {
+		t.Errorf("queried %v, want the answering miner once and the failing one twice", got)
+	}
+}
+
+func TestCacheEvictsUnpinnedRoots(t *testing.T) {
+	ctx := context.Background()
+
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	bs := blockstore.NewBlockstore(ds)
+	pins := NewPinset(ds)
+	cache := NewCache(ds, bs, pins, CacheLRU, 0)
+
+	// Retrieved with --pin: pinned before being touched
+	nd := merkledag.NewRawNode([]byte("retrieved and pinned"))
+	if err := bs.Put(ctx, nd); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pins.Add(ctx, nd.Cid(), "", PinRecursive); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Touch(ctx, nd.Cid()); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := cache.GC(ctx, 0, CacheLRU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Evicted) != 0 {
+		t.Fatalf("evicted pinned roots %v", res.Evicted)
+	}
+
+	if err := pins.Remove(ctx, nd.Cid()); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = cache.GC(ctx, 0, CacheLRU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Evicted) != 1 || res.Evicted[0] != nd.Cid() {
+		t.Fatalf("evicted %v after unpinning, want %s", res.Evicted, nd.Cid())
+	}
+	if has, err := bs.Has(ctx, nd.Cid()); err != nil || has {
+		t.Errorf("blockstore still has the evicted root (err %v)", err)
+	}
+}
+
+func newTestHost(t *testing.T) host.Host {
+	t.Helper()
+
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+
+	return h
+}
+
+func TestConnectProvider(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	providers := func(infos ...peer.AddrInfo) <-chan peer.AddrInfo {
+		ch := make(chan peer.AddrInfo, len(infos))
+		for _, info := range infos {
+			ch <- info
+		}
+		close(ch)
+		return ch
+	}
+
+	h := newTestHost(t)
+	live := newTestHost(t)
+	stale := newTestHost(t)
+	staleInfo := peer.AddrInfo{ID: stale.ID(), Addrs: stale.Addrs()}
+	if err := stale.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Dialable from the peerstore, but listed without addresses
+	h.Peerstore().AddAddrs(live.ID(), live.Addrs(), peerstore.PermanentAddrTTL)
+	if connectProvider(ctx, h, providers(peer.AddrInfo{ID: live.ID()})) {
+		t.Error("connected to a provider listed without addresses")
+	}
+	if h.Network().Connectedness(live.ID()) == network.Connected {
+		t.Error("dialed a provider listed without addresses")
+	}
+
+	if connectProvider(ctx, h, providers(staleInfo)) {
+		t.Error("connected to a stopped provider")
+	}
+
+	if !connectProvider(ctx, h, providers(staleInfo, peer.AddrInfo{ID: live.ID(), Addrs: live.Addrs()})) {
+		t.Fatal("didn't get past a stopped provider")
+	}
+	if h.Network().Connectedness(live.ID()) != network.Connected {
+		t.Error("reported a provider ready without connecting to it")
+	}
+}
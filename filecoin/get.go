@@ -2,24 +2,35 @@ package filecoin
 
 import (
 	"context"
-	"flag"
 	"fmt"
 	"path/filepath"
+	"time"
 
 	"github.com/mitchellh/go-homedir"
 
-	"github.com/anacrolix/log"
 	"github.com/application-research/filclient"
-	"github.com/application-research/filclient/keystore"
+	"github.com/application-research/filclient/retrievehelper"
 	whypfs "github.com/application-research/whypfs-core"
 	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/ipfs/go-blockservice"
 	"github.com/ipfs/go-cid"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	files "github.com/ipfs/go-ipfs-files"
+	"github.com/ipfs/go-merkledag"
+	unixfile "github.com/ipfs/go-unixfs/file"
 	"github.com/ipld/go-ipld-prime"
-	"github.com/urfave/cli/v2"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	textselector "github.com/ipld/go-ipld-selector-text-lite"
+	"github.com/labstack/gommon/log"
+	"golang.org/x/xerrors"
 
 	"github.com/filecoin-project/lotus/chain/types"
 	"github.com/filecoin-project/lotus/chain/wallet"
-	lcli "github.com/filecoin-project/lotus/cli"
 )
 
 const (
@@ -45,26 +56,181 @@ type Node struct {
 
 var ApiURL string = "wss://api.chain.love"
 
-func Get(nd *whypfs.Node, cidStr, network, dmSelText string, minerStrings []string) error {
+// Directory the wallet and filclient state are kept in
+var DataDir = "~/.whypfs"
+
+// GetRequest describes a single retrieval: the root to fetch, where to fetch
+// it from and, optionally, where to write the result.
+type GetRequest struct {
+	Cid     cid.Cid `json:"cid"`
+	Network string  `json:"network,omitempty"`
+
+	// Optional datamodel path selector to retrieve a sub-DAG of Cid
+	Selector string `json:"selector,omitempty"`
+
+	// Miners to use as FIL candidates for Cid
+	Miners []address.Address `json:"miners,omitempty"`
 
-	homedir, err := ddir()
+	// If set, the retrieved content is written to this path as a UnixFS file
+	Output string `json:"output,omitempty"`
+
+	// Whether to pin the retrieved root recursively
+	Pin bool `json:"pin,omitempty"`
+
+	// Called with the number of bytes received so far once a transfer starts
+	OnProgress func(bytesReceived uint64) `json:"-"`
+}
+
+// Retriever holds the wallet and filclient that retrievals made through a
+// node share, so they only have to be set up once for many retrievals.
+type Retriever struct {
+	Node      *whypfs.Node
+	FilClient *filclient.FilClient
+	Wallet    *wallet.LocalWallet
+	Pins      *Pinset
+	Paych     *PaychManager
+	Deals     *DealStore
+	Staging   *Staging
+	Chain     Chain
+
+	// Signs for ClientAddr. filclient opens payment channels, signs
+	// vouchers and proposes deals with Wallet only, so unless the signer is
+	// Wallet it is only used to settle and collect channels, see
+	// ErrSignerNotLocal.
+	Signer     Signer
+	ClientAddr address.Address
+
+	// Most a single Filecoin retrieval may cost, no limit if nil
+	MaxPrice abi.TokenAmount
+
+	// See FILRetrievalAttempt
+	QueryConcurrency int
+	QueryTimeout     time.Duration
+	QueryCache       *QueryCache
+
+	// If set, content retrieved from Filecoin is announced with it
+	Provider *Provider
+
+	// If set, retrieved roots are tracked in it
+	Cache *Cache
+
+	closer func()
+}
+
+func NewRetriever(nd *whypfs.Node) (*Retriever, error) {
+	ddir, err := ddir()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	wal, err := setup(homedir)
+	wal, err := setup(ddir)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	addr, err := wal.GetDefault()
+	if err != nil {
+		return nil, err
+	}
+
+	chain, closer, err := GatewayAPI()
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := newRetriever(nd, ddir, chain, wal, wal, addr)
+	if err != nil {
+		closer()
+		return nil, err
+	}
+	r.closer = chained(r.closer, closer)
+
+	return r, nil
+}
+
+// NewRetrieverWithSigner sets up a retriever paying from addr, which signer
+// holds the key of. Filecoin retrievals and deals fail with
+// ErrSignerNotLocal unless signer is a *wallet.LocalWallet.
+func NewRetrieverWithSigner(ctx context.Context, nd *whypfs.Node, signer Signer, addr address.Address) (*Retriever, error) {
+	chain, closer, err := GatewayAPI()
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := NewRetrieverWithChain(ctx, nd, chain, signer, addr)
+	if err != nil {
+		closer()
+		return nil, err
+	}
+	r.closer = chained(r.closer, closer)
+
+	return r, nil
+}
+
+// NewRetrieverWithChain is NewRetrieverWithSigner talking to chain instead
+// of the lotus gateway at ApiURL
+func NewRetrieverWithChain(ctx context.Context, nd *whypfs.Node, chain Chain, signer Signer, addr address.Address) (*Retriever, error) {
+	ddir, err := ddir()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := CheckSigner(ctx, signer, addr); err != nil {
+		return nil, err
+	}
+
+	wal, ok := signer.(*wallet.LocalWallet)
+	if !ok {
+		// filclient insists on a local wallet even for free retrievals, give
+		// it one without keys
+		wal, err = NewMemorySigner()
+		if err != nil {
+			return nil, err
+		}
 	}
-	fmt.Println(wal)
 
+	return newRetriever(nd, ddir, chain, wal, signer, addr)
+}
+
+func newRetriever(nd *whypfs.Node, ddir string, chain Chain, wal *wallet.LocalWallet, signer Signer, addr address.Address) (*Retriever, error) {
+	fc, err := clientFromNode(nd, chain, wal, addr, ddir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Retriever{
+		Node:       nd,
+		FilClient:  fc,
+		Wallet:     wal,
+		Pins:       NewPinset(nd.Datastore),
+		Paych:      NewPaychManager(chain, signer, nd.Datastore),
+		Deals:      NewDealStore(nd.Datastore),
+		Staging:    NewStaging(nd.Datastore),
+		Chain:      chain,
+		Signer:     signer,
+		ClientAddr: addr,
+		closer:     func() {},
+	}, nil
+}
+
+// Call first, then then
+func chained(first, then func()) func() {
+	return func() {
+		first()
+		then()
+	}
+}
+
+func (r *Retriever) Close() {
+	r.closer()
+}
+
+func Get(nd *whypfs.Node, cidStr, network, dmSelText string, minerStrings []string) error {
 	// Parse command input
 	if cidStr == "" {
 		return fmt.Errorf("please specify a CID to retrieve")
 	}
 
-	// dmSelText := textselector.Expression(cctx.String(flagDmPathSel.Name))
-
 	miners, err := parseMiners(minerStrings)
 	if err != nil {
 		return err
@@ -75,220 +241,281 @@ func Get(nd *whypfs.Node, cidStr, network, dmSelText string, minerStrings []stri
 		return err
 	}
 
-	// Get subselector node
-	var selNode ipld.Node
-	/*
-		var selNode ipld.Node
-		if dmSelText != "" {
-			ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
-
-			selspec, err := textselector.SelectorSpecFromPath(
-				dmSelText,
-				true,
-
-				// URGH - this is a direct copy from https://github.com/filecoin-project/go-fil-markets/blob/v1.12.0/shared/selectors.go#L10-L16
-				// Unable to use it because we need the SelectorSpec, and markets exposes just a reified node
-				ssb.ExploreRecursive(
-					selector.RecursionLimitNone(),
-					ssb.ExploreAll(ssb.ExploreRecursiveEdge()),
-				),
-			)
-			if err != nil {
-				return xerrors.Errorf("failed to parse text-selector '%s': %w", dmSelText, err)
-			}
-
-			selNode = selspec.Node()
-		}
-	*/
-
 	// Set up node and filclient
 
-	ddir, err := ddir()
+	r, err := NewRetriever(nd)
 	if err != nil {
 		return err
 	}
+	defer r.Close()
 
-	/*
-		wallet, err := setup(ddir)
-		if err != nil {
-			return err
-		}
-	*/
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	fc, closer, err := clientFromNode(nd, wal, ddir)
+	stats, err := r.Retrieve(ctx, GetRequest{
+		Cid:      c,
+		Network:  network,
+		Selector: dmSelText,
+		Miners:   miners,
+	})
 	if err != nil {
 		return err
 	}
-	defer closer()
+
+	printRetrievalStats(stats)
+
+	return nil
+}
+
+// Retrieve fetches the content described by req into the node's blockstore,
+// writing it out to req.Output if one is set.
+func (r *Retriever) Retrieve(ctx context.Context, req GetRequest) (RetrievalStats, error) {
+	// Get subselector node
+	selNode, err := parseSelector(req.Selector)
+	if err != nil {
+		return nil, err
+	}
 
 	// Collect retrieval candidates and config. If one or more miners are
 	// provided, use those with the requested cid as the root cid as the
 	// candidate list. Otherwise, we can use the auto retrieve API endpoint
 	// to automatically find some candidates to retrieve from.
 
-	var candidates []FILRetrievalCandidate
-	if len(miners) > 0 {
-		for _, miner := range miners {
-			candidates = append(candidates, FILRetrievalCandidate{
-				Miner:   miner,
-				RootCid: c,
-			})
+	filRoot, filSelNode := req.Cid, selNode
+	miners := req.Miners
+
+	// Roots stored in an aggregate are retrieved from Filecoin through the
+	// aggregate root, from the miners of its deals unless miners are given
+	entry, err := r.Staging.Lookup(ctx, req.Cid)
+	switch err {
+	case nil:
+		path := entry.Path
+		if req.Selector != "" {
+			path += "/" + req.Selector
 		}
-	}
-	/*
-		else {
-			endpoint := "https://api.estuary.tech/retrieval-candidates" // TODO: don't hard code
-			candidates_, err := node.GetRetrievalCandidates(endpoint, c)
+		filRoot = entry.Root
+		filSelNode, err = parseSelector(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(miners) == 0 {
+			miners, err = r.aggregateMiners(ctx, entry.Root)
 			if err != nil {
-				return fmt.Errorf("failed to get retrieval candidates: %w", err)
+				return nil, err
 			}
-
-			candidates = candidates_
 		}
-	*/
+
+		log.Infof("%s is stored in aggregate %s at %s", req.Cid, entry.Root, entry.Path)
+	case ErrNotAggregated:
+	default:
+		return nil, err
+	}
+
+	var candidates []FILRetrievalCandidate
+	for _, miner := range miners {
+		candidates = append(candidates, FILRetrievalCandidate{
+			Miner:   miner,
+			RootCid: filRoot,
+		})
+	}
 
 	// Do the retrieval
 
+	network := req.Network
+	if network == "" {
+		network = NetworkAuto
+	}
+
 	var networks []GetAttempt
 
 	if network == NetworkIPFS || network == NetworkAuto {
-		/*
-			if selNode != nil && !selNode.IsNull() {
-				// Selector nodes are not compatible with IPFS
-				if network == NetworkIPFS {
-					log.Fatal("IPFS is not compatible with selector node")
-				} else {
-					log.Info("A selector node has been specified, skipping IPFS")
-				}
-			} else {
-				networks = append(networks, &IPFSRetrievalAttempt{
-					Cid: c,
-				})
+		if selNode != nil && !selNode.IsNull() {
+			// Selector nodes are not compatible with IPFS
+			if network == NetworkIPFS {
+				return nil, fmt.Errorf("IPFS is not compatible with selector node")
 			}
-		*/
-
-		networks = append(networks, &IPFSRetrievalAttempt{
-			Cid: c,
-		})
+			log.Info("A selector node has been specified, skipping IPFS")
+		} else {
+			networks = append(networks, &IPFSRetrievalAttempt{
+				Cid:        req.Cid,
+				OnProgress: req.OnProgress,
+			})
+		}
 	}
 
 	if network == NetworkFIL || network == NetworkAuto {
-		networks = append(networks, &FILRetrievalAttempt{
-			FilClient:  fc,
-			Cid:        c,
-			Candidates: candidates,
-			SelNode:    selNode,
-		})
+		if err := r.checkFIL(ctx); err != nil {
+			if network == NetworkFIL {
+				return nil, err
+			}
+			log.Warnf("Not retrieving %s from Filecoin: %v", req.Cid, err)
+		} else {
+			networks = append(networks, &FILRetrievalAttempt{
+				Client:     r.FilClient,
+				Cid:        filRoot,
+				Candidates: candidates,
+				SelNode:    filSelNode,
+				MaxPrice:   r.MaxPrice,
+				OnProgress: req.OnProgress,
+
+				QueryConcurrency: r.QueryConcurrency,
+				QueryTimeout:     r.QueryTimeout,
+				QueryCache:       r.QueryCache,
+			})
+		}
 	}
 
 	if len(networks) == 0 {
-		log.Fatalf("Unknown --network value \"%s\"", network)
+		return nil, fmt.Errorf("unknown network value \"%s\"", network)
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	stats, err := RetrieveFromBestCandidate(nd, ctx, networks)
+	stats, err := RetrieveFromBestCandidate(r.Node, ctx, networks)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	printRetrievalStats(stats)
+	if req.Pin {
+		if _, err := r.Pins.Add(ctx, req.Cid, "", PinRecursive); err != nil {
+			return nil, xerrors.Errorf("retrieved %s but failed to pin it: %w", req.Cid, err)
+		}
+	}
 
-	// Save the output
+	r.touchCache(ctx, req.Cid)
 
-	// jcl
-	//dservOffline := merkledag.NewDAGService(blockservice.New(node.Blockstore, offline.Exchange(node.Blockstore)))
+	// Only whole DAGs are announced, a selector retrieval may have fetched
+	// just part of it
+	if _, fromFIL := stats.(*FILRetrievalStats); fromFIL && selNode == nil {
+		r.provideRetrieved(ctx, req.Cid)
+	}
 
-	// if we used a selector - need to find the sub-root the user actually wanted to retrieve
-	/*
-		if dmSelText != "" {
-			var subRootFound bool
-
-			// no err check - we just compiled this before starting, but now we do not wrap a `*`
-			selspec, _ := textselector.SelectorSpecFromPath(dmSelText, true, nil) //nolint:errcheck
-			if err := retrievehelper.TraverseDag(
-				cctx.Context,
-				dservOffline,
-				c,
-				selspec.Node(),
-				func(p traversal.Progress, n ipld.Node, r traversal.VisitReason) error {
-					if r == traversal.VisitReason_SelectionMatch {
-
-						if p.LastBlock.Path.String() != p.Path.String() {
-							return xerrors.Errorf("unsupported selection path '%s' does not correspond to a node boundary (a.k.a. CID link)", p.Path.String())
-						}
-
-						cidLnk, castOK := p.LastBlock.Link.(cidlink.Link)
-						if !castOK {
-							return xerrors.Errorf("cidlink cast unexpectedly failed on '%s'", p.LastBlock.Link.String())
-						}
-
-						c = cidLnk.Cid
-						subRootFound = true
-					}
-					return nil
-				},
-			); err != nil {
-				return xerrors.Errorf("error while locating partial retrieval sub-root: %w", err)
-			}
+	// Save the output
 
-			if !subRootFound {
-				return xerrors.Errorf("path selection '%s' does not match a node within %s", dmSelText, c)
-			}
+	if req.Output != "" {
+		if err := saveOutput(ctx, r.Node, req.Cid, req.Selector, req.Output); err != nil {
+			return nil, err
 		}
-	*/
+	}
 
-	// jcl
-	/*
-		dnode, err := dservOffline.Get(ctx, c)
-		if err != nil {
-			return err
-		}
-	*/
+	return stats, nil
+}
 
-	/*
-		if cctx.Bool(flagCar.Name) {
-			// Write file as car file
-			file, err := os.Create(output + ".car")
-			if err != nil {
-				return err
-			}
-			car.WriteCar(cctx.Context, dservOffline, []cid.Cid{c}, file)
+// Check that Filecoin retrievals can be paid for
+func (r *Retriever) checkFIL(ctx context.Context) error {
+	if r.Signer != Signer(r.Wallet) {
+		return xerrors.Errorf("retrieval vouchers are signed by filclient: %w", ErrSignerNotLocal)
+	}
 
-			fmt.Println("Saved .car output to", output+".car")
-		} else {
-			// Otherwise write file as UnixFS File
-			ufsFile, err := unixfile.NewUnixfsFile(cctx.Context, dservOffline, dnode)
-			if err != nil {
-				return err
-			}
+	return CheckSigner(ctx, r.Signer, r.ClientAddr)
+}
 
-			if err := files.WriteTo(ufsFile, output); err != nil {
-				return err
-			}
+// Announce a root retrieved from Filecoin to the DHT. Failing to do so doesn't
+// fail the retrieval.
+func (r *Retriever) provideRetrieved(ctx context.Context, root cid.Cid) {
+	if r.Provider == nil {
+		return
+	}
 
-			fmt.Println("Saved output to", output)
+	if err := r.Provider.Provide(ctx, root); err != nil {
+		log.Errorf("Failed to provide %s: %v", root, err)
+	}
+}
+
+// Record an access to a retrieved root in the cache
+func (r *Retriever) touchCache(ctx context.Context, root cid.Cid) {
+	if r.Cache == nil {
+		return
+	}
+
+	if err := r.Cache.Touch(ctx, root); err != nil {
+		log.Errorf("Failed to track %s in the cache: %v", root, err)
+	}
+}
+
+// Compile a datamodel path selector, returning a nil node if dmSelText is
+// empty.
+func parseSelector(dmSelText string) (ipld.Node, error) {
+	if dmSelText == "" {
+		return nil, nil
+	}
+
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+
+	selspec, err := textselector.SelectorSpecFromPath(
+		textselector.Expression(dmSelText),
+		true,
+
+		// URGH - this is a direct copy from https://github.com/filecoin-project/go-fil-markets/blob/v1.12.0/shared/selectors.go#L10-L16
+		// Unable to use it because we need the SelectorSpec, and markets exposes just a reified node
+		ssb.ExploreRecursive(
+			selector.RecursionLimitNone(),
+			ssb.ExploreAll(ssb.ExploreRecursiveEdge()),
+		),
+	)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to parse text-selector '%s': %w", dmSelText, err)
+	}
+
+	return selspec.Node(), nil
+}
+
+// Write the retrieved DAG rooted at c (or at the sub-root matched by
+// dmSelText) to output as a UnixFS file.
+func saveOutput(ctx context.Context, nd *whypfs.Node, c cid.Cid, dmSelText string, output string) error {
+	dservOffline := merkledag.NewDAGService(blockservice.New(nd.Blockstore, offline.Exchange(nd.Blockstore)))
+
+	// if we used a selector - need to find the sub-root the user actually wanted to retrieve
+	if dmSelText != "" {
+		var subRootFound bool
+
+		// no err check - we just compiled this before starting, but now we do not wrap a `*`
+		selspec, _ := textselector.SelectorSpecFromPath(textselector.Expression(dmSelText), true, nil) //nolint:errcheck
+		if err := retrievehelper.TraverseDag(
+			ctx,
+			dservOffline,
+			c,
+			selspec.Node(),
+			func(p traversal.Progress, n ipld.Node, r traversal.VisitReason) error {
+				if r == traversal.VisitReason_SelectionMatch {
+
+					if p.LastBlock.Path.String() != p.Path.String() {
+						return xerrors.Errorf("unsupported selection path '%s' does not correspond to a node boundary (a.k.a. CID link)", p.Path.String())
+					}
+
+					cidLnk, castOK := p.LastBlock.Link.(cidlink.Link)
+					if !castOK {
+						return xerrors.Errorf("cidlink cast unexpectedly failed on '%s'", p.LastBlock.Link.String())
+					}
+
+					c = cidLnk.Cid
+					subRootFound = true
+				}
+				return nil
+			},
+		); err != nil {
+			return xerrors.Errorf("error while locating partial retrieval sub-root: %w", err)
 		}
-	*/
 
-	// jcl
-	// Otherwise write file as UnixFS File
-	/*
-		ufsFile, err := unixfile.NewUnixfsFile(ctx, dservOffline, dnode)
-		if err != nil {
-			return err
+		if !subRootFound {
+			return xerrors.Errorf("path selection '%s' does not match a node within %s", dmSelText, c)
 		}
+	}
 
-		//jcl
-		output := cidStr
+	dnode, err := dservOffline.Get(ctx, c)
+	if err != nil {
+		return err
+	}
 
-		if err := files.WriteTo(ufsFile, output); err != nil {
-			return err
-		}
+	ufsFile, err := unixfile.NewUnixfsFile(ctx, dservOffline, dnode)
+	if err != nil {
+		return err
+	}
+
+	if err := files.WriteTo(ufsFile, output); err != nil {
+		return err
+	}
 
-		fmt.Println("Saved output to", output)
-	*/
+	fmt.Println("Saved output to", output)
 
 	return nil
 }
@@ -298,7 +525,7 @@ func walletPath(baseDir string) string {
 }
 
 func setup(cfgdir string) (*wallet.LocalWallet, error) {
-	return setupWallet(walletPath(cfgdir))
+	return setupWallet(cfgdir)
 }
 
 // Read a comma-separated or multi flag list of miners from the CLI.
@@ -317,38 +544,12 @@ func parseMiners(minerStrings []string) ([]address.Address, error) {
 	return miners, nil
 }
 
-func clientFromNode(nd *whypfs.Node, wal *wallet.LocalWallet, dir string) (*filclient.FilClient, func(), error) {
-	// send a CLI context to lotus that contains only the node "api-url" flag set, so that other flags don't accidentally conflict with lotus cli flags
-	// https://github.com/filecoin-project/lotus/blob/731da455d46cb88ee5de9a70920a2d29dec9365c/cli/util/api.go#L37
-	flset := flag.NewFlagSet("lotus", flag.ExitOnError)
-	flset.String("api-url", "", "node api url")
-	err := flset.Set("api-url", ApiURL)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	ncctx := cli.NewContext(cli.NewApp(), flset, nil)
-	api, closer, err := lcli.GetGatewayAPI(ncctx)
-	if err != nil {
-		return nil, nil, err
-	}
-	//defer closer()
-
-	addr, err := wal.GetDefault()
-	if err != nil {
-		return nil, nil, err
-	}
-
-	fc, err := filclient.NewClient(nd.Host, api, wal, addr, nd.Blockstore, nd.Datastore, dir)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	return fc, closer, nil
+func clientFromNode(nd *whypfs.Node, chain Chain, wal *wallet.LocalWallet, addr address.Address, dir string) (*filclient.FilClient, error) {
+	return filclient.NewClient(nd.Host, chain, wal, addr, nd.Blockstore, nd.Datastore, dir)
 }
 
-func setupWallet(dir string) (*wallet.LocalWallet, error) {
-	kstore, err := keystore.OpenOrInitKeystore(dir)
+func setupWallet(cfgdir string) (*wallet.LocalWallet, error) {
+	kstore, err := openKeystore(cfgdir)
 	if err != nil {
 		return nil, err
 	}
@@ -364,10 +565,11 @@ func setupWallet(dir string) (*wallet.LocalWallet, error) {
 	}
 
 	if len(addrs) == 0 {
-		_, err := wallet.WalletNew(context.TODO(), types.KTBLS)
+		addr, err := wallet.WalletNew(context.TODO(), types.KTBLS)
 		if err != nil {
 			return nil, err
 		}
+		log.Infof("Created wallet address %s, see 'wormhole wallet' to manage it", addr)
 	}
 
 	return wallet, nil
@@ -375,7 +577,7 @@ func setupWallet(dir string) (*wallet.LocalWallet, error) {
 
 func ddir() (string, error) {
 	// Store config dir in metadata
-	ddir, err := homedir.Expand("~/.whypfs")
+	ddir, err := homedir.Expand(DataDir)
 	if err != nil {
 		fmt.Println("could not set config dir: ", err)
 	}
@@ -12,8 +12,13 @@ import (
 	ipldformat "github.com/ipfs/go-ipld-format"
 	"github.com/ipfs/go-merkledag"
 	"github.com/labstack/gommon/log"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
 )
 
+// How long to wait for each IPFS provider to connect before trying the next
+const ipfsConnectTimeout = 15 * time.Second
+
 type IPFSRetrievalStats struct {
 	ByteSize uint64
 	Duration time.Duration
@@ -33,6 +38,9 @@ func (stats *IPFSRetrievalStats) GetAverageBytesPerSecond() uint64 {
 
 type IPFSRetrievalAttempt struct {
 	Cid cid.Cid
+
+	// Called with the number of bytes received so far during the transfer
+	OnProgress func(bytesReceived uint64)
 }
 
 func (attempt *IPFSRetrievalAttempt) Retrieve(ctx context.Context, node *whypfs.Node) (RetrievalStats, error) {
@@ -43,41 +51,11 @@ func (attempt *IPFSRetrievalAttempt) Retrieve(ctx context.Context, node *whypfs.
 
 	providers := node.Dht.FindProvidersAsync(ctx, attempt.Cid, 0)
 
-	// Ready will be true if we connected to at least one provider, false if no
-	// miners successfully connected
-	ready := make(chan bool, 1)
-	go func() {
-		for {
-			select {
-			case provider, ok := <-providers:
-				if !ok {
-					ready <- false
-					return
-				}
-
-				// If no addresses are listed for the provider, we should just
-				// skip it
-				if len(provider.Addrs) == 0 {
-					log.Debugf("Skipping IPFS provider with no addresses %s", provider.ID)
-					continue
-				}
-
-				log.Infof("Connected to IPFS provider %s", provider.ID)
-				ready <- true
-			case <-ctx.Done():
-				return
-			}
-		}
-	}()
-
-	select {
-	// TODO: also add connection timeout
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	case ready := <-ready:
-		if !ready {
-			return nil, fmt.Errorf("couldn't find CID")
+	if !connectProvider(ctx, node.Host, providers) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
 		}
+		return nil, fmt.Errorf("couldn't find CID")
 	}
 
 	// If we were able to connect to at least one of the providers, go ahead
@@ -108,6 +86,9 @@ func (attempt *IPFSRetrievalAttempt) Retrieve(ctx context.Context, node *whypfs.
 			}
 			bytesRetrieved += nodeSize
 			printProgress(bytesRetrieved)
+			if attempt.OnProgress != nil {
+				attempt.OnProgress(bytesRetrieved)
+			}
 			progressLk.Unlock()
 		}
 
@@ -127,3 +108,36 @@ func (attempt *IPFSRetrievalAttempt) Retrieve(ctx context.Context, node *whypfs.
 		Duration: time.Since(startTime),
 	}, nil
 }
+
+// Connect to the first reachable provider, skipping ones without addresses.
+// Returns false if none of them could be connected to
+func connectProvider(ctx context.Context, h host.Host, providers <-chan peer.AddrInfo) bool {
+	for {
+		select {
+		case provider, ok := <-providers:
+			if !ok {
+				return false
+			}
+
+			// If no addresses are listed for the provider, we should just
+			// skip it
+			if len(provider.Addrs) == 0 {
+				log.Debugf("Skipping IPFS provider with no addresses %s", provider.ID)
+				continue
+			}
+
+			connectCtx, cancel := context.WithTimeout(ctx, ipfsConnectTimeout)
+			err := h.Connect(connectCtx, provider)
+			cancel()
+			if err != nil {
+				log.Debugf("Couldn't connect to IPFS provider %s: %v", provider.ID, err)
+				continue
+			}
+
+			log.Infof("Connected to IPFS provider %s", provider.ID)
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
@@ -0,0 +1,397 @@
+package filecoin
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/labstack/gommon/log"
+	"golang.org/x/xerrors"
+)
+
+type JobState string
+
+const (
+	JobQueued       JobState = "queued"
+	JobQuerying     JobState = "querying"
+	JobTransferring JobState = "transferring"
+	JobDone         JobState = "done"
+	JobFailed       JobState = "failed"
+)
+
+var ErrJobNotFound = fmt.Errorf("job not found")
+
+var (
+	jobsPrefix = datastore.NewKey("/wormhole/jobs")
+	jobsNextID = datastore.NewKey("/wormhole/next-job-id")
+)
+
+// A Job is a retrieval request stored in the job queue
+type Job struct {
+	ID       uint64     `json:"id"`
+	Priority int        `json:"priority"`
+	Request  GetRequest `json:"request"`
+	State    JobState   `json:"state"`
+	Error    string     `json:"error,omitempty"`
+	Created  time.Time  `json:"created"`
+	Updated  time.Time  `json:"updated"`
+}
+
+// Whether the job is finished, successfully or not
+func (job *Job) Finished() bool {
+	return job.State == JobDone || job.State == JobFailed
+}
+
+// JobQueue is a persistent, prioritized queue of retrievals stored in the
+// node's datastore and processed by a pool of workers. Jobs that were in
+// flight when the queue was stopped are picked up again the next time it
+// starts.
+type JobQueue struct {
+	ds        datastore.Batching
+	retriever *Retriever
+	workers   int
+
+	lk        sync.Mutex
+	running   map[uint64]context.CancelFunc
+	cancelled map[uint64]bool
+
+	wake chan struct{}
+}
+
+func NewJobQueue(ds datastore.Batching, r *Retriever, workers int) *JobQueue {
+	if workers < 1 {
+		workers = 1
+	}
+
+	return &JobQueue{
+		ds:        ds,
+		retriever: r,
+		workers:   workers,
+		running:   make(map[uint64]context.CancelFunc),
+		cancelled: make(map[uint64]bool),
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// Start requeues any jobs that were in flight when the queue last stopped and
+// starts the workers. The workers stop when ctx is done.
+func (q *JobQueue) Start(ctx context.Context) error {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	jobs, err := q.list(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		if job.State == JobQuerying || job.State == JobTransferring {
+			log.Infof("Resuming interrupted job %d (%s)", job.ID, job.Request.Cid)
+			job.State = JobQueued
+			if err := q.put(ctx, job); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i := 0; i < q.workers; i++ {
+		go q.worker(ctx)
+	}
+
+	q.notify()
+
+	return nil
+}
+
+// Enqueue adds a retrieval to the queue. Jobs with a higher priority are
+// processed first, jobs with equal priority in the order they were added.
+func (q *JobQueue) Enqueue(ctx context.Context, req GetRequest, priority int) (*Job, error) {
+	if !req.Cid.Defined() {
+		return nil, fmt.Errorf("please specify a CID to retrieve")
+	}
+
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	id, err := q.nextID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	job := &Job{
+		ID:       id,
+		Priority: priority,
+		Request:  req,
+		State:    JobQueued,
+		Created:  now,
+		Updated:  now,
+	}
+	if err := q.put(ctx, job); err != nil {
+		return nil, err
+	}
+
+	q.notify()
+
+	return job, nil
+}
+
+// Cancel stops a queued or running job, marking it as failed. Finished jobs
+// can't be cancelled.
+func (q *JobQueue) Cancel(ctx context.Context, id uint64) error {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	job, err := q.get(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if job.Finished() {
+		return fmt.Errorf("job %d is already %s", id, job.State)
+	}
+
+	if cancel, ok := q.running[id]; ok {
+		// The worker marks the job as failed once the retrieval returns
+		q.cancelled[id] = true
+		cancel()
+		return nil
+	}
+
+	job.State = JobFailed
+	job.Error = "job cancelled"
+	return q.put(ctx, job)
+}
+
+func (q *JobQueue) Get(ctx context.Context, id uint64) (*Job, error) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	return q.get(ctx, id)
+}
+
+// List returns all jobs ordered by ID
+func (q *JobQueue) List(ctx context.Context) ([]*Job, error) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	return q.list(ctx)
+}
+
+func (q *JobQueue) worker(ctx context.Context) {
+	for {
+		job, jobCtx, err := q.claim(ctx)
+		if err != nil {
+			log.Errorf("Failed to claim next job: %v", err)
+		}
+
+		if job == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-q.wake:
+			case <-time.After(10 * time.Second):
+			}
+			continue
+		}
+
+		// Let another idle worker look for more work
+		q.notify()
+
+		q.process(ctx, jobCtx, job)
+	}
+}
+
+// Pick the next queued job and mark it as in flight. The returned context is
+// cancelled when the job is.
+func (q *JobQueue) claim(ctx context.Context) (*Job, context.Context, error) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	if ctx.Err() != nil {
+		return nil, nil, nil
+	}
+
+	jobs, err := q.list(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var queued []*Job
+	for _, job := range jobs {
+		if job.State == JobQueued {
+			queued = append(queued, job)
+		}
+	}
+
+	if len(queued) == 0 {
+		return nil, nil, nil
+	}
+
+	sort.SliceStable(queued, func(i, j int) bool {
+		return queued[i].Priority > queued[j].Priority
+	})
+
+	job := queued[0]
+	job.State = JobQuerying
+	job.Error = ""
+	if err := q.put(ctx, job); err != nil {
+		return nil, nil, err
+	}
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	q.running[job.ID] = cancel
+
+	return job, jobCtx, nil
+}
+
+func (q *JobQueue) process(ctx context.Context, jobCtx context.Context, job *Job) {
+	log.Infof("Starting job %d (%s)", job.ID, job.Request.Cid)
+
+	var transferOnce sync.Once
+	req := job.Request
+	req.OnProgress = func(uint64) {
+		transferOnce.Do(func() {
+			q.setState(ctx, job.ID, JobTransferring, "")
+		})
+	}
+
+	_, err := q.retriever.Retrieve(jobCtx, req)
+
+	q.lk.Lock()
+	cancelled := q.cancelled[job.ID]
+	q.running[job.ID]()
+	delete(q.running, job.ID)
+	delete(q.cancelled, job.ID)
+	q.lk.Unlock()
+
+	switch {
+	case cancelled:
+		log.Infof("Job %d was cancelled", job.ID)
+		q.setState(ctx, job.ID, JobFailed, "job cancelled")
+	case ctx.Err() != nil:
+		// The queue is shutting down - leave the job in flight so that it is
+		// resumed on the next start
+	case err != nil:
+		log.Errorf("Job %d failed: %v", job.ID, err)
+		q.setState(ctx, job.ID, JobFailed, err.Error())
+	default:
+		log.Infof("Job %d done", job.ID)
+		q.setState(ctx, job.ID, JobDone, "")
+	}
+}
+
+func (q *JobQueue) setState(ctx context.Context, id uint64, state JobState, errMsg string) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	job, err := q.get(ctx, id)
+	if err != nil {
+		log.Errorf("Failed to update state of job %d: %v", id, err)
+		return
+	}
+
+	job.State = state
+	job.Error = errMsg
+	if err := q.put(ctx, job); err != nil {
+		log.Errorf("Failed to update state of job %d: %v", id, err)
+	}
+}
+
+func (q *JobQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func jobKey(id uint64) datastore.Key {
+	return jobsPrefix.ChildString(strconv.FormatUint(id, 10))
+}
+
+func (q *JobQueue) nextID(ctx context.Context) (uint64, error) {
+	var id uint64 = 1
+
+	data, err := q.ds.Get(ctx, jobsNextID)
+	switch {
+	case err == nil:
+		id = binary.BigEndian.Uint64(data)
+	case err != datastore.ErrNotFound:
+		return 0, err
+	}
+
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, id+1)
+	if err := q.ds.Put(ctx, jobsNextID, buf); err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+func (q *JobQueue) get(ctx context.Context, id uint64) (*Job, error) {
+	data, err := q.ds.Get(ctx, jobKey(id))
+	if err != nil {
+		if err == datastore.ErrNotFound {
+			return nil, ErrJobNotFound
+		}
+		return nil, err
+	}
+
+	var job Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, xerrors.Errorf("could not decode job %d: %w", id, err)
+	}
+
+	return &job, nil
+}
+
+func (q *JobQueue) put(ctx context.Context, job *Job) error {
+	job.Updated = time.Now()
+
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	if err := q.ds.Put(ctx, jobKey(job.ID), data); err != nil {
+		return err
+	}
+
+	return q.ds.Sync(ctx, jobsPrefix)
+}
+
+func (q *JobQueue) list(ctx context.Context) ([]*Job, error) {
+	res, err := q.ds.Query(ctx, query.Query{Prefix: jobsPrefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	var jobs []*Job
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+
+		var job Job
+		if err := json.Unmarshal(r.Value, &job); err != nil {
+			return nil, xerrors.Errorf("could not decode job %s: %w", r.Key, err)
+		}
+
+		jobs = append(jobs, &job)
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].ID < jobs[j].ID
+	})
+
+	return jobs, nil
+}
@@ -0,0 +1,452 @@
+package filecoin
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/application-research/filclient/keystore"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/labstack/gommon/log"
+	"github.com/whyrusleeping/base32"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// Passphrase of the encrypted keystore
+	PassphraseEnv = "WORMHOLE_PASSPHRASE"
+
+	// File to read the passphrase of the encrypted keystore from
+	PassphraseFileEnv = "WORMHOLE_PASSPHRASE_FILE"
+)
+
+var (
+	ErrWrongPassphrase = errors.New("wrong keystore passphrase")
+	ErrEmptyPassphrase = errors.New("the keystore passphrase can't be empty")
+)
+
+// Holds the KDF parameters and a passphrase check, not a key
+const keystoreMetaFile = "keystore.json"
+
+// Sealed into the metadata to tell a wrong passphrase from corrupted keys
+var keystoreCheck = []byte("wormhole-keystore")
+
+type keystoreMeta struct {
+	KDF   string `json:"kdf"`
+	Salt  []byte `json:"salt"`
+	N     int    `json:"n"`
+	R     int    `json:"r"`
+	P     int    `json:"p"`
+	Check []byte `json:"check"`
+}
+
+// EncryptedKeyStore is a types.KeyStore that keeps each key in its own file
+// like the filclient disk keystore, sealed with AES-GCM under a key derived
+// from a passphrase with scrypt.
+type EncryptedKeyStore struct {
+	path string
+	aead cipher.AEAD
+}
+
+func encryptedWalletPath(baseDir string) string {
+	return filepath.Join(baseDir, "wallet-encrypted")
+}
+
+// InitEncryptedKeystore creates a new, empty encrypted keystore at p
+func InitEncryptedKeystore(p string, passphrase []byte) (*EncryptedKeyStore, error) {
+	if len(passphrase) == 0 {
+		return nil, ErrEmptyPassphrase
+	}
+
+	if _, err := os.Stat(p); err == nil {
+		return nil, fmt.Errorf("keystore %s already exists", p)
+	}
+
+	meta := &keystoreMeta{
+		KDF:  "scrypt",
+		Salt: make([]byte, 32),
+		N:    1 << 15,
+		R:    8,
+		P:    1,
+	}
+	if _, err := rand.Read(meta.Salt); err != nil {
+		return nil, err
+	}
+
+	aead, err := meta.cipher(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	meta.Check, err = seal(aead, keystoreCheck, []byte(keystoreMetaFile))
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Mkdir(p, 0700); err != nil {
+		return nil, err
+	}
+
+	if err := os.WriteFile(filepath.Join(p, keystoreMetaFile), data, 0600); err != nil {
+		return nil, err
+	}
+
+	return &EncryptedKeyStore{path: p, aead: aead}, nil
+}
+
+// OpenEncryptedKeystore unlocks the encrypted keystore at p
+func OpenEncryptedKeystore(p string, passphrase []byte) (*EncryptedKeyStore, error) {
+	data, err := os.ReadFile(filepath.Join(p, keystoreMetaFile))
+	if err != nil {
+		return nil, xerrors.Errorf("reading keystore metadata: %w", err)
+	}
+
+	var meta keystoreMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, xerrors.Errorf("decoding keystore metadata: %w", err)
+	}
+
+	aead, err := meta.cipher(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := open(aead, meta.Check, []byte(keystoreMetaFile)); err != nil {
+		return nil, ErrWrongPassphrase
+	}
+
+	return &EncryptedKeyStore{path: p, aead: aead}, nil
+}
+
+func (meta *keystoreMeta) cipher(passphrase []byte) (cipher.AEAD, error) {
+	if meta.KDF != "scrypt" {
+		return nil, fmt.Errorf("unsupported keystore KDF '%s'", meta.KDF)
+	}
+
+	key, err := scrypt.Key(passphrase, meta.Salt, meta.N, meta.R, meta.P, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Encrypt data, binding it to ad, and prefix it with the nonce
+func seal(aead cipher.AEAD, data []byte, ad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, data, ad), nil
+}
+
+func open(aead cipher.AEAD, sealed []byte, ad []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("sealed data too short")
+	}
+
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], ad)
+}
+
+func (ks *EncryptedKeyStore) List() ([]string, error) {
+	entries, err := os.ReadDir(ks.path)
+	if err != nil {
+		return nil, xerrors.Errorf("reading keystore dir: %w", err)
+	}
+
+	var keys []string
+	for _, entry := range entries {
+		if entry.Name() == keystoreMetaFile {
+			continue
+		}
+
+		name, err := base32.RawStdEncoding.DecodeString(entry.Name())
+		if err != nil {
+			return nil, xerrors.Errorf("decoding key: '%s': %w", entry.Name(), err)
+		}
+		keys = append(keys, string(name))
+	}
+
+	return keys, nil
+}
+
+func (ks *EncryptedKeyStore) Get(name string) (types.KeyInfo, error) {
+	sealed, err := os.ReadFile(ks.keyPath(name))
+	if os.IsNotExist(err) {
+		return types.KeyInfo{}, xerrors.Errorf("opening key '%s': %w", name, types.ErrKeyInfoNotFound)
+	} else if err != nil {
+		return types.KeyInfo{}, xerrors.Errorf("opening key '%s': %w", name, err)
+	}
+
+	// The name is authenticated so that key files can't be swapped around
+	data, err := open(ks.aead, sealed, []byte(name))
+	if err != nil {
+		return types.KeyInfo{}, xerrors.Errorf("decrypting key '%s': %w", name, err)
+	}
+
+	var res types.KeyInfo
+	if err := json.Unmarshal(data, &res); err != nil {
+		return types.KeyInfo{}, xerrors.Errorf("decoding key '%s': %w", name, err)
+	}
+
+	return res, nil
+}
+
+func (ks *EncryptedKeyStore) Put(name string, info types.KeyInfo) error {
+	keyPath := ks.keyPath(name)
+
+	_, err := os.Stat(keyPath)
+	if err == nil {
+		return xerrors.Errorf("checking key before put '%s': %w", name, types.ErrKeyExists)
+	} else if !os.IsNotExist(err) {
+		return xerrors.Errorf("checking key before put '%s': %w", name, err)
+	}
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return xerrors.Errorf("encoding key '%s': %w", name, err)
+	}
+
+	sealed, err := seal(ks.aead, data, []byte(name))
+	if err != nil {
+		return xerrors.Errorf("encrypting key '%s': %w", name, err)
+	}
+
+	if err := os.WriteFile(keyPath, sealed, 0600); err != nil {
+		return xerrors.Errorf("writing key '%s': %w", name, err)
+	}
+	return nil
+}
+
+func (ks *EncryptedKeyStore) Delete(name string) error {
+	keyPath := ks.keyPath(name)
+
+	_, err := os.Stat(keyPath)
+	if os.IsNotExist(err) {
+		return xerrors.Errorf("checking key before delete '%s': %w", name, types.ErrKeyInfoNotFound)
+	} else if err != nil {
+		return xerrors.Errorf("checking key before delete '%s': %w", name, err)
+	}
+
+	if err := os.Remove(keyPath); err != nil {
+		return xerrors.Errorf("deleting key '%s': %w", name, err)
+	}
+	return nil
+}
+
+func (ks *EncryptedKeyStore) keyPath(name string) string {
+	return keyFilePath(ks.path, name)
+}
+
+// Key files are named the same way as in the filclient disk keystore
+func keyFilePath(dir string, name string) string {
+	return filepath.Join(dir, base32.RawStdEncoding.EncodeToString([]byte(name)))
+}
+
+// ReadPassphrase gets the keystore passphrase from the environment, a file
+// named by the environment, or by prompting for it on the terminal
+func ReadPassphrase(prompt string) ([]byte, error) {
+	if passphrase, ok := os.LookupEnv(PassphraseEnv); ok {
+		return []byte(passphrase), nil
+	}
+
+	if path := os.Getenv(PassphraseFileEnv); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, xerrors.Errorf("reading passphrase file: %w", err)
+		}
+		return []byte(strings.TrimRight(string(data), "\r\n")), nil
+	}
+
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, fmt.Errorf("the keystore is encrypted, set %s or %s to unlock it", PassphraseEnv, PassphraseFileEnv)
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	return passphrase, nil
+}
+
+// Whether a passphrase was configured without having to prompt for it
+func passphraseConfigured() bool {
+	_, ok := os.LookupEnv(PassphraseEnv)
+	return ok || os.Getenv(PassphraseFileEnv) != ""
+}
+
+// Open the wallet's keystore in cfgdir, unlocking it if it is encrypted. A
+// new keystore is only encrypted if a passphrase is configured.
+func openKeystore(cfgdir string) (types.KeyStore, error) {
+	encPath := encryptedWalletPath(cfgdir)
+	plainPath := walletPath(cfgdir)
+
+	_, encErr := os.Stat(encPath)
+	_, plainErr := os.Stat(plainPath)
+
+	switch {
+	case encErr == nil:
+		if plainErr == nil {
+			log.Warnf("Both an encrypted and a plaintext keystore exist, using the encrypted one. Remove %s once you've checked the migration.", plainPath)
+		}
+
+		passphrase, err := ReadPassphrase("Keystore passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+
+		return OpenEncryptedKeystore(encPath, passphrase)
+	case plainErr == nil || !passphraseConfigured():
+		return keystore.OpenOrInitKeystore(plainPath)
+	default:
+		passphrase, err := ReadPassphrase("")
+		if err != nil {
+			return nil, err
+		}
+
+		return InitEncryptedKeystore(encPath, passphrase)
+	}
+}
+
+// MigrateKeystore moves the keys of the plaintext keystore in cfgdir into a
+// new keystore encrypted with passphrase, then deletes the plaintext keys.
+// The encrypted keystore is built and checked next to its final path and
+// only renamed into place once complete, so an interrupted migration leaves
+// the plaintext keystore in use.
+func MigrateKeystore(cfgdir string, passphrase []byte) (int, error) {
+	plainPath := walletPath(cfgdir)
+	if _, err := os.Stat(plainPath); err != nil {
+		return 0, xerrors.Errorf("no plaintext keystore to migrate: %w", err)
+	}
+
+	encPath := encryptedWalletPath(cfgdir)
+	if _, err := os.Stat(encPath); err == nil {
+		return 0, fmt.Errorf("keystore %s already exists", encPath)
+	}
+
+	plain, err := keystore.OpenOrInitKeystore(plainPath)
+	if err != nil {
+		return 0, err
+	}
+
+	names, err := plain.List()
+	if err != nil {
+		return 0, err
+	}
+
+	// Left over from an interrupted migration
+	tmpPath := encPath + ".tmp"
+	if err := os.RemoveAll(tmpPath); err != nil {
+		return 0, err
+	}
+
+	if err := buildEncryptedKeystore(tmpPath, passphrase, plain, names); err != nil {
+		os.RemoveAll(tmpPath)
+		return 0, err
+	}
+
+	if err := os.Rename(tmpPath, encPath); err != nil {
+		os.RemoveAll(tmpPath)
+		return 0, err
+	}
+
+	for _, name := range names {
+		if err := shred(keyFilePath(plainPath, name)); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := os.Remove(plainPath); err != nil {
+		return 0, err
+	}
+
+	return len(names), nil
+}
+
+// Copy the named keys of plain into a new encrypted keystore at p, then
+// reopen it with passphrase and check every key reads back the same
+func buildEncryptedKeystore(p string, passphrase []byte, plain types.KeyStore, names []string) error {
+	enc, err := InitEncryptedKeystore(p, passphrase)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		ki, err := plain.Get(name)
+		if err != nil {
+			return err
+		}
+
+		if err := enc.Put(name, ki); err != nil {
+			return err
+		}
+	}
+
+	enc, err = OpenEncryptedKeystore(p, passphrase)
+	if err != nil {
+		return xerrors.Errorf("verifying migrated keystore: %w", err)
+	}
+
+	migrated, err := enc.List()
+	if err != nil {
+		return err
+	}
+	if len(migrated) != len(names) {
+		return xerrors.Errorf("verifying migrated keystore: %d keys instead of %d", len(migrated), len(names))
+	}
+
+	for _, name := range names {
+		want, err := plain.Get(name)
+		if err != nil {
+			return err
+		}
+
+		got, err := enc.Get(name)
+		if err != nil {
+			return xerrors.Errorf("verifying migrated key '%s': %w", name, err)
+		}
+		if got.Type != want.Type || !bytes.Equal(got.PrivateKey, want.PrivateKey) {
+			return xerrors.Errorf("verifying migrated key '%s': key differs", name)
+		}
+	}
+
+	return nil
+}
+
+// Overwrite a file before removing it, so the plaintext key doesn't linger in
+// the file's old blocks
+func shred(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(path, make([]byte, fi.Size()), 0600); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
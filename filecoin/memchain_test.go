@@ -0,0 +1,554 @@
+package filecoin
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin/v8/paych"
+	"github.com/filecoin-project/go-state-types/exitcode"
+	"github.com/filecoin-project/go-state-types/network"
+	"github.com/filecoin-project/lotus/api"
+	lblockstore "github.com/filecoin-project/lotus/blockstore"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/types/mock"
+	"github.com/filecoin-project/lotus/paychmgr"
+	builtin0 "github.com/filecoin-project/specs-actors/actors/builtin"
+	account0 "github.com/filecoin-project/specs-actors/actors/builtin/account"
+	paych0 "github.com/filecoin-project/specs-actors/actors/builtin/paych"
+	adt0 "github.com/filecoin-project/specs-actors/actors/util/adt"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	dssync "github.com/ipfs/go-datastore/sync"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// MemChain is an in-memory Chain for testing payment channel and wallet flows
+// without a network. Every pushed message is included in a new tipset right
+// away. Plain value transfers move balances, method calls are passed to
+// OnMessage if set and otherwise succeed without any effect. Signatures are
+// not checked.
+//
+// Gateway methods MemChain doesn't implement return api.ErrNotSupported.
+type MemChain struct {
+	api.GatewayStub
+
+	// Executes method calls, returning their receipt
+	OnMessage func(msg *types.Message) types.MessageReceipt
+
+	lk      sync.Mutex
+	head    *types.TipSet
+	tipsets map[types.TipSetKey]*types.TipSet
+	bs      *lblockstore.SyncBlockstore
+	actors  map[address.Address]*types.Actor
+	ids     map[address.Address]address.Address
+	keys    map[address.Address]address.Address
+	nextID  uint64
+	miners  map[address.Address]api.MinerInfo
+	msgs    map[cid.Cid]*api.MsgLookup
+
+	// Closed and replaced whenever a message lands
+	landed chan struct{}
+}
+
+func NewMemChain() *MemChain {
+	genesis := mock.TipSet(mock.MkBlock(nil, 1, 0))
+
+	return &MemChain{
+		head:    genesis,
+		tipsets: map[types.TipSetKey]*types.TipSet{genesis.Key(): genesis},
+		bs:      lblockstore.NewMemorySync(),
+		actors:  make(map[address.Address]*types.Actor),
+		ids:     make(map[address.Address]address.Address),
+		keys:    make(map[address.Address]address.Address),
+		nextID:  1000,
+		miners:  make(map[address.Address]api.MinerInfo),
+		msgs:    make(map[cid.Cid]*api.MsgLookup),
+		landed:  make(chan struct{}),
+	}
+}
+
+// SetBalance sets the balance of addr, creating an account actor for it if
+// there is none yet
+func (mc *MemChain) SetBalance(addr address.Address, balance abi.TokenAmount) {
+	mc.lk.Lock()
+	defer mc.lk.Unlock()
+
+	mc.getOrCreate(addr).Balance = balance
+}
+
+// SetActor puts an actor on chain, e.g. a payment channel whose state was
+// written to Blockstore
+func (mc *MemChain) SetActor(addr address.Address, act *types.Actor) {
+	mc.lk.Lock()
+	defer mc.lk.Unlock()
+
+	mc.actors[mc.resolve(addr)] = act
+}
+
+// AddMiner registers a storage provider reachable at peerID
+func (mc *MemChain) AddMiner(addr address.Address, peerID peer.ID) {
+	mc.lk.Lock()
+	defer mc.lk.Unlock()
+
+	mc.miners[addr] = api.MinerInfo{
+		Owner:  addr,
+		Worker: addr,
+		PeerId: &peerID,
+	}
+}
+
+// Blockstore holds the state ChainReadObj serves. It is safe to use
+// concurrently, OnMessage included.
+func (mc *MemChain) Blockstore() lblockstore.Blockstore {
+	return mc.bs
+}
+
+// Resolve addr to its ID address, assigning one to key addresses not seen
+// before. Must be called with lk held.
+func (mc *MemChain) resolve(addr address.Address) address.Address {
+	if addr.Protocol() == address.ID {
+		return addr
+	}
+
+	id, ok := mc.ids[addr]
+	if !ok {
+		id, _ = address.NewIDAddress(mc.nextID)
+		mc.nextID++
+		mc.ids[addr] = id
+		mc.keys[id] = addr
+	}
+
+	return id
+}
+
+func (mc *MemChain) getOrCreate(addr address.Address) *types.Actor {
+	id := mc.resolve(addr)
+
+	act, ok := mc.actors[id]
+	if !ok {
+		key, ok := mc.keys[id]
+		if !ok {
+			key = id
+		}
+
+		// The blockstore can't fail to store an account's state
+		head, _ := cbor.NewCborStore(mc.bs).Put(context.Background(), &account0.State{Address: key})
+
+		act = &types.Actor{
+			Code:    builtin0.AccountActorCodeID,
+			Head:    head,
+			Balance: big.Zero(),
+		}
+		mc.actors[id] = act
+	}
+
+	return act
+}
+
+func (mc *MemChain) actor(addr address.Address) (*types.Actor, error) {
+	if addr.Protocol() != address.ID {
+		id, ok := mc.ids[addr]
+		if !ok {
+			return nil, types.ErrActorNotFound
+		}
+		addr = id
+	}
+
+	act, ok := mc.actors[addr]
+	if !ok {
+		return nil, types.ErrActorNotFound
+	}
+
+	return act, nil
+}
+
+func (mc *MemChain) ChainHead(ctx context.Context) (*types.TipSet, error) {
+	mc.lk.Lock()
+	defer mc.lk.Unlock()
+
+	return mc.head, nil
+}
+
+func (mc *MemChain) ChainGetTipSet(ctx context.Context, tsk types.TipSetKey) (*types.TipSet, error) {
+	mc.lk.Lock()
+	defer mc.lk.Unlock()
+
+	if tsk.IsEmpty() {
+		return mc.head, nil
+	}
+
+	ts, ok := mc.tipsets[tsk]
+	if !ok {
+		return nil, fmt.Errorf("tipset %s not found", tsk)
+	}
+
+	return ts, nil
+}
+
+func (mc *MemChain) ChainReadObj(ctx context.Context, c cid.Cid) ([]byte, error) {
+	blk, err := mc.bs.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	return blk.RawData(), nil
+}
+
+func (mc *MemChain) ChainHasObj(ctx context.Context, c cid.Cid) (bool, error) {
+	return mc.bs.Has(ctx, c)
+}
+
+func (mc *MemChain) ChainPutObj(ctx context.Context, blk blocks.Block) error {
+	return mc.bs.Put(ctx, blk)
+}
+
+func (mc *MemChain) StateGetActor(ctx context.Context, addr address.Address, tsk types.TipSetKey) (*types.Actor, error) {
+	mc.lk.Lock()
+	defer mc.lk.Unlock()
+
+	act, err := mc.actor(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	cpy := *act
+	return &cpy, nil
+}
+
+func (mc *MemChain) WalletBalance(ctx context.Context, addr address.Address) (types.BigInt, error) {
+	act, err := mc.StateGetActor(ctx, addr, types.EmptyTSK)
+	if err == types.ErrActorNotFound {
+		return big.Zero(), nil
+	} else if err != nil {
+		return big.Zero(), err
+	}
+
+	return act.Balance, nil
+}
+
+func (mc *MemChain) StateLookupID(ctx context.Context, addr address.Address, tsk types.TipSetKey) (address.Address, error) {
+	mc.lk.Lock()
+	defer mc.lk.Unlock()
+
+	if _, err := mc.actor(addr); err != nil {
+		return address.Undef, err
+	}
+
+	return mc.resolve(addr), nil
+}
+
+func (mc *MemChain) StateAccountKey(ctx context.Context, addr address.Address, tsk types.TipSetKey) (address.Address, error) {
+	mc.lk.Lock()
+	defer mc.lk.Unlock()
+
+	if addr.Protocol() != address.ID {
+		return addr, nil
+	}
+
+	key, ok := mc.keys[addr]
+	if !ok {
+		return address.Undef, fmt.Errorf("%s is not an account actor", addr)
+	}
+
+	return key, nil
+}
+
+func (mc *MemChain) StateMinerInfo(ctx context.Context, addr address.Address, tsk types.TipSetKey) (api.MinerInfo, error) {
+	mc.lk.Lock()
+	defer mc.lk.Unlock()
+
+	info, ok := mc.miners[addr]
+	if !ok {
+		return api.MinerInfo{}, fmt.Errorf("miner %s not found", addr)
+	}
+
+	return info, nil
+}
+
+func (mc *MemChain) StateNetworkVersion(ctx context.Context, tsk types.TipSetKey) (network.Version, error) {
+	return network.Version17, nil
+}
+
+func (mc *MemChain) GasEstimateMessageGas(ctx context.Context, msg *types.Message, spec *api.MessageSendSpec, tsk types.TipSetKey) (*types.Message, error) {
+	estim := *msg
+	estim.GasLimit = 10_000_000
+	estim.GasFeeCap = abi.NewTokenAmount(100_000)
+	estim.GasPremium = abi.NewTokenAmount(1_000)
+
+	return &estim, nil
+}
+
+// MpoolPush includes smsg in a new tipset and executes it. Gas isn't charged.
+func (mc *MemChain) MpoolPush(ctx context.Context, smsg *types.SignedMessage) (cid.Cid, error) {
+	mc.lk.Lock()
+	defer mc.lk.Unlock()
+
+	msg := &smsg.Message
+
+	from, err := mc.actor(msg.From)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("sender %s: %w", msg.From, err)
+	}
+	if msg.Nonce != from.Nonce {
+		return cid.Undef, fmt.Errorf("message nonce %d doesn't match the nonce %d of %s", msg.Nonce, from.Nonce, msg.From)
+	}
+	from.Nonce++
+
+	receipt := types.MessageReceipt{ExitCode: exitcode.Ok}
+	switch {
+	case from.Balance.LessThan(msg.Value):
+		receipt.ExitCode = exitcode.SysErrInsufficientFunds
+	case msg.Method == 0:
+		from.Balance = big.Sub(from.Balance, msg.Value)
+		to := mc.getOrCreate(msg.To)
+		to.Balance = big.Add(to.Balance, msg.Value)
+	case mc.OnMessage != nil:
+		receipt = mc.OnMessage(msg)
+	}
+
+	mc.head = mock.TipSet(mock.MkBlock(mc.head, 1, uint64(mc.head.Height())+1))
+	mc.tipsets[mc.head.Key()] = mc.head
+
+	lookup := &api.MsgLookup{
+		Message: smsg.Cid(),
+		Receipt: receipt,
+		TipSet:  mc.head.Key(),
+		Height:  mc.head.Height(),
+	}
+	mc.msgs[smsg.Cid()] = lookup
+	mc.msgs[msg.Cid()] = lookup
+
+	close(mc.landed)
+	mc.landed = make(chan struct{})
+
+	return smsg.Cid(), nil
+}
+
+func (mc *MemChain) StateSearchMsg(ctx context.Context, from types.TipSetKey, msg cid.Cid, limit abi.ChainEpoch, allowReplaced bool) (*api.MsgLookup, error) {
+	mc.lk.Lock()
+	defer mc.lk.Unlock()
+
+	return mc.msgs[msg], nil
+}
+
+// StateWaitMsg waits for msg to be pushed, messages being final as soon as
+// they land
+func (mc *MemChain) StateWaitMsg(ctx context.Context, msg cid.Cid, confidence uint64, limit abi.ChainEpoch, allowReplaced bool) (*api.MsgLookup, error) {
+	for {
+		mc.lk.Lock()
+		lookup, ok := mc.msgs[msg]
+		landed := mc.landed
+		mc.lk.Unlock()
+
+		if ok {
+			return lookup, nil
+		}
+
+		select {
+		case <-landed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func TestSendWithMemChain(t *testing.T) {
+	ctx := context.Background()
+	mc := NewMemChain()
+
+	signer, err := NewMemorySigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, err := signer.WalletNew(ctx, types.KTSecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := address.NewIDAddress(2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mc.SetBalance(from, big.NewInt(100))
+
+	for i := 0; i < 2; i++ {
+		msg, err := Send(ctx, mc, signer, from, to, big.NewInt(30))
+		if err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+
+		lookup, err := mc.StateWaitMsg(ctx, msg, 1, 0, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lookup.Receipt.ExitCode != exitcode.Ok {
+			t.Fatalf("send %d exited with %s", i, lookup.Receipt.ExitCode)
+		}
+	}
+
+	if balance, _ := mc.WalletBalance(ctx, from); !balance.Equals(big.NewInt(40)) {
+		t.Errorf("sender has %s left, want 40", balance)
+	}
+	if balance, _ := mc.WalletBalance(ctx, to); !balance.Equals(big.NewInt(60)) {
+		t.Errorf("recipient has %s, want 60", balance)
+	}
+
+	// Signers that don't hold the sender's key are refused before anything
+	// is pushed
+	other, err := NewMemorySigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Send(ctx, mc, other, from, to, big.NewInt(1)); err == nil {
+		t.Error("sent with a signer that doesn't hold the key")
+	}
+}
+
+func TestPaychSettleCollect(t *testing.T) {
+	ctx := context.Background()
+	mc := NewMemChain()
+
+	signer, err := NewMemorySigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, err := signer.WalletNew(ctx, types.KTSecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bystander, err := signer.WalletNew(ctx, types.KTSecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider, err := address.NewIDAddress(2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, err := address.NewIDAddress(3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mc.SetBalance(from, big.NewInt(1000))
+	mc.SetBalance(bystander, big.NewInt(1000))
+
+	// A channel holding 100, 50 of which the provider redeemed
+	store := adt0.WrapStore(ctx, cbor.NewCborStore(mc.Blockstore()))
+	lanes, err := adt0.MakeEmptyArray(store).Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := &paych0.State{
+		From:       from,
+		To:         provider,
+		ToSend:     big.NewInt(50),
+		LaneStates: lanes,
+	}
+	head, err := store.Put(ctx, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	act := &types.Actor{
+		Code:    builtin0.PaymentChannelActorCodeID,
+		Head:    head,
+		Balance: big.NewInt(100),
+	}
+	mc.SetActor(ch, act)
+
+	// Settling lets the channel be collected at the next epoch
+	var methods []abi.MethodNum
+	mc.OnMessage = func(msg *types.Message) types.MessageReceipt {
+		methods = append(methods, msg.Method)
+
+		if msg.Method == builtin0.MethodsPaych.Settle {
+			state.SettlingAt = mc.head.Height() + 2
+			head, err := store.Put(ctx, state)
+			if err != nil {
+				return types.MessageReceipt{ExitCode: exitcode.ErrIllegalState}
+			}
+			act.Head = head
+		}
+
+		return types.MessageReceipt{ExitCode: exitcode.Ok}
+	}
+
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	pchstore := paychmgr.NewStore(namespace.Wrap(ds, datastore.NewKey("paych")))
+	if _, err := pchstore.TrackChannel(ctx, &paychmgr.ChannelInfo{
+		ChannelID: "outbound",
+		Channel:   &ch,
+		Control:   from,
+		Target:    provider,
+		Direction: paychmgr.DirOutbound,
+		Vouchers: []*paychmgr.VoucherInfo{
+			{Voucher: &paych.SignedVoucher{Lane: 0, Nonce: 1, Amount: big.NewInt(30)}},
+			{Voucher: &paych.SignedVoucher{Lane: 0, Nonce: 2, Amount: big.NewInt(50)}},
+			{Voucher: &paych.SignedVoucher{Lane: 1, Nonce: 1, Amount: big.NewInt(20)}},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	pm := NewPaychManager(mc, signer, ds)
+
+	statuses, err := pm.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1 {
+		t.Fatalf("listed %d channels, want 1", len(statuses))
+	}
+	status := statuses[0]
+	if status.Provider != provider || status.VouchersSent != 3 {
+		t.Errorf("channel to %s with %d vouchers, want %s with 3", status.Provider, status.VouchersSent, provider)
+	}
+	if !status.VoucherTotal.Equals(big.NewInt(70)) || !status.Redeemed.Equals(big.NewInt(50)) || !status.Redeemable.Equals(big.NewInt(30)) {
+		t.Errorf("vouchers worth %s, %s redeemed, %s redeemable, want 70, 50, 30", status.VoucherTotal, status.Redeemed, status.Redeemable)
+	}
+	if status.Settling {
+		t.Error("channel is settling before being settled")
+	}
+
+	if _, err := pm.Collect(ctx, ch); err == nil {
+		t.Fatal("collected a channel that isn't settled")
+	}
+
+	if _, err := pm.Settle(ctx, ch); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err = pm.Status(ctx, ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Settling || status.Collectable {
+		t.Fatalf("settling %v, collectable %v right after settling, want true, false", status.Settling, status.Collectable)
+	}
+	if _, err := pm.Collect(ctx, ch); err == nil {
+		t.Fatal("collected a channel that is still settling")
+	}
+
+	// Let the settlement period pass, without touching the nonce of the
+	// channel's control address
+	if _, err := Send(ctx, mc, signer, bystander, provider, big.NewInt(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pm.Collect(ctx, ch); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []abi.MethodNum{builtin0.MethodsPaych.Settle, builtin0.MethodsPaych.Collect}
+	if !reflect.DeepEqual(methods, want) {
+		t.Errorf("called methods %v, want %v", methods, want)
+	}
+}
@@ -0,0 +1,237 @@
+package filecoin
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	actorstypes "github.com/filecoin-project/go-state-types/actors"
+	"github.com/filecoin-project/go-state-types/big"
+	lpaych "github.com/filecoin-project/lotus/chain/actors/builtin/paych"
+	rpcstmgr "github.com/filecoin-project/lotus/chain/stmgr/rpc"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/paychmgr"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"golang.org/x/xerrors"
+)
+
+// PaychStatus describes a payment channel opened for paid retrievals
+type PaychStatus struct {
+	Channel  address.Address `json:"channel"`
+	Provider address.Address `json:"provider"`
+
+	// Funds locked in the channel on chain
+	Balance types.BigInt `json:"balance"`
+
+	// Number of vouchers sent to the provider, and the total they are
+	// worth. Vouchers are cumulative per lane, so only the highest one of
+	// each lane counts.
+	VouchersSent int          `json:"vouchersSent"`
+	VoucherTotal types.BigInt `json:"voucherTotal"`
+
+	// Amount the provider has redeemed on chain
+	Redeemed types.BigInt `json:"redeemed"`
+
+	// Funds that return to the wallet when the channel is collected
+	Redeemable types.BigInt `json:"redeemable"`
+
+	Settling    bool           `json:"settling"`
+	SettlingAt  abi.ChainEpoch `json:"settlingAt,omitempty"`
+	Collectable bool           `json:"collectable"`
+}
+
+// PaychManager reports on and winds down the outbound payment channels that
+// filclient opens for paid retrievals. filclient's own channel manager opens
+// the channels and creates the vouchers, PaychManager only reads the channel
+// store they share and sends settle and collect messages itself, so that no
+// second manager runs on the store.
+type PaychManager struct {
+	api   Chain
+	sm    *rpcstmgr.RPCStateManager
+	store *paychmgr.Store
+	mp    *signerPusher
+}
+
+// NewPaychManager manages the channels filclient keeps in ds, signing the
+// messages it sends with signer
+func NewPaychManager(gw Chain, signer Signer, ds datastore.Batching) *PaychManager {
+	return &PaychManager{
+		api: gw,
+		sm:  rpcstmgr.NewRPCStateManager(gw),
+		// Same namespace filclient keeps its channels in
+		store: paychmgr.NewStore(namespace.Wrap(ds, datastore.NewKey("paych"))),
+		mp:    newSignerPusher(gw, signer),
+	}
+}
+
+// List returns the status of every outbound channel
+func (pm *PaychManager) List(ctx context.Context) ([]*PaychStatus, error) {
+	chans, err := pm.store.ListChannels(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []*PaychStatus
+	for _, ch := range chans {
+		status, err := pm.Status(ctx, ch)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to get status of channel %s: %w", ch, err)
+		}
+		if status != nil {
+			statuses = append(statuses, status)
+		}
+	}
+
+	return statuses, nil
+}
+
+// Status combines the locally recorded vouchers of a channel with its state
+// on chain. Inbound channels aren't ours to manage, their status is nil.
+func (pm *PaychManager) Status(ctx context.Context, ch address.Address) (*PaychStatus, error) {
+	info, err := pm.store.ByAddress(ctx, ch)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Direction != paychmgr.DirOutbound {
+		return nil, nil
+	}
+
+	status := &PaychStatus{
+		Channel:      ch,
+		Provider:     info.Target,
+		VoucherTotal: big.Zero(),
+		Settling:     info.Settling,
+	}
+
+	highest := make(map[uint64]big.Int)
+	for _, v := range info.Vouchers {
+		status.VouchersSent++
+		if amt, ok := highest[v.Voucher.Lane]; !ok || v.Voucher.Amount.GreaterThan(amt) {
+			highest[v.Voucher.Lane] = v.Voucher.Amount
+		}
+	}
+	for _, amt := range highest {
+		status.VoucherTotal = big.Add(status.VoucherTotal, amt)
+	}
+
+	act, state, err := pm.sm.GetPaychState(ctx, ch, nil)
+	if err != nil {
+		return nil, err
+	}
+	status.Balance = act.Balance
+
+	status.Redeemed, err = state.ToSend()
+	if err != nil {
+		return nil, err
+	}
+
+	status.Redeemable = big.Sub(act.Balance, status.VoucherTotal)
+	if status.Redeemable.LessThan(big.Zero()) {
+		status.Redeemable = big.Zero()
+	}
+
+	status.SettlingAt, err = state.SettlingAt()
+	if err != nil {
+		return nil, err
+	}
+
+	if status.SettlingAt != 0 {
+		status.Settling = true
+
+		head, err := pm.api.ChainHead(ctx)
+		if err != nil {
+			return nil, err
+		}
+		status.Collectable = head.Height() >= status.SettlingAt
+	}
+
+	return status, nil
+}
+
+// Settle starts settling a channel, after which the provider has until the
+// settlement period ends to redeem its vouchers. Returns the CID of the
+// settle message.
+func (pm *PaychManager) Settle(ctx context.Context, ch address.Address) (cid.Cid, error) {
+	info, err := pm.store.ByAddress(ctx, ch)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if info.Direction != paychmgr.DirOutbound {
+		return cid.Undef, fmt.Errorf("channel %s is inbound", ch)
+	}
+
+	mb, err := pm.messageBuilder(ctx, info.Control)
+	if err != nil {
+		return cid.Undef, err
+	}
+	msg, err := mb.Settle(ch)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	return pm.push(ctx, msg)
+}
+
+// Collect sends the funds left in a settled channel back to the wallet.
+// Returns the CID of the collect message.
+func (pm *PaychManager) Collect(ctx context.Context, ch address.Address) (cid.Cid, error) {
+	status, err := pm.Status(ctx, ch)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if status == nil {
+		return cid.Undef, fmt.Errorf("channel %s is inbound", ch)
+	}
+
+	if !status.Collectable {
+		if !status.Settling {
+			return cid.Undef, fmt.Errorf("channel %s has to be settled before it can be collected", ch)
+		}
+		return cid.Undef, fmt.Errorf("channel %s is still settling until epoch %d", ch, status.SettlingAt)
+	}
+
+	info, err := pm.store.ByAddress(ctx, ch)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	mb, err := pm.messageBuilder(ctx, info.Control)
+	if err != nil {
+		return cid.Undef, err
+	}
+	msg, err := mb.Collect(ch)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	return pm.push(ctx, msg)
+}
+
+// Build channel messages from the channel's controlling address for the
+// actors version of the current network
+func (pm *PaychManager) messageBuilder(ctx context.Context, from address.Address) (lpaych.MessageBuilder, error) {
+	nv, err := pm.api.StateNetworkVersion(ctx, types.EmptyTSK)
+	if err != nil {
+		return nil, err
+	}
+
+	av, err := actorstypes.VersionForNetwork(nv)
+	if err != nil {
+		return nil, err
+	}
+
+	return lpaych.Message(av, from), nil
+}
+
+func (pm *PaychManager) push(ctx context.Context, msg *types.Message) (cid.Cid, error) {
+	smsg, err := pm.mp.MpoolPushMessage(ctx, msg, nil)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	return smsg.Cid(), nil
+}
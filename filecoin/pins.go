@@ -0,0 +1,256 @@
+package filecoin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	ipldformat "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"golang.org/x/xerrors"
+)
+
+type PinType string
+
+const (
+	// The root and every block below it are kept
+	PinRecursive PinType = "recursive"
+
+	// Only the root block is kept
+	PinDirect PinType = "direct"
+)
+
+func ParsePinType(s string) (PinType, error) {
+	switch typ := PinType(s); typ {
+	case PinRecursive, PinDirect:
+		return typ, nil
+	default:
+		return "", fmt.Errorf("unknown pin type '%s' (expected recursive or direct)", s)
+	}
+}
+
+var ErrPinNotFound = fmt.Errorf("pin not found")
+
+var pinsPrefix = datastore.NewKey("/wormhole/pins")
+
+// A Pin records a root that was added to the node and should be kept
+type Pin struct {
+	Cid     cid.Cid   `json:"cid"`
+	Name    string    `json:"name,omitempty"`
+	Type    PinType   `json:"type,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// Whether the whole DAG under the pin is kept. Pins recorded before pin
+// types existed are recursive.
+func (pin *Pin) Recursive() bool {
+	return pin.Type != PinDirect
+}
+
+// PinStatus is the result of verifying a pin
+type PinStatus struct {
+	Pin *Pin `json:"pin"`
+	Ok  bool `json:"ok"`
+
+	// Blocks of the pinned DAG that are missing from the blockstore
+	Missing []cid.Cid `json:"missing,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// Pinset keeps track of the pinned roots in the node's datastore
+type Pinset struct {
+	ds datastore.Batching
+
+	// Held for reading while pins are added and for writing by the cache
+	// GC, which must not see a pin appear while it deletes blocks
+	lk sync.RWMutex
+}
+
+func NewPinset(ds datastore.Batching) *Pinset {
+	return &Pinset{ds: ds}
+}
+
+func pinKey(c cid.Cid) datastore.Key {
+	return pinsPrefix.ChildString(c.String())
+}
+
+// Pin fetches the content to pin with dserv, all of it for a recursive pin
+// or just the root for a direct one, and then adds the pin
+func (ps *Pinset) Pin(ctx context.Context, dserv ipldformat.DAGService, c cid.Cid, name string, typ PinType) (*Pin, error) {
+	ps.lk.RLock()
+	defer ps.lk.RUnlock()
+
+	if typ == PinDirect {
+		if _, err := dserv.Get(ctx, c); err != nil {
+			return nil, xerrors.Errorf("failed to fetch %s: %w", c, err)
+		}
+	} else {
+		if err := merkledag.FetchGraph(ctx, c, dserv); err != nil {
+			return nil, xerrors.Errorf("failed to fetch DAG under %s: %w", c, err)
+		}
+	}
+
+	return ps.add(ctx, c, name, typ)
+}
+
+// Add pins c without checking the content is available, replacing any
+// existing pin of c
+func (ps *Pinset) Add(ctx context.Context, c cid.Cid, name string, typ PinType) (*Pin, error) {
+	ps.lk.RLock()
+	defer ps.lk.RUnlock()
+
+	return ps.add(ctx, c, name, typ)
+}
+
+func (ps *Pinset) add(ctx context.Context, c cid.Cid, name string, typ PinType) (*Pin, error) {
+	pin := &Pin{
+		Cid:     c,
+		Name:    name,
+		Type:    typ,
+		Created: time.Now(),
+	}
+
+	data, err := json.Marshal(pin)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ps.ds.Put(ctx, pinKey(c), data); err != nil {
+		return nil, err
+	}
+
+	return pin, ps.ds.Sync(ctx, pinsPrefix)
+}
+
+func (ps *Pinset) Get(ctx context.Context, c cid.Cid) (*Pin, error) {
+	data, err := ps.ds.Get(ctx, pinKey(c))
+	if err != nil {
+		if err == datastore.ErrNotFound {
+			return nil, ErrPinNotFound
+		}
+		return nil, err
+	}
+
+	var pin Pin
+	if err := json.Unmarshal(data, &pin); err != nil {
+		return nil, xerrors.Errorf("could not decode pin %s: %w", c, err)
+	}
+
+	return &pin, nil
+}
+
+// Remove unpins c. Its blocks stay in the blockstore, only cache GC removes
+// them and only if the cache tracks c, i.e. it was retrieved rather than
+// added.
+func (ps *Pinset) Remove(ctx context.Context, c cid.Cid) error {
+	if _, err := ps.Get(ctx, c); err != nil {
+		return err
+	}
+
+	if err := ps.ds.Delete(ctx, pinKey(c)); err != nil {
+		return err
+	}
+
+	return ps.ds.Sync(ctx, pinsPrefix)
+}
+
+// Verify checks that the pinned content of each of cids is in bs, verifying
+// all pins if no cids are given
+func (ps *Pinset) Verify(ctx context.Context, bs blockstore.Blockstore, cids []cid.Cid) ([]*PinStatus, error) {
+	var pins []*Pin
+	if len(cids) == 0 {
+		all, err := ps.List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		pins = all
+	}
+	for _, c := range cids {
+		pin, err := ps.Get(ctx, c)
+		if err != nil {
+			return nil, xerrors.Errorf("%s: %w", c, err)
+		}
+		pins = append(pins, pin)
+	}
+
+	var statuses []*PinStatus
+	for _, pin := range pins {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, verifyPin(ctx, bs, pin))
+	}
+
+	return statuses, nil
+}
+
+func verifyPin(ctx context.Context, bs blockstore.Blockstore, pin *Pin) *PinStatus {
+	status := &PinStatus{Pin: pin}
+
+	if !pin.Recursive() {
+		has, err := bs.Has(ctx, pin.Cid)
+		switch {
+		case err != nil:
+			status.Error = err.Error()
+		case !has:
+			status.Missing = []cid.Cid{pin.Cid}
+		default:
+			status.Ok = true
+		}
+		return status
+	}
+
+	dserv := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+
+	cset := cid.NewSet()
+	err := merkledag.Walk(ctx, func(ctx context.Context, c cid.Cid) ([]*ipldformat.Link, error) {
+		node, err := dserv.Get(ctx, c)
+		if err != nil {
+			if ipldformat.IsNotFound(err) {
+				status.Missing = append(status.Missing, c)
+				return nil, nil
+			}
+			return nil, err
+		}
+		return node.Links(), nil
+	}, pin.Cid, cset.Visit)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+
+	status.Ok = len(status.Missing) == 0
+	return status
+}
+
+func (ps *Pinset) List(ctx context.Context) ([]*Pin, error) {
+	res, err := ps.ds.Query(ctx, query.Query{Prefix: pinsPrefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	var pins []*Pin
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+
+		var pin Pin
+		if err := json.Unmarshal(r.Value, &pin); err != nil {
+			return nil, xerrors.Errorf("could not decode pin %s: %w", r.Key, err)
+		}
+
+		pins = append(pins, &pin)
+	}
+
+	return pins, nil
+}
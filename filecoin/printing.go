@@ -2,6 +2,9 @@ package filecoin
 
 import (
 	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
@@ -27,6 +30,40 @@ Max Piece Size: %v
 	)
 }
 
+// PrintAsks prints asks as a table in the order given. With verbose, the
+// full ask of every miner that answered follows.
+func PrintAsks(results []*AskResult, verbose bool) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "MINER\tPRICE\tVERIFIED PRICE\tMIN PIECE SIZE\tMAX PIECE SIZE\tLATENCY")
+	for _, res := range results {
+		if res.Ask == nil {
+			fmt.Fprintf(tw, "%s\tQuery failed: %s\t\t\t\t%s\n", res.Miner, res.Error, res.Latency.Round(time.Millisecond))
+			continue
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			res.Miner,
+			types.FIL(res.Ask.Price).Short(),
+			types.FIL(res.Ask.VerifiedPrice).Short(),
+			humanize.IBytes(uint64(res.Ask.MinPieceSize)),
+			humanize.IBytes(uint64(res.Ask.MaxPieceSize)),
+			res.Latency.Round(time.Millisecond),
+		)
+	}
+	tw.Flush()
+
+	if !verbose {
+		return
+	}
+
+	for _, res := range results {
+		if res.Ask != nil {
+			fmt.Println()
+			printAskResponse(res.Ask)
+		}
+	}
+}
+
 func printDealStatus(state *storagemarket.ProviderDealState) {
 	fmt.Printf(`DEAL STATUS
 -----
@@ -57,7 +94,7 @@ Fast Retrieval: %t
 	End Epoch:               %d
 	Storage Price Per Epoch: %d (%s)
 	Provider Collateral:     %d (%s)
-	Client Collateral:       %d (%d)
+	Client Collateral:       %d (%s)
 `,
 			state.Proposal.PieceCID,
 			state.Proposal.PieceSize, humanize.IBytes(uint64(state.Proposal.PieceSize)),
@@ -114,17 +151,7 @@ Average Speed: %v
 }
 
 func printQueryResponse(query *retrievalmarket.QueryResponse, availableOnIPFS bool) {
-	var status string
-	switch query.Status {
-	case retrievalmarket.QueryResponseAvailable:
-		status = "Available"
-	case retrievalmarket.QueryResponseUnavailable:
-		status = "Unavailable"
-	case retrievalmarket.QueryResponseError:
-		status = "Error"
-	default:
-		status = fmt.Sprintf("Unrecognized Status (%d)", query.Status)
-	}
+	status := queryStatus(query.Status)
 
 	var pieceCIDFound string
 	switch query.PieceCIDFound {
@@ -167,6 +194,165 @@ Max Payment Interval Increase: %v (%v)
 	}
 
 	if availableOnIPFS {
-		fmt.Printf("-----\nAvaiable on IPFS")
+		fmt.Printf("-----\nAvailable on IPFS\n")
+	}
+}
+
+// PrintDeals prints deals as a table
+func PrintDeals(deals []*Deal) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tCID\tMINER\tPIECE SIZE\tPRICE\tSTATE\tDEAL ID\tUPDATED\tMESSAGE")
+	for _, deal := range deals {
+		dealID := "-"
+		if deal.DealID != 0 {
+			dealID = fmt.Sprint(deal.DealID)
+		}
+
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			deal.ID,
+			deal.Cid,
+			deal.Miner,
+			humanize.IBytes(uint64(deal.PieceSize)),
+			types.FIL(deal.TotalPrice).Short(),
+			deal.State,
+			dealID,
+			deal.Updated.Format(time.RFC3339),
+			deal.Message,
+		)
+	}
+	tw.Flush()
+}
+
+// PrintDeal prints a deal with the state its provider last reported and its
+// event log
+func PrintDeal(deal *Deal, events []*DealEvent) {
+	fmt.Printf("Deal %d: %s with %s\n", deal.ID, deal.Cid, deal.Miner)
+	if deal.RenewalOf != 0 {
+		fmt.Printf("Renewal of deal %d\n", deal.RenewalOf)
+	}
+	if deal.RenewedBy != 0 {
+		fmt.Printf("Renewed by deal %d\n", deal.RenewedBy)
+	}
+
+	state := deal.ProviderState
+	if state == nil {
+		proposalCid := deal.ProposalCid
+		state = &storagemarket.ProviderDealState{
+			ProposalCid:   &proposalCid,
+			PublishCid:    deal.PublishCid,
+			DealID:        deal.DealID,
+			FastRetrieval: deal.FastRetrieval,
+		}
+	} else {
+		cpy := *state
+		state = &cpy
+	}
+
+	// The chain is polled after the provider, it knows better
+	state.State = deal.Status
+	state.Message = deal.Message
+
+	printDealStatus(state)
+
+	fmt.Println("-----\nEVENTS")
+	for _, event := range events {
+		fmt.Printf("%s  %s", event.Time.Format(time.RFC3339), event.State)
+		if event.Message != "" {
+			fmt.Printf(": %s", event.Message)
+		}
+		fmt.Println()
+	}
+}
+
+func queryStatus(status retrievalmarket.QueryResponseStatus) string {
+	switch status {
+	case retrievalmarket.QueryResponseAvailable:
+		return "Available"
+	case retrievalmarket.QueryResponseUnavailable:
+		return "Unavailable"
+	case retrievalmarket.QueryResponseError:
+		return "Error"
+	default:
+		return fmt.Sprintf("Unrecognized Status (%d)", status)
+	}
+}
+
+// PrintQueryReport prints the candidates of a query as a table, best first.
+// With verbose, the full response of every candidate that answered follows.
+func PrintQueryReport(report *QueryReport, verbose bool) {
+	if report.AvailableOnIPFS {
+		fmt.Printf("%s is available on IPFS from %d providers\n\n", report.Cid, report.IPFSProviders)
+	} else {
+		fmt.Printf("%s was not found on IPFS\n\n", report.Cid)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "#\tMINER\tSTATUS\tUNSEALED\tSIZE\tUNSEAL PRICE\tPRICE/BYTE\tTOTAL\tPAYMENT INTERVAL")
+	for i, res := range report.Candidates {
+		if res.Response == nil {
+			fmt.Fprintf(tw, "%d\t%s\tQuery failed: %s\t\t\t\t\t\t\n", i+1, res.Candidate.Miner, res.Error)
+			continue
+		}
+
+		query := res.Response
+		status := queryStatus(query.Status)
+		if res.OverMaxPrice {
+			status += " (over max price)"
+		}
+
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%v\t%s\t%s\t%s\t%s\t%s\n",
+			i+1,
+			res.Candidate.Miner,
+			status,
+			query.UnsealPrice.IsZero(),
+			humanize.IBytes(query.Size),
+			types.FIL(query.UnsealPrice).Short(),
+			types.FIL(query.MinPricePerByte).Short(),
+			types.FIL(res.TotalPrice).Short(),
+			humanize.IBytes(query.MaxPaymentInterval),
+		)
+	}
+	tw.Flush()
+
+	if !verbose {
+		return
+	}
+
+	for _, res := range report.Candidates {
+		if res.Response == nil {
+			continue
+		}
+
+		// IPFS availability was printed above the table
+		fmt.Printf("\nMiner: %v\n", res.Candidate.Miner)
+		printQueryResponse(res.Response, false)
+	}
+}
+
+func printBatchReport(report *BatchReport) {
+	fmt.Printf(`BATCH REPORT
+-----
+Entries:   %v
+Succeeded: %v
+Failed:    %v
+Skipped:   %v
+Duration:  %v
+`,
+		len(report.Results),
+		report.Succeeded,
+		report.Failed,
+		report.Skipped,
+		report.Duration,
+	)
+
+	for _, result := range report.Results {
+		switch {
+		case result.Skipped:
+			fmt.Printf("SKIPPED %s\n", result.Entry.Cid)
+		case result.Error != "":
+			fmt.Printf("FAILED  %s: %s\n", result.Entry.Cid, result.Error)
+		default:
+			fmt.Printf("OK      %s %v (%v) in %v\n", result.Entry.Cid, result.Size, humanize.IBytes(result.Size), result.Duration)
+		}
 	}
 }
@@ -0,0 +1,155 @@
+package filecoin
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	whypfs "github.com/application-research/whypfs-core"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	ipldformat "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/labstack/gommon/log"
+)
+
+// ProvideStrategy decides what is announced to the DHT after content is
+// retrieved from Filecoin
+type ProvideStrategy string
+
+const (
+	ProvideRoots ProvideStrategy = "roots"
+	ProvideAll   ProvideStrategy = "all"
+	ProvideNone  ProvideStrategy = "none"
+)
+
+func ParseProvideStrategy(s string) (ProvideStrategy, error) {
+	switch strategy := ProvideStrategy(s); strategy {
+	case ProvideRoots, ProvideAll, ProvideNone:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("unknown provide strategy '%s' (expected roots, all or none)", s)
+	}
+}
+
+var providedPrefix = datastore.NewKey("/wormhole/provided")
+
+func providedKey(root cid.Cid) datastore.Key {
+	return providedPrefix.ChildString(root.String())
+}
+
+// Provider announces content retrieved from Filecoin to the DHT so that IPFS
+// peers can fetch it from the node, and keeps announcing it on a schedule.
+type Provider struct {
+	node     *whypfs.Node
+	Strategy ProvideStrategy
+}
+
+func NewProvider(nd *whypfs.Node, strategy ProvideStrategy) *Provider {
+	return &Provider{
+		node:     nd,
+		Strategy: strategy,
+	}
+}
+
+// Provide records root for reproviding and announces it according to the
+// provide strategy
+func (p *Provider) Provide(ctx context.Context, root cid.Cid) error {
+	if p.Strategy == ProvideNone {
+		return nil
+	}
+
+	if err := p.node.Datastore.Put(ctx, providedKey(root), nil); err != nil {
+		return err
+	}
+
+	return p.announce(ctx, root)
+}
+
+// Reprovide announces all recorded roots again
+func (p *Provider) Reprovide(ctx context.Context) error {
+	if p.Strategy == ProvideNone {
+		return nil
+	}
+
+	res, err := p.node.Datastore.Query(ctx, query.Query{Prefix: providedPrefix.String(), KeysOnly: true})
+	if err != nil {
+		return err
+	}
+
+	entries, err := res.Rest()
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Reproviding %d retrieved roots", len(entries))
+
+	for _, entry := range entries {
+		root, err := cid.Decode(datastore.NewKey(entry.Key).BaseNamespace())
+		if err != nil {
+			log.Errorf("Skipping invalid provided root key %s: %v", entry.Key, err)
+			continue
+		}
+
+		if err := p.announce(ctx, root); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Errorf("Failed to reprovide %s: %v", root, err)
+		}
+	}
+
+	return nil
+}
+
+// Run reprovides every interval until ctx is done, never if interval isn't
+// positive
+func (p *Provider) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := p.Reprovide(ctx); err != nil {
+				log.Errorf("Reprovide failed: %v", err)
+			}
+		}
+	}
+}
+
+func (p *Provider) announce(ctx context.Context, root cid.Cid) error {
+	if p.Strategy != ProvideAll {
+		return p.node.Dht.Provide(ctx, root, true)
+	}
+
+	// Only walk what is available locally
+	dserv := merkledag.NewDAGService(blockservice.New(p.node.Blockstore, offline.Exchange(p.node.Blockstore)))
+
+	cset := cid.NewSet()
+	return merkledag.Walk(ctx, func(ctx context.Context, c cid.Cid) ([]*ipldformat.Link, error) {
+		if err := p.node.Dht.Provide(ctx, c, true); err != nil {
+			return nil, err
+		}
+
+		if c.Type() == cid.Raw {
+			return nil, nil
+		}
+
+		node, err := dserv.Get(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+
+		return node.Links(), nil
+	}, root, cset.Visit)
+}
@@ -0,0 +1,153 @@
+package filecoin
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+)
+
+// Stop looking for IPFS providers after this many were found
+const maxIPFSProviders = 20
+
+// How long to look for IPFS providers if the retriever has no QueryTimeout
+const ipfsLookupTimeout = 30 * time.Second
+
+// QueryRequest asks what retrieving Cid would cost
+type QueryRequest struct {
+	Cid cid.Cid `json:"cid"`
+
+	// Miners to query, the candidates are looked up if empty
+	Miners []address.Address `json:"miners,omitempty"`
+}
+
+// QueryResult is a candidate's answer with the price of a full retrieval
+type QueryResult struct {
+	CandidateQuery
+
+	TotalPrice abi.TokenAmount `json:"totalPrice,omitempty"`
+
+	// Set if the candidate asks for more than the retriever's MaxPrice
+	OverMaxPrice bool `json:"overMaxPrice,omitempty"`
+}
+
+// QueryReport compares the FIL candidates for a CID, best first, the way a
+// retrieval would try them
+type QueryReport struct {
+	Cid cid.Cid `json:"cid"`
+
+	AvailableOnIPFS bool `json:"availableOnIPFS"`
+
+	// IPFS providers with addresses that were found, at most
+	// maxIPFSProviders
+	IPFSProviders int `json:"ipfsProviders"`
+
+	Candidates []*QueryResult `json:"candidates"`
+}
+
+// Query asks every FIL candidate for req.Cid what a retrieval would cost and
+// checks the DHT for IPFS providers, without retrieving or paying anything.
+// The candidates are req.Miners, or else looked up with finder.
+func (r *Retriever) Query(ctx context.Context, req QueryRequest, finder CandidateFinder) (*QueryReport, error) {
+	var candidates []FILRetrievalCandidate
+	for _, miner := range req.Miners {
+		candidates = append(candidates, FILRetrievalCandidate{
+			Miner:   miner,
+			RootCid: req.Cid,
+		})
+	}
+
+	if len(candidates) == 0 {
+		if finder == nil {
+			return nil, xerrors.New("no miners were given and there is no candidates endpoint to look them up")
+		}
+
+		var err error
+		candidates, err = finder.FindCandidates(ctx, req.Cid)
+		if err != nil {
+			return nil, xerrors.Errorf("looking up candidates for %s: %w", req.Cid, err)
+		}
+	}
+
+	ipfsProviders := make(chan int, 1)
+	go func() {
+		ipfsProviders <- r.countIPFSProviders(ctx, req.Cid)
+	}()
+
+	attempt := &FILRetrievalAttempt{
+		Client:     r.FilClient,
+		Cid:        req.Cid,
+		Candidates: candidates,
+
+		QueryConcurrency: r.QueryConcurrency,
+		QueryTimeout:     r.QueryTimeout,
+		QueryCache:       r.QueryCache,
+	}
+
+	report := &QueryReport{Cid: req.Cid}
+	for _, query := range attempt.queryCandidates(ctx) {
+		res := &QueryResult{CandidateQuery: query}
+		if query.Response != nil {
+			res.TotalPrice = totalCost(query.Response)
+			res.OverMaxPrice = !r.MaxPrice.Nil() && res.TotalPrice.GreaterThan(r.MaxPrice)
+		}
+		report.Candidates = append(report.Candidates, res)
+	}
+	rankQueryResults(report.Candidates)
+
+	report.IPFSProviders = <-ipfsProviders
+	report.AvailableOnIPFS = report.IPFSProviders > 0
+
+	return report, ctx.Err()
+}
+
+// Order results by how a retrieval would try them: affordable available
+// answers first, then unavailable ones, then failed queries
+func rankQueryResults(results []*QueryResult) {
+	rank := func(res *QueryResult) int {
+		switch {
+		case res.Response == nil:
+			return 3
+		case res.Response.Status != retrievalmarket.QueryResponseAvailable:
+			return 2
+		case res.OverMaxPrice:
+			return 1
+		}
+		return 0
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if rank(a) != rank(b) {
+			return rank(a) < rank(b)
+		}
+		if a.Response == nil {
+			return false
+		}
+		return preferQuery(a.Response, b.Response)
+	})
+}
+
+// Count the DHT providers of c that have addresses
+func (r *Retriever) countIPFSProviders(ctx context.Context, c cid.Cid) int {
+	timeout := r.QueryTimeout
+	if timeout <= 0 {
+		timeout = ipfsLookupTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	count := 0
+	for provider := range r.Node.Dht.FindProvidersAsync(ctx, c, maxIPFSProviders) {
+		if len(provider.Addrs) > 0 {
+			count++
+		}
+	}
+
+	return count
+}
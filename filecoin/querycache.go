@@ -0,0 +1,130 @@
+package filecoin
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/labstack/gommon/log"
+)
+
+var queriesPrefix = datastore.NewKey("/wormhole/queries")
+
+func queryKey(miner address.Address, root cid.Cid) datastore.Key {
+	return queriesPrefix.ChildString(miner.String()).ChildString(root.String())
+}
+
+type cachedQuery struct {
+	Response *retrievalmarket.QueryResponse `json:"response"`
+	Fetched  time.Time                      `json:"fetched"`
+}
+
+// QueryCache keeps the retrieval query responses of storage providers in the
+// datastore for TTL, so that they aren't asked again for every retrieval
+type QueryCache struct {
+	ds  datastore.Batching
+	TTL time.Duration
+}
+
+func NewQueryCache(ds datastore.Batching, ttl time.Duration) *QueryCache {
+	return &QueryCache{ds: ds, TTL: ttl}
+}
+
+// Get returns the response miner gave for root, if it is younger than TTL
+func (qc *QueryCache) Get(ctx context.Context, miner address.Address, root cid.Cid) (*retrievalmarket.QueryResponse, bool) {
+	data, err := qc.ds.Get(ctx, queryKey(miner, root))
+	if err != nil {
+		if err != datastore.ErrNotFound {
+			log.Warnf("Could not read cached query of %s for %s: %v", miner, root, err)
+		}
+		return nil, false
+	}
+
+	var cached cachedQuery
+	if err := json.Unmarshal(data, &cached); err != nil {
+		log.Warnf("Could not decode cached query of %s for %s: %v", miner, root, err)
+		return nil, false
+	}
+
+	if time.Since(cached.Fetched) > qc.TTL {
+		if err := qc.ds.Delete(ctx, queryKey(miner, root)); err != nil {
+			log.Warnf("Could not delete expired query of %s for %s: %v", miner, root, err)
+		}
+		return nil, false
+	}
+
+	return cached.Response, true
+}
+
+func (qc *QueryCache) Put(ctx context.Context, miner address.Address, root cid.Cid, resp *retrievalmarket.QueryResponse) error {
+	data, err := json.Marshal(&cachedQuery{
+		Response: resp,
+		Fetched:  time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	return qc.ds.Put(ctx, queryKey(miner, root), data)
+}
+
+// Prune deletes the expired responses, returning how many there were
+func (qc *QueryCache) Prune(ctx context.Context) (int, error) {
+	res, err := qc.ds.Query(ctx, query.Query{Prefix: queriesPrefix.String()})
+	if err != nil {
+		return 0, err
+	}
+	defer res.Close()
+
+	var expired []datastore.Key
+	for r := range res.Next() {
+		if r.Error != nil {
+			return 0, r.Error
+		}
+
+		var cached cachedQuery
+		if err := json.Unmarshal(r.Value, &cached); err != nil || time.Since(cached.Fetched) > qc.TTL {
+			expired = append(expired, datastore.NewKey(r.Key))
+		}
+	}
+
+	for _, key := range expired {
+		if err := qc.ds.Delete(ctx, key); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(expired), qc.ds.Sync(ctx, queriesPrefix)
+}
+
+// Run prunes expired responses every TTL until ctx is done, never if TTL
+// isn't positive
+func (qc *QueryCache) Run(ctx context.Context) {
+	if qc.TTL <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(qc.TTL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			n, err := qc.Prune(ctx)
+			if err != nil {
+				log.Errorf("Pruning the query cache failed: %v", err)
+				continue
+			}
+			if n > 0 {
+				log.Debugf("Pruned %d expired queries", n)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package filecoin
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/chain/types"
+	"golang.org/x/xerrors"
+
+	"github.com/labstack/gommon/log"
+)
+
+// Renewer proposes a replacement for every active deal RenewBefore epochs
+// before it ends, with the same duration and verified status. The miner
+// holding the deal is asked first, then Miners in order. Roots with a
+// replication policy are left to the Replicator.
+type Renewer struct {
+	retriever *Retriever
+	policies  *PolicyStore
+
+	RenewBefore abi.ChainEpoch
+
+	// Alternatives to the miner holding a deal
+	Miners []address.Address
+
+	// Most to pay per GiB per epoch, no limit if nil
+	MaxPrice *abi.TokenAmount
+
+	// Most all renewals may cost together, no limit if nil
+	Budget *abi.TokenAmount
+
+	// How often expiring deals are looked for
+	Interval time.Duration
+}
+
+func NewRenewer(r *Retriever, policies *PolicyStore, renewBefore abi.ChainEpoch) *Renewer {
+	return &Renewer{
+		retriever:   r,
+		policies:    policies,
+		RenewBefore: renewBefore,
+		Interval:    time.Hour,
+	}
+}
+
+// Run renews expiring deals every Interval until ctx is done, never if
+// Interval isn't positive
+func (rn *Renewer) Run(ctx context.Context) {
+	if rn.Interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(rn.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := rn.RenewAll(ctx); err != nil {
+			log.Errorf("Renewing deals failed: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// RenewAll renews the deals that are due, a failing renewal not stopping the
+// others
+func (rn *Renewer) RenewAll(ctx context.Context) error {
+	r := rn.retriever
+
+	head, err := r.Chain.ChainHead(ctx)
+	if err != nil {
+		return xerrors.Errorf("getting chain head: %w", err)
+	}
+
+	deals, err := r.Deals.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	byID := make(map[uint64]*Deal)
+	spent := big.Zero()
+	for _, deal := range deals {
+		byID[deal.ID] = deal
+		if deal.RenewalOf != 0 && !dealFailed(deal) {
+			spent = big.Add(spent, deal.TotalPrice)
+		}
+	}
+
+	for _, deal := range deals {
+		if deal.Status != storagemarket.StorageDealActive || deal.EndEpoch-head.Height() > rn.RenewBefore {
+			continue
+		}
+
+		// A renewal that failed is tried again
+		if renewal, ok := byID[deal.RenewedBy]; ok && !dealFailed(renewal) {
+			continue
+		}
+
+		if _, err := rn.policies.Get(ctx, deal.Cid); err == nil {
+			continue
+		}
+
+		renewal, err := rn.renew(ctx, deal, spent)
+		if err != nil {
+			log.Warnf("Renewing deal %d for %s failed: %v", deal.ID, deal.Cid, err)
+			continue
+		}
+		spent = big.Add(spent, renewal.TotalPrice)
+	}
+
+	return nil
+}
+
+func (rn *Renewer) renew(ctx context.Context, deal *Deal, spent abi.TokenAmount) (*Deal, error) {
+	r := rn.retriever
+
+	duration := deal.EndEpoch - deal.StartEpoch
+	if duration < MinDealDuration {
+		duration = MinDealDuration
+	}
+	if duration > MaxDealDuration {
+		duration = MaxDealDuration
+	}
+
+	miners := []address.Address{deal.Miner}
+	for _, miner := range rn.Miners {
+		if miner != deal.Miner {
+			miners = append(miners, miner)
+		}
+	}
+
+	for _, ask := range r.QueryAsks(ctx, miners) {
+		if ask.Ask == nil {
+			log.Debugf("Not renewing deal %d with %s: %s", deal.ID, ask.Miner, ask.Error)
+			continue
+		}
+
+		price := ask.Ask.Price
+		if deal.Verified {
+			price = ask.Ask.VerifiedPrice
+		}
+		if rn.MaxPrice != nil && price.GreaterThan(*rn.MaxPrice) {
+			log.Debugf("Not renewing deal %d with %s: asks %s, more than %s", deal.ID, ask.Miner, types.FIL(price), types.FIL(*rn.MaxPrice))
+			continue
+		}
+
+		// The piece is the same as before, unless the miner pads it more
+		size := deal.PieceSize
+		if size < ask.Ask.MinPieceSize {
+			size = ask.Ask.MinPieceSize
+		}
+		cost := big.Div(big.Mul(big.Mul(big.NewInt(int64(size)), price), big.NewInt(int64(duration))), big.NewInt(1<<30))
+		if rn.Budget != nil && big.Add(spent, cost).GreaterThan(*rn.Budget) {
+			log.Warnf("Not renewing deal %d with %s: %s would exceed the renewal budget of %s, %s of which is spent", deal.ID, ask.Miner, types.FIL(cost), types.FIL(*rn.Budget), types.FIL(spent))
+			continue
+		}
+
+		renewal, err := r.MakeDeal(ctx, DealRequest{
+			Cid:           deal.Cid,
+			Miner:         ask.Miner,
+			Duration:      duration,
+			Price:         &price,
+			Verified:      deal.Verified,
+			FastRetrieval: deal.FastRetrieval,
+		})
+		if renewal != nil {
+			if err := rn.link(ctx, deal, renewal); err != nil {
+				return nil, err
+			}
+		}
+		if err != nil {
+			log.Warnf("Renewing deal %d with %s failed: %v", deal.ID, ask.Miner, err)
+			continue
+		}
+
+		log.Infof("Renewed deal %d for %s with deal %d with %s", deal.ID, deal.Cid, renewal.ID, ask.Miner)
+		return renewal, nil
+	}
+
+	return nil, fmt.Errorf("no miner took the renewal")
+}
+
+// Record that renewal replaces deal
+func (rn *Renewer) link(ctx context.Context, deal, renewal *Deal) error {
+	renewal.RenewalOf = deal.ID
+	if _, err := rn.retriever.Deals.Modify(ctx, renewal.ID, func(d *Deal) {
+		d.RenewalOf = deal.ID
+	}); err != nil {
+		return err
+	}
+
+	deal.RenewedBy = renewal.ID
+	_, err := rn.retriever.Deals.Modify(ctx, deal.ID, func(d *Deal) {
+		d.RenewedBy = renewal.ID
+	})
+
+	return err
+}
+
+// Whether a deal ended without being paid for
+func dealFailed(deal *Deal) bool {
+	return deal.Finished() &&
+		deal.Status != storagemarket.StorageDealExpired &&
+		deal.Status != storagemarket.StorageDealSlashed
+}
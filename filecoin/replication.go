@@ -0,0 +1,421 @@
+package filecoin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/labstack/gommon/log"
+	"golang.org/x/xerrors"
+)
+
+var ErrPolicyNotFound = fmt.Errorf("replication policy not found")
+
+var policiesPrefix = datastore.NewKey("/wormhole/replication")
+
+// ReplicationPolicy is how many storage deals a pinned root should have
+type ReplicationPolicy struct {
+	Cid cid.Cid `json:"cid"`
+
+	// Number of deals to keep, each with a different miner
+	Deals int `json:"deals"`
+
+	// Miners new deals may be made with, in no particular order, minus the
+	// excluded ones
+	Miners        []address.Address `json:"miners"`
+	ExcludeMiners []address.Address `json:"excludeMiners,omitempty"`
+
+	// Most to pay per GiB per epoch, no limit if nil
+	MaxPrice *abi.TokenAmount `json:"maxPrice,omitempty"`
+
+	VerifiedOnly bool `json:"verifiedOnly,omitempty"`
+
+	// Deals with fewer epochs left don't count towards Deals
+	MinRemaining abi.ChainEpoch `json:"minRemaining,omitempty"`
+
+	// Length of new deals
+	Duration abi.ChainEpoch `json:"duration"`
+
+	FastRetrieval bool `json:"fastRetrieval,omitempty"`
+}
+
+// PolicyStore keeps the replication policies of pins in the node's datastore
+type PolicyStore struct {
+	ds datastore.Batching
+}
+
+func NewPolicyStore(ds datastore.Batching) *PolicyStore {
+	return &PolicyStore{ds: ds}
+}
+
+func policyKey(c cid.Cid) datastore.Key {
+	return policiesPrefix.ChildString(c.String())
+}
+
+// Set replaces the policy of policy.Cid
+func (ps *PolicyStore) Set(ctx context.Context, policy *ReplicationPolicy) error {
+	if policy.Deals < 1 {
+		return fmt.Errorf("a policy needs at least one deal")
+	}
+	if len(policy.Miners) < policy.Deals {
+		return fmt.Errorf("%d deals need at least as many miners, %d were given", policy.Deals, len(policy.Miners))
+	}
+	if policy.Duration < MinDealDuration || policy.Duration > MaxDealDuration {
+		return fmt.Errorf("deal duration of %d epochs is not between %d and %d", policy.Duration, MinDealDuration, MaxDealDuration)
+	}
+
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+
+	if err := ps.ds.Put(ctx, policyKey(policy.Cid), data); err != nil {
+		return err
+	}
+
+	return ps.ds.Sync(ctx, policiesPrefix)
+}
+
+func (ps *PolicyStore) Get(ctx context.Context, c cid.Cid) (*ReplicationPolicy, error) {
+	data, err := ps.ds.Get(ctx, policyKey(c))
+	if err != nil {
+		if err == datastore.ErrNotFound {
+			return nil, ErrPolicyNotFound
+		}
+		return nil, err
+	}
+
+	var policy ReplicationPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, xerrors.Errorf("could not decode policy of %s: %w", c, err)
+	}
+
+	return &policy, nil
+}
+
+func (ps *PolicyStore) Remove(ctx context.Context, c cid.Cid) error {
+	if _, err := ps.Get(ctx, c); err != nil {
+		return err
+	}
+
+	if err := ps.ds.Delete(ctx, policyKey(c)); err != nil {
+		return err
+	}
+
+	return ps.ds.Sync(ctx, policiesPrefix)
+}
+
+func (ps *PolicyStore) List(ctx context.Context) ([]*ReplicationPolicy, error) {
+	res, err := ps.ds.Query(ctx, query.Query{Prefix: policiesPrefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	var policies []*ReplicationPolicy
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+
+		var policy ReplicationPolicy
+		if err := json.Unmarshal(r.Value, &policy); err != nil {
+			return nil, xerrors.Errorf("could not decode policy %s: %w", r.Key, err)
+		}
+
+		policies = append(policies, &policy)
+	}
+
+	return policies, nil
+}
+
+// Replicator makes deals until every pin with a replication policy has the
+// deals it asks for. Deals that fail, get slashed, expire or come too close
+// to expiring are replaced.
+type Replicator struct {
+	retriever *Retriever
+	policies  *PolicyStore
+
+	// How often the policies are reconciled
+	Interval time.Duration
+
+	// How long a miner is left alone for a root after a deal for it failed,
+	// doubling with each further failure up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Deals that failed before being recorded in the deal store
+	failuresLk sync.Mutex
+	failures   map[replicaKey]*replicaFailures
+}
+
+type replicaKey struct {
+	cid   cid.Cid
+	miner address.Address
+}
+
+type replicaFailures struct {
+	count int
+	last  time.Time
+}
+
+func NewReplicator(r *Retriever, policies *PolicyStore) *Replicator {
+	return &Replicator{
+		retriever:  r,
+		policies:   policies,
+		Interval:   10 * time.Minute,
+		Backoff:    time.Hour,
+		MaxBackoff: 7 * 24 * time.Hour,
+		failures:   make(map[replicaKey]*replicaFailures),
+	}
+}
+
+// Run reconciles the policies every Interval until ctx is done, never if
+// Interval isn't positive
+func (rep *Replicator) Run(ctx context.Context) {
+	if rep.Interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(rep.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := rep.ReconcileAll(ctx); err != nil {
+			log.Errorf("Reconciling replication policies failed: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ReconcileAll reconciles every policy, a failing one not stopping the others
+func (rep *Replicator) ReconcileAll(ctx context.Context) error {
+	policies, err := rep.policies.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, policy := range policies {
+		if err := rep.Reconcile(ctx, policy); err != nil {
+			log.Warnf("Replicating %s failed: %v", policy.Cid, err)
+		}
+	}
+
+	return nil
+}
+
+// Reconcile makes the deals policy is missing, if its root is pinned
+func (rep *Replicator) Reconcile(ctx context.Context, policy *ReplicationPolicy) error {
+	r := rep.retriever
+
+	if _, err := r.Pins.Get(ctx, policy.Cid); err != nil {
+		if err == ErrPinNotFound {
+			log.Debugf("Not replicating %s, it isn't pinned", policy.Cid)
+			return nil
+		}
+		return err
+	}
+
+	head, err := r.Chain.ChainHead(ctx)
+	if err != nil {
+		return xerrors.Errorf("getting chain head: %w", err)
+	}
+
+	deals, err := r.Deals.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Miners holding a deal that counts, or that is still in progress, and
+	// miners deals failed with
+	holding := make(map[address.Address]bool)
+	failed := rep.unrecordedFailures(policy.Cid)
+	for _, deal := range deals {
+		switch {
+		case deal.Cid != policy.Cid:
+		case deal.Finished():
+			if deal.Status != storagemarket.StorageDealExpired {
+				f, ok := failed[deal.Miner]
+				if !ok {
+					f = &replicaFailures{}
+					failed[deal.Miner] = f
+				}
+				f.count++
+				if deal.Updated.After(f.last) {
+					f.last = deal.Updated
+				}
+			}
+		case deal.EndEpoch-head.Height() >= policy.MinRemaining:
+			holding[deal.Miner] = true
+		}
+	}
+
+	missing := policy.Deals - len(holding)
+	if missing <= 0 {
+		return nil
+	}
+
+	miners := rep.candidates(policy, holding)
+	if len(miners) == 0 {
+		return fmt.Errorf("%d more deals are needed, but no allowed miner is left", missing)
+	}
+
+	ready := miners[:0]
+	for _, miner := range miners {
+		if wait := rep.backoff(failed[miner]); wait > 0 {
+			log.Debugf("Skipping %s for %s: %d deals failed, trying again in %s", miner, policy.Cid, failed[miner].count, wait.Round(time.Minute))
+			continue
+		}
+		ready = append(ready, miner)
+	}
+	miners = ready
+	if len(miners) == 0 {
+		return fmt.Errorf("%d more deals are needed, but deals with all allowed miners failed recently", missing)
+	}
+
+	log.Infof("Replicating %s: %d of %d deals, asking %d miners", policy.Cid, len(holding), policy.Deals, len(miners))
+
+	asks := r.QueryAsks(ctx, miners)
+	if policy.VerifiedOnly {
+		SortAsks(asks, AskSortVerifiedPrice)
+	} else {
+		SortAsks(asks, AskSortPrice)
+	}
+
+	// Give miners that failed before another chance only after the others
+	sort.SliceStable(asks, func(i, j int) bool {
+		return failed[asks[i].Miner] == nil && failed[asks[j].Miner] != nil
+	})
+
+	for _, ask := range asks {
+		if missing == 0 {
+			break
+		}
+		if ask.Ask == nil {
+			log.Debugf("Skipping %s for %s: %s", ask.Miner, policy.Cid, ask.Error)
+			continue
+		}
+
+		price := ask.Ask.Price
+		if policy.VerifiedOnly {
+			price = ask.Ask.VerifiedPrice
+		}
+		if policy.MaxPrice != nil && price.GreaterThan(*policy.MaxPrice) {
+			log.Debugf("Skipping %s for %s: asks %s, more than %s", ask.Miner, policy.Cid, types.FIL(price), types.FIL(*policy.MaxPrice))
+			continue
+		}
+
+		deal, err := r.MakeDeal(ctx, DealRequest{
+			Cid:           policy.Cid,
+			Miner:         ask.Miner,
+			Duration:      policy.Duration,
+			Price:         &price,
+			Verified:      policy.VerifiedOnly,
+			FastRetrieval: policy.FastRetrieval,
+		})
+		if err != nil {
+			log.Warnf("Deal for %s with %s failed: %v", policy.Cid, ask.Miner, err)
+			// Failed proposals are in the deal store already
+			if deal == nil {
+				rep.recordFailure(policy.Cid, ask.Miner)
+			}
+			continue
+		}
+
+		log.Infof("Made deal %d for %s with %s", deal.ID, policy.Cid, ask.Miner)
+		rep.clearFailures(policy.Cid, ask.Miner)
+		missing--
+	}
+
+	if missing > 0 {
+		return fmt.Errorf("%d deals are still missing", missing)
+	}
+
+	return nil
+}
+
+// How much longer to leave a miner alone after its deals failed
+func (rep *Replicator) backoff(f *replicaFailures) time.Duration {
+	if f == nil || f.count == 0 {
+		return 0
+	}
+
+	wait := rep.Backoff
+	for i := 1; i < f.count && wait < rep.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if rep.MaxBackoff > 0 && wait > rep.MaxBackoff {
+		wait = rep.MaxBackoff
+	}
+
+	return time.Until(f.last.Add(wait))
+}
+
+// Copies of the failures not in the deal store for root, by miner
+func (rep *Replicator) unrecordedFailures(root cid.Cid) map[address.Address]*replicaFailures {
+	rep.failuresLk.Lock()
+	defer rep.failuresLk.Unlock()
+
+	failed := make(map[address.Address]*replicaFailures)
+	for key, f := range rep.failures {
+		if key.cid == root {
+			cpy := *f
+			failed[key.miner] = &cpy
+		}
+	}
+
+	return failed
+}
+
+func (rep *Replicator) recordFailure(root cid.Cid, miner address.Address) {
+	rep.failuresLk.Lock()
+	defer rep.failuresLk.Unlock()
+
+	key := replicaKey{cid: root, miner: miner}
+	f, ok := rep.failures[key]
+	if !ok {
+		f = &replicaFailures{}
+		rep.failures[key] = f
+	}
+	f.count++
+	f.last = time.Now()
+}
+
+func (rep *Replicator) clearFailures(root cid.Cid, miner address.Address) {
+	rep.failuresLk.Lock()
+	defer rep.failuresLk.Unlock()
+
+	delete(rep.failures, replicaKey{cid: root, miner: miner})
+}
+
+// The allowed miners without a deal for the policy's root
+func (rep *Replicator) candidates(policy *ReplicationPolicy, holding map[address.Address]bool) []address.Address {
+	excluded := make(map[address.Address]bool)
+	for _, miner := range policy.ExcludeMiners {
+		excluded[miner] = true
+	}
+
+	var miners []address.Address
+	for _, miner := range policy.Miners {
+		if !holding[miner] && !excluded[miner] {
+			miners = append(miners, miner)
+		}
+	}
+
+	return miners
+}
@@ -0,0 +1,156 @@
+package filecoin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/api/client"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/wallet"
+	"golang.org/x/xerrors"
+)
+
+// Token sent to a remote signer
+const SignerTokenEnv = "WORMHOLE_SIGNER_TOKEN"
+
+var (
+	ErrSignerUnavailable = errors.New("wallet signer unavailable")
+
+	// filclient signs retrieval vouchers and deal proposals with a
+	// *wallet.LocalWallet of its own and its payment channel manager can't be
+	// swapped, so it can't use any other signer for them
+	ErrSignerNotLocal = errors.New("Filecoin retrievals and deals need a local wallet, the configured signer can only be used to settle and collect payment channels")
+)
+
+// Signer holds the wallet's keys and signs with them. It is the lotus wallet
+// API, implemented by a local wallet as well as by a remote lotus-wallet.
+type Signer interface {
+	api.Wallet
+}
+
+// How long a signer may take to answer before it is considered unavailable
+const signerTimeout = 10 * time.Second
+
+// NewRemoteSigner connects to a lotus-wallet style JSON-RPC signer at url,
+// authenticating with token if one is given
+func NewRemoteSigner(ctx context.Context, url string, token string) (Signer, func(), error) {
+	header := http.Header{}
+	if token != "" {
+		header.Add("Authorization", "Bearer "+token)
+	}
+
+	signer, closer, err := client.NewWalletRPCV0(ctx, url, header)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("%w: %v", ErrSignerUnavailable, err)
+	}
+
+	return signer, closer, nil
+}
+
+// NewMemorySigner is a signer keeping its keys in memory only, a stand-in for
+// a remote signer in tests and local setups
+func NewMemorySigner() (*wallet.LocalWallet, error) {
+	return wallet.NewWallet(wallet.NewMemKeyStore())
+}
+
+// CheckSigner makes sure signer is reachable and holds the key of addr
+func CheckSigner(ctx context.Context, signer Signer, addr address.Address) error {
+	ctx, cancel := context.WithTimeout(ctx, signerTimeout)
+	defer cancel()
+
+	has, err := signer.WalletHas(ctx, addr)
+	if err != nil {
+		return xerrors.Errorf("%w: %v", ErrSignerUnavailable, err)
+	}
+	if !has {
+		return fmt.Errorf("the wallet signer doesn't hold the key of %s", addr)
+	}
+
+	return nil
+}
+
+// Pushes messages signed by a Signer, picking the nonce and estimating gas the
+// same way filclient's MsgPusher does for a local wallet
+type signerPusher struct {
+	gw     Chain
+	signer Signer
+
+	lk     sync.Mutex
+	nonces map[address.Address]uint64
+}
+
+func newSignerPusher(gw Chain, signer Signer) *signerPusher {
+	return &signerPusher{
+		gw:     gw,
+		signer: signer,
+		nonces: make(map[address.Address]uint64),
+	}
+}
+
+func (sp *signerPusher) MpoolPushMessage(ctx context.Context, msg *types.Message, maxFee *api.MessageSendSpec) (*types.SignedMessage, error) {
+	sp.lk.Lock()
+	defer sp.lk.Unlock()
+
+	kaddr, err := sp.gw.StateAccountKey(ctx, msg.From, types.EmptyTSK)
+	if err != nil {
+		return nil, err
+	}
+
+	n, ok := sp.nonces[kaddr]
+	if !ok {
+		act, err := sp.gw.StateGetActor(ctx, kaddr, types.EmptyTSK)
+		if err != nil {
+			return nil, err
+		}
+
+		n = act.Nonce
+	}
+
+	msg.Nonce = n
+
+	estim, err := sp.gw.GasEstimateMessageGas(ctx, msg, &api.MessageSendSpec{}, types.EmptyTSK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to estimate gas: %w", err)
+	}
+
+	estim.GasFeeCap = abi.NewTokenAmount(4000000000)
+	estim.GasPremium = big.Mul(estim.GasPremium, big.NewInt(2))
+
+	// Remote signers check the message they are signing against Extra
+	serialized, err := estim.Serialize()
+	if err != nil {
+		return nil, err
+	}
+
+	signCtx, cancel := context.WithTimeout(ctx, signerTimeout)
+	defer cancel()
+
+	sig, err := sp.signer.WalletSign(signCtx, kaddr, estim.Cid().Bytes(), api.MsgMeta{
+		Type:  api.MTChainMsg,
+		Extra: serialized,
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("%w: %v", ErrSignerUnavailable, err)
+	}
+
+	smsg := &types.SignedMessage{
+		Message:   *estim,
+		Signature: *sig,
+	}
+
+	if _, err := sp.gw.MpoolPush(ctx, smsg); err != nil {
+		return nil, err
+	}
+
+	sp.nonces[kaddr] = n + 1
+
+	return smsg, nil
+}
@@ -0,0 +1,117 @@
+package filecoin
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/wallet"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+)
+
+// OpenWallet opens the wallet retrievals are paid from, without creating an
+// address if it is empty
+func OpenWallet() (*wallet.LocalWallet, error) {
+	ddir, err := ddir()
+	if err != nil {
+		return nil, err
+	}
+
+	kstore, err := openKeystore(ddir)
+	if err != nil {
+		return nil, err
+	}
+
+	return wallet.NewWallet(kstore)
+}
+
+func ParseKeyType(s string) (types.KeyType, error) {
+	switch typ := types.KeyType(strings.ToLower(s)); typ {
+	case types.KTSecp256k1, types.KTBLS:
+		return typ, nil
+	default:
+		return "", fmt.Errorf("unknown key type '%s' (expected secp256k1 or bls)", s)
+	}
+}
+
+// ExportKey exports the key of addr in the hex encoded format of
+// 'lotus wallet export'
+func ExportKey(ctx context.Context, wal *wallet.LocalWallet, addr address.Address) (string, error) {
+	ki, err := wal.WalletExport(ctx, addr)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(ki)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(data), nil
+}
+
+// ImportKey imports a key exported with 'lotus wallet export' or ExportKey
+func ImportKey(ctx context.Context, wal *wallet.LocalWallet, exported string) (address.Address, error) {
+	data, err := hex.DecodeString(strings.TrimSpace(exported))
+	if err != nil {
+		return address.Undef, xerrors.Errorf("key is not hex encoded: %w", err)
+	}
+
+	var ki types.KeyInfo
+	if err := json.Unmarshal(data, &ki); err != nil {
+		return address.Undef, xerrors.Errorf("could not decode key: %w", err)
+	}
+
+	return wal.WalletImport(ctx, &ki)
+}
+
+// Balance looks up the balance of addr on chain. Addresses that were never
+// funded have no actor yet and a zero balance.
+func Balance(ctx context.Context, gw Chain, addr address.Address) (abi.TokenAmount, error) {
+	act, err := gw.StateGetActor(ctx, addr, types.EmptyTSK)
+	if err != nil {
+		if strings.Contains(err.Error(), "actor not found") {
+			return big.Zero(), nil
+		}
+		return big.Zero(), err
+	}
+
+	return act.Balance, nil
+}
+
+// Send pushes a message transferring amount from one of the wallet's
+// addresses to another address, returning the message CID
+func Send(ctx context.Context, gw Chain, signer Signer, from, to address.Address, amount abi.TokenAmount) (cid.Cid, error) {
+	if err := CheckSigner(ctx, signer, from); err != nil {
+		return cid.Undef, err
+	}
+
+	smsg, err := newSignerPusher(gw, signer).MpoolPushMessage(ctx, &types.Message{
+		From:  from,
+		To:    to,
+		Value: amount,
+	}, nil)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	return smsg.Cid(), nil
+}
+
+// EncryptWallet migrates the plaintext wallet keystore to an encrypted one,
+// returning the number of keys migrated
+func EncryptWallet(passphrase []byte) (int, error) {
+	ddir, err := ddir()
+	if err != nil {
+		return 0, err
+	}
+
+	return MigrateKeystore(ddir, passphrase)
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/jlogelin/wormhole/config"
+	fc "github.com/jlogelin/wormhole/filecoin"
+)
+
+var flagConfig = &cli.StringFlag{
+	Name:    "config",
+	Usage:   "config file to use instead of config.toml in the wormhole directory",
+	EnvVars: []string{config.ConfigEnv},
+}
+
+var flagChain = &cli.StringFlag{
+	Name:  "chain",
+	Usage: "network profile to use [mainnet|calibration|<profile defined in the config>]",
+}
+
+var flagMaxPrice = &cli.StringFlag{
+	Name:  "max-price",
+	Usage: "most a single Filecoin retrieval may cost in FIL, providers asking for more are skipped",
+}
+
+var flagMiners = &cli.StringSliceFlag{
+	Name:    "miners",
+	Aliases: []string{"miner", "m"},
+}
+
+var flagOutput = &cli.StringFlag{
+	Name:    "output",
+	Aliases: []string{"o"},
+}
+
+var flagNetwork = &cli.StringFlag{
+	Name:        "network",
+	Aliases:     []string{"n"},
+	Usage:       "which network to retrieve from [fil|ipfs|auto]",
+	DefaultText: fc.NetworkAuto,
+	Value:       fc.NetworkAuto,
+}
+
+var flagDmPathSel = &cli.StringFlag{
+	Name:  "datamodel-path-selector",
+	Usage: "a rudimentary (DM-level-only) text-path selector, allowing for sub-selection within a deal",
+}
+
+var flagBatch = &cli.StringFlag{
+	Name:  "batch",
+	Usage: "retrieve every entry of a manifest file (.txt, .csv or .json) instead of a single CID",
+}
+
+var flagConcurrency = &cli.IntFlag{
+	Name:    "concurrency",
+	Aliases: []string{"c"},
+	Usage:   "number of batch entries to retrieve at the same time",
+	Value:   4,
+}
+
+var flagResume = &cli.BoolFlag{
+	Name:  "resume",
+	Usage: "skip batch entries that were already retrieved by a previous run of the manifest",
+}
+
+var flagReport = &cli.StringFlag{
+	Name:  "report",
+	Usage: "write the batch summary report as JSON to this file",
+}
+
+var flagWorkers = &cli.IntFlag{
+	Name:  "workers",
+	Usage: "number of retrieval jobs to process at the same time",
+	Value: 2,
+}
+
+var flagPriority = &cli.IntFlag{
+	Name:  "priority",
+	Usage: "jobs with a higher priority are processed first",
+}
+
+var flagAPIListen = &cli.StringFlag{
+	Name:  "api",
+	Usage: "address to serve the local control API on",
+	Value: "127.0.0.1:6747",
+}
+
+var flagGatewayListen = &cli.StringFlag{
+	Name:  "gateway",
+	Usage: "address to serve the /ipfs/ HTTP gateway on, empty to disable it",
+	Value: "127.0.0.1:8080",
+}
+
+var flagGatewayFilecoin = &cli.BoolFlag{
+	Name:  "gateway-filecoin",
+	Usage: "let gateway requests retrieve missing content from Filecoin, spending FIL, instead of only over IPFS",
+}
+
+var flagFallbackBlockstore = &cli.BoolFlag{
+	Name:  "fallback-blockstore",
+	Usage: "retrieve blocks other peers want that are missing from the blockstore from Filecoin, within --fallback-remote-budget (and for gateway reads with --gateway-filecoin)",
+}
+
+var flagFallbackRemoteBudget = &cli.StringFlag{
+	Name:  "fallback-remote-budget",
+	Usage: "most the fallback retrievals of blocks other peers want may cost together per daemon run (e.g. 0.1 FIL), empty to never retrieve for them",
+}
+
+var flagFallbackRemoteRate = &cli.IntFlag{
+	Name:  "fallback-remote-rate",
+	Usage: "most fallback lookups of blocks other peers want per hour, 0 for no limit",
+	Value: 10,
+}
+
+var flagCandidatesEndpoint = &cli.StringFlag{
+	Name:  "candidates-endpoint",
+	Usage: "HTTP endpoint used to look up retrieval candidates for a CID",
+	Value: "https://api.estuary.tech/retrieval-candidates",
+}
+
+var flagProvide = &cli.StringFlag{
+	Name:  "provide",
+	Usage: "what to announce to the DHT after a Filecoin retrieval [roots|all|none]",
+	Value: string(fc.ProvideRoots),
+}
+
+var flagReprovideInterval = &cli.DurationFlag{
+	Name:  "reprovide-interval",
+	Usage: "how often to announce content retrieved from Filecoin again, 0 to never",
+	Value: 12 * time.Hour,
+}
+
+var flagCacheSize = &cli.StringFlag{
+	Name:  "cache-size",
+	Usage: "maximum size of the retrieved content kept in the blockstore (e.g. 50GiB), 0 for no limit",
+	Value: "0",
+}
+
+var flagCachePolicy = &cli.StringFlag{
+	Name:  "cache-policy",
+	Usage: "which retrieved content to evict first [lru|lfu]",
+	Value: string(fc.CacheLRU),
+}
+
+var flagGCInterval = &cli.DurationFlag{
+	Name:  "gc-interval",
+	Usage: "how often to check whether the cache is above its high watermark, 0 to never",
+	Value: 10 * time.Minute,
+}
+
+var flagGCTarget = &cli.StringFlag{
+	Name:  "target",
+	Usage: "size to shrink the cached content to (e.g. 10GiB), 0 to evict all retrieved content that isn't pinned",
+	Value: "0",
+}
+
+var flagPin = &cli.BoolFlag{
+	Name:  "pin",
+	Usage: "pin the retrieved root so that cache GC never evicts it",
+}
+
+var flagPinName = &cli.StringFlag{
+	Name:  "name",
+	Usage: "name to record with the pin",
+}
+
+var flagPinDirect = &cli.BoolFlag{
+	Name:  "direct",
+	Usage: "only pin the root block instead of the whole DAG",
+}
+
+var flagPinType = &cli.StringFlag{
+	Name:  "type",
+	Usage: "only list pins of this type [recursive|direct]",
+}
+
+var flagAll = &cli.BoolFlag{
+	Name:  "all",
+	Usage: "apply to every channel it is possible for",
+}
+
+var flagKeyType = &cli.StringFlag{
+	Name:  "type",
+	Usage: "type of key to create [secp256k1|bls]",
+	Value: "secp256k1",
+}
+
+var flagFrom = &cli.StringFlag{
+	Name:  "from",
+	Usage: "address to send from, the default one if not set",
+}
+
+var flagSigner = &cli.StringFlag{
+	Name:  "signer",
+	Usage: "URL of a lotus-wallet JSON-RPC signer to send funds and settle and collect payment channels with instead of the local wallet, authenticated with $" + fc.SignerTokenEnv + ". Filecoin retrievals and deals still need the local wallet.",
+}
+
+var flagSignerAddress = &cli.StringFlag{
+	Name:  "signer-address",
+	Usage: "address the remote signer signs for",
+}
+
+var flagWait = &cli.BoolFlag{
+	Name:  "wait",
+	Usage: "wait for the message to land on chain",
+}
+
+var flagJSON = &cli.BoolFlag{
+	Name:  "json",
+	Usage: "print the output as JSON",
+}
+
+var flagVerbose = &cli.BoolFlag{
+	Name:    "verbose",
+	Aliases: []string{"v"},
+	Usage:   "also print the full answer of every provider",
+}
+
+var flagDealMiner = &cli.StringFlag{
+	Name:     "miner",
+	Aliases:  []string{"m"},
+	Usage:    "storage provider to make the deal with",
+	Required: true,
+}
+
+var flagDealDuration = &cli.IntFlag{
+	Name:  "duration",
+	Usage: "length of the deal in days",
+	Value: 180,
+}
+
+var flagDealPrice = &cli.StringFlag{
+	Name:  "price",
+	Usage: "price in FIL per GiB per epoch, the provider's ask by default",
+}
+
+var flagVerified = &cli.BoolFlag{
+	Name:  "verified",
+	Usage: "make a verified deal, paid for with datacap",
+}
+
+var flagFastRetrieval = &cli.BoolFlag{
+	Name:  "fast-retrieval",
+	Usage: "ask the provider to keep an unsealed copy for retrievals",
+	Value: true,
+}
+
+var flagAskSort = &cli.StringFlag{
+	Name:  "sort",
+	Usage: "what to sort the asks by [price|verified-price|min-size|max-size|latency]",
+	Value: string(fc.AskSortPrice),
+}
+
+var flagReplicas = &cli.IntFlag{
+	Name:  "deals",
+	Usage: "number of deals to keep, each with a different miner",
+	Value: 1,
+}
+
+var flagExcludeMiners = &cli.StringSliceFlag{
+	Name:  "exclude",
+	Usage: "miners never to make deals with",
+}
+
+var flagStorageMaxPrice = &cli.StringFlag{
+	Name:  "max-price",
+	Usage: "most to pay in FIL per GiB per epoch, no limit by default",
+}
+
+var flagVerifiedOnly = &cli.BoolFlag{
+	Name:  "verified-only",
+	Usage: "only make verified deals",
+}
+
+var flagMinRemaining = &cli.IntFlag{
+	Name:  "min-remaining",
+	Usage: "days a deal must have left to count, it is replaced before",
+	Value: 30,
+}
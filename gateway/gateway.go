@@ -0,0 +1,366 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"os"
+	gopath "path"
+	"strings"
+	"time"
+
+	whypfs "github.com/application-research/whypfs-core"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	ipldformat "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	ufsio "github.com/ipfs/go-unixfs/io"
+	"github.com/ipld/go-car"
+	"github.com/labstack/gommon/log"
+	"golang.org/x/sync/singleflight"
+
+	fc "github.com/jlogelin/wormhole/filecoin"
+)
+
+const immutableCacheControl = "public, max-age=29030400, immutable"
+
+// Gateway is a read-through /ipfs/<cid>/<path> HTTP gateway. Content that
+// isn't completely in the node's blockstore is fetched with the retriever
+// before being served.
+type Gateway struct {
+	Node      *whypfs.Node
+	Retriever *fc.Retriever
+
+	// Where content is read from, the node's blockstore unless set to a
+	// FallbackBlockstore that retrieves missing blocks
+	Blockstore blockstore.Blockstore
+
+	// Network retrievals triggered by requests use. Any web page can make
+	// the browser request content from the gateway, so only IPFS is used
+	// unless Filecoin retrievals are opted into.
+	Network string
+
+	// How long a retrieval triggered by a request may take
+	RetrievalTimeout time.Duration
+
+	// Deduplicates concurrent retrievals of the same root
+	fetches singleflight.Group
+}
+
+func New(nd *whypfs.Node, r *fc.Retriever) *Gateway {
+	return &Gateway{
+		Node:             nd,
+		Retriever:        r,
+		Blockstore:       nd.Blockstore,
+		Network:          fc.NetworkIPFS,
+		RetrievalTimeout: 30 * time.Minute,
+	}
+}
+
+// Serve runs the gateway on listenAddr until ctx is done
+func (gw *Gateway) Serve(ctx context.Context, listenAddr string) error {
+	srv := &http.Server{
+		Addr:    listenAddr,
+		Handler: gw,
+	}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	log.Infof("Gateway listening on %s", listenAddr)
+
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func (gw *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !strings.HasPrefix(r.URL.Path, "/ipfs/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	rootStr, subPath, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/ipfs/"), "/")
+	root, err := cid.Decode(rootStr)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid CID '%s': %v", rootStr, err), http.StatusBadRequest)
+		return
+	}
+
+	if err := gw.ensureLocal(r.Context(), root); err != nil {
+		http.Error(w, fmt.Sprintf("failed to retrieve %s: %v", root, err), http.StatusBadGateway)
+		return
+	}
+
+	if gw.Retriever.Cache != nil {
+		if err := gw.Retriever.Cache.Touch(r.Context(), root); err != nil {
+			log.Errorf("Failed to record access to %s: %v", root, err)
+		}
+	}
+
+	dserv := merkledag.NewDAGService(blockservice.New(gw.Blockstore, offline.Exchange(gw.Blockstore)))
+
+	nd, err := resolvePath(r.Context(), dserv, root, subPath)
+	if err != nil {
+		if errors.Is(err, errNoLink) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	etag := `"` + nd.Cid().String() + `"`
+	format := responseFormat(r)
+	if format != "" {
+		etag = `"` + nd.Cid().String() + "." + format + `"`
+	}
+
+	w.Header().Set("Etag", etag)
+	w.Header().Set("Cache-Control", immutableCacheControl)
+	w.Header().Set("X-Ipfs-Path", r.URL.Path)
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" && inm == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	switch format {
+	case "raw":
+		gw.serveRaw(w, r, nd)
+	case "car":
+		gw.serveCar(w, r, dserv, nd)
+	case "":
+		gw.serveUnixFS(w, r, dserv, nd, subPath)
+	default:
+		http.Error(w, fmt.Sprintf("unsupported format '%s'", format), http.StatusBadRequest)
+	}
+}
+
+// Make sure the whole DAG under root is in the blockstore, retrieving it if
+// it isn't, so that responses aren't cut short by a missing block. Only one
+// retrieval per root runs at a time.
+func (gw *Gateway) ensureLocal(ctx context.Context, root cid.Cid) error {
+	has, err := hasDAG(ctx, gw.Blockstore, root)
+	if err != nil {
+		return err
+	}
+	if has {
+		return nil
+	}
+
+	ch := gw.fetches.DoChan(root.KeyString(), func() (interface{}, error) {
+		// Not tied to the request, other requests may be waiting on the
+		// same retrieval
+		ctx, cancel := context.WithTimeout(context.Background(), gw.RetrievalTimeout)
+		defer cancel()
+
+		log.Infof("Gateway miss for %s, retrieving", root)
+
+		return gw.Retriever.Retrieve(ctx, fc.GetRequest{
+			Cid:     root,
+			Network: gw.Network,
+		})
+	})
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case res := <-ch:
+		return res.Err
+	}
+}
+
+// Whether bs holds every block of the DAG under root
+func hasDAG(ctx context.Context, bs blockstore.Blockstore, root cid.Cid) (bool, error) {
+	dserv := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+
+	complete := true
+	err := merkledag.Walk(ctx, func(ctx context.Context, c cid.Cid) ([]*ipldformat.Link, error) {
+		nd, err := dserv.Get(ctx, c)
+		if err != nil {
+			if ipldformat.IsNotFound(err) {
+				complete = false
+				return nil, nil
+			}
+			return nil, err
+		}
+		return nd.Links(), nil
+	}, root, cid.NewSet().Visit)
+
+	return complete, err
+}
+
+func (gw *Gateway) serveRaw(w http.ResponseWriter, r *http.Request, nd ipldformat.Node) {
+	w.Header().Set("Content-Type", "application/vnd.ipld.raw")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.bin"`, nd.Cid()))
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(nd.RawData()))
+}
+
+func (gw *Gateway) serveCar(w http.ResponseWriter, r *http.Request, dserv ipldformat.DAGService, nd ipldformat.Node) {
+	w.Header().Set("Content-Type", "application/vnd.ipld.car; version=1")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.car"`, nd.Cid()))
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	if err := car.WriteCar(r.Context(), dserv, []cid.Cid{nd.Cid()}, w); err != nil {
+		// Headers are already out, all we can do is cut the response short
+		log.Errorf("Failed to write CAR for %s: %v", nd.Cid(), err)
+	}
+}
+
+func (gw *Gateway) serveUnixFS(w http.ResponseWriter, r *http.Request, dserv ipldformat.DAGService, nd ipldformat.Node, subPath string) {
+	dir, err := ufsio.NewDirectoryFromNode(dserv, nd)
+	switch {
+	case err == ufsio.ErrNotADir:
+		gw.serveFile(w, r, dserv, nd, gopath.Base("/"+subPath))
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		gw.serveDirectory(w, r, dserv, dir)
+	}
+}
+
+func (gw *Gateway) serveFile(w http.ResponseWriter, r *http.Request, dserv ipldformat.DAGService, nd ipldformat.Node, name string) {
+	dr, err := ufsio.NewDagReader(r.Context(), nd, dserv)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer dr.Close()
+
+	if ctype := mime.TypeByExtension(gopath.Ext(name)); ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+
+	// ServeContent handles range requests and sniffs the content type if it
+	// couldn't be told from the name
+	http.ServeContent(w, r, name, time.Time{}, dr)
+}
+
+func (gw *Gateway) serveDirectory(w http.ResponseWriter, r *http.Request, dserv ipldformat.DAGService, dir ufsio.Directory) {
+	// Directories are only served with a trailing slash so that relative links
+	// in listings and index pages resolve
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	if index, err := dir.Find(r.Context(), "index.html"); err == nil {
+		gw.serveFile(w, r, dserv, index, "index.html")
+		return
+	}
+
+	links, err := dir.Links(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	listing := directoryListing{Path: r.URL.Path}
+	for _, l := range links {
+		listing.Entries = append(listing.Entries, directoryEntry{
+			Name: l.Name,
+			Cid:  l.Cid.String(),
+			Size: l.Size,
+		})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	if err := listingTemplate.Execute(w, listing); err != nil {
+		log.Errorf("Failed to render directory listing for %s: %v", r.URL.Path, err)
+	}
+}
+
+var errNoLink = errors.New("no link named")
+
+// Walk the UnixFS path from root, one directory entry at a time
+func resolvePath(ctx context.Context, dserv ipldformat.DAGService, root cid.Cid, subPath string) (ipldformat.Node, error) {
+	nd, err := dserv.Get(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range strings.Split(subPath, "/") {
+		if name == "" {
+			continue
+		}
+
+		dir, err := ufsio.NewDirectoryFromNode(dserv, nd)
+		if err != nil {
+			return nil, fmt.Errorf("%w '%s' under %s", errNoLink, name, nd.Cid())
+		}
+
+		nd, err = dir.Find(ctx, name)
+		if err != nil {
+			if err == os.ErrNotExist {
+				return nil, fmt.Errorf("%w '%s' under %s", errNoLink, name, root)
+			}
+			return nil, err
+		}
+	}
+
+	return nd, nil
+}
+
+// The requested response format, from the format query parameter or the
+// Accept header
+func responseFormat(r *http.Request) string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format
+	}
+
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.HasPrefix(accept, "application/vnd.ipld.raw"):
+		return "raw"
+	case strings.HasPrefix(accept, "application/vnd.ipld.car"):
+		return "car"
+	}
+	return ""
+}
+
+type directoryEntry struct {
+	Name string
+	Cid  string
+	Size uint64
+}
+
+type directoryListing struct {
+	Path    string
+	Entries []directoryEntry
+}
+
+var listingTemplate = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{ .Path }}</title></head>
+<body>
+<h1>Index of {{ .Path }}</h1>
+<table>
+<tr><th>Name</th><th>CID</th><th>Size</th></tr>
+{{ range .Entries }}<tr><td><a href="{{ .Name }}">{{ .Name }}</a></td><td>{{ .Cid }}</td><td>{{ .Size }}</td></tr>
+{{ end }}</table>
+</body>
+</html>
+`))
@@ -0,0 +1,239 @@
+// Package harness runs several whypfs nodes in process, connected over
+// loopback TCP and sharing a private DHT, so that IPFS retrievals can be
+// exercised without internet access.
+package harness
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	whypfs "github.com/application-research/whypfs-core"
+	"github.com/ipfs/go-bitswap"
+	bsnet "github.com/ipfs/go-bitswap/network"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	ipldformat "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/xerrors"
+)
+
+// Keeps the harness DHT apart from the public IPFS one
+const dhtPrefix = "/wormhole-harness"
+
+// Network is a set of whypfs nodes that all know each other
+type Network struct {
+	Nodes []*whypfs.Node
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	dir    string
+}
+
+// New starts n nodes with their repos in dir, a new temporary directory if
+// dir is empty, and connects every node to every other one
+func New(ctx context.Context, n int, dir string) (*Network, error) {
+	if dir == "" {
+		var err error
+		dir, err = os.MkdirTemp("", "wormhole-harness")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	net := &Network{ctx: ctx, cancel: cancel, dir: dir}
+
+	for i := 0; i < n; i++ {
+		if _, err := net.AddNode(); err != nil {
+			net.Close()
+			return nil, err
+		}
+	}
+
+	return net, nil
+}
+
+// AddNode starts another node and connects it to all the running ones
+func (net *Network) AddNode() (*whypfs.Node, error) {
+	repo := filepath.Join(net.dir, fmt.Sprintf("node%d", len(net.Nodes)))
+
+	nd, err := whypfs.NewNode(whypfs.NewNodeParams{
+		Ctx:  net.ctx,
+		Repo: repo,
+		Config: &whypfs.Config{
+			Libp2pKeyFile: filepath.Join(repo, "libp2p.key"),
+			ListenAddrs:   []string{"/ip4/127.0.0.1/tcp/0"},
+			DatastoreDir: struct {
+				Directory string
+				Options   leveldb.Options
+			}{
+				Directory: filepath.Join(repo, "datastore"),
+			},
+			NoLimiter: true,
+			// No reproviding, Provide announces what the tests need
+			ReprovideInterval: -1,
+			ConnectionManagerConfig: whypfs.ConnectionManager{
+				HighWater: 100,
+				LowWater:  50,
+			},
+		},
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("starting node %d: %w", len(net.Nodes), err)
+	}
+
+	if err := privateRouting(net.ctx, nd); err != nil {
+		return nil, err
+	}
+
+	for _, other := range net.Nodes {
+		if err := nd.Host.Connect(net.ctx, peer.AddrInfo{ID: other.Host.ID(), Addrs: other.Host.Addrs()}); err != nil {
+			return nil, xerrors.Errorf("connecting to %s: %w", other.Host.ID(), err)
+		}
+	}
+
+	net.Nodes = append(net.Nodes, nd)
+
+	if err := net.waitForRouting(nd); err != nil {
+		return nil, err
+	}
+
+	return nd, nil
+}
+
+// Replace the node's DHT with a server mode one on the harness protocol, and
+// rebuild Bitswap on top of it. Loopback only nodes would otherwise stay DHT
+// clients, which never answer provider lookups. The routing whypfs started
+// is closed first, Bitswap's protocol handlers are registered again.
+func privateRouting(ctx context.Context, nd *whypfs.Node) error {
+	if err := nd.Bitswap.Close(); err != nil {
+		return xerrors.Errorf("closing Bitswap: %w", err)
+	}
+	if err := nd.Dht.Close(); err != nil {
+		return xerrors.Errorf("closing DHT: %w", err)
+	}
+	if err := nd.FullRt.Close(); err != nil {
+		return xerrors.Errorf("closing full routing table: %w", err)
+	}
+
+	d, err := dht.New(ctx, nd.Host,
+		dht.Mode(dht.ModeServer),
+		dht.ProtocolPrefix(dhtPrefix),
+		dht.Datastore(nd.Datastore),
+		dht.BootstrapPeers(),
+	)
+	if err != nil {
+		return xerrors.Errorf("constructing DHT: %w", err)
+	}
+
+	bswap := bitswap.New(ctx, bsnet.NewFromIpfsHost(nd.Host, d), nd.Blockstore)
+
+	nd.Dht = d
+	nd.Bitswap = bswap
+	nd.Exchange = bswap
+	nd.Blockservice = blockservice.New(nd.Blockstore, bswap)
+	nd.DAGService = merkledag.NewDAGService(nd.Blockservice)
+
+	return nil
+}
+
+// Wait until nd's routing table holds every other node, so that provider
+// records reach all of them
+func (net *Network) waitForRouting(nd *whypfs.Node) error {
+	ctx, cancel := context.WithTimeout(net.ctx, 10*time.Second)
+	defer cancel()
+
+	for nd.Dht.RoutingTable().Size() < len(net.Nodes)-1 {
+		select {
+		case <-time.After(50 * time.Millisecond):
+		case <-ctx.Done():
+			return xerrors.Errorf("waiting for %s to see %d peers: %w", nd.Host.ID(), len(net.Nodes)-1, ctx.Err())
+		}
+	}
+
+	return nil
+}
+
+// Add imports data as a UnixFS file on node i without announcing it
+func (net *Network) Add(ctx context.Context, i int, data []byte) (cid.Cid, error) {
+	nd, err := net.Nodes[i].AddPinFile(ctx, bytes.NewReader(data), nil)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	return nd.Cid(), nil
+}
+
+// Provide announces on node i's DHT that it holds c
+func (net *Network) Provide(ctx context.Context, i int, c cid.Cid) error {
+	return net.Nodes[i].Dht.Provide(ctx, c, true)
+}
+
+// AddAndProvide adds data on node i and announces its root
+func (net *Network) AddAndProvide(ctx context.Context, i int, data []byte) (cid.Cid, error) {
+	c, err := net.Add(ctx, i, data)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	if err := net.Provide(ctx, i, c); err != nil {
+		return cid.Undef, err
+	}
+
+	return c, nil
+}
+
+// Has tells whether node i holds every block of the DAG under c, without
+// fetching anything
+func (net *Network) Has(ctx context.Context, i int, c cid.Cid) (bool, error) {
+	bs := net.Nodes[i].Blockstore
+	dserv := merkledag.NewDAGService(blockservice.New(bs, nil))
+
+	complete := true
+	err := merkledag.Walk(ctx, func(ctx context.Context, c cid.Cid) ([]*ipldformat.Link, error) {
+		has, err := bs.Has(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		if !has {
+			complete = false
+			return nil, nil
+		}
+
+		return merkledag.GetLinksDirect(dserv)(ctx, c)
+	}, c, cid.NewSet().Visit)
+
+	return complete, err
+}
+
+// Stop shuts node i down, its provider records staying behind in the other
+// nodes' DHTs
+func (net *Network) Stop(i int) error {
+	nd := net.Nodes[i]
+
+	if err := nd.Dht.Close(); err != nil {
+		return err
+	}
+
+	return nd.Host.Close()
+}
+
+// Close stops all nodes and removes their repos
+func (net *Network) Close() error {
+	net.cancel()
+
+	for _, nd := range net.Nodes {
+		nd.Dht.Close()
+		nd.Host.Close()
+		nd.Datastore.Close()
+	}
+
+	return os.RemoveAll(net.dir)
+}
@@ -0,0 +1,115 @@
+package harness
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+
+	fc "github.com/jlogelin/wormhole/filecoin"
+)
+
+func newNetwork(t *testing.T, n int) *Network {
+	t.Helper()
+
+	net, err := New(context.Background(), n, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { net.Close() })
+
+	return net
+}
+
+// Enough random data for a DAG of several blocks
+func testData(t *testing.T) []byte {
+	t.Helper()
+
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	return data
+}
+
+func TestRetrieveFromProvider(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	net := newNetwork(t, 2)
+
+	c, err := net.AddAndProvide(ctx, 0, testData(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var progress []uint64
+	stats, err := fc.RetrieveFromBestCandidate(net.Nodes[1], ctx, []fc.GetAttempt{
+		&fc.IPFSRetrievalAttempt{
+			Cid: c,
+			OnProgress: func(bytesReceived uint64) {
+				progress = append(progress, bytesReceived)
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("retrieval failed: %v", err)
+	}
+	if stats.GetByteSize() == 0 {
+		t.Error("retrieval reported no bytes")
+	}
+
+	if len(progress) < 2 {
+		t.Fatalf("progress reported %d times for a DAG of several blocks", len(progress))
+	}
+	for i := 1; i < len(progress); i++ {
+		if progress[i] <= progress[i-1] {
+			t.Errorf("progress went from %d to %d bytes", progress[i-1], progress[i])
+		}
+	}
+	if last := progress[len(progress)-1]; last != stats.GetByteSize() {
+		t.Errorf("last progress %d bytes, retrieval reported %d", last, stats.GetByteSize())
+	}
+
+	has, err := net.Has(ctx, 1, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !has {
+		t.Error("node 1 doesn't hold the whole DAG after retrieving it")
+	}
+}
+
+func TestRetrieveFromStaleProvider(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	net := newNetwork(t, 2)
+
+	c, err := net.AddAndProvide(ctx, 0, testData(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := net.Stop(0); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fc.RetrieveFromBestCandidate(net.Nodes[1], ctx, []fc.GetAttempt{
+		&fc.IPFSRetrievalAttempt{Cid: c},
+	})
+	if err == nil {
+		t.Fatal("retrieval from a stopped provider succeeded")
+	}
+	if ctx.Err() != nil {
+		t.Fatal("retrieval from a stopped provider didn't give up")
+	}
+
+	// Only looks at node 1's blockstore, no need to wait on the network
+	has, err := net.Has(context.Background(), 1, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if has {
+		t.Error("node 1 holds the DAG of a stopped provider")
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	"github.com/urfave/cli/v2"
+
+	"github.com/jlogelin/wormhole/api"
+	fc "github.com/jlogelin/wormhole/filecoin"
+)
+
+var jobCmd = &cli.Command{
+	Name:  "job",
+	Usage: "Manage the daemon's retrieval job queue",
+	Subcommands: []*cli.Command{
+		jobAddCmd,
+		jobListCmd,
+		jobStatusCmd,
+		jobCancelCmd,
+	},
+}
+
+var jobAddCmd = &cli.Command{
+	Name:      "add",
+	Usage:     "Queue a retrieval job",
+	ArgsUsage: "<cid>",
+	Flags: []cli.Flag{
+		flagMiners,
+		flagOutput,
+		flagNetwork,
+		flagDmPathSel,
+		flagPin,
+		flagPriority,
+	},
+	Action: func(cctx *cli.Context) error {
+		req, err := parseGetRequest(cctx)
+		if err != nil {
+			return err
+		}
+
+		queue, closer, err := openJobs(cctx.Context)
+		if err != nil {
+			return err
+		}
+		defer closer()
+
+		job, err := queue.Enqueue(cctx.Context, req, cctx.Int(flagPriority.Name))
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Queued job %d\n", job.ID)
+
+		return nil
+	},
+}
+
+var jobListCmd = &cli.Command{
+	Name:      "list",
+	Usage:     "List retrieval jobs",
+	ArgsUsage: " ",
+	Action: func(cctx *cli.Context) error {
+		queue, closer, err := openJobs(cctx.Context)
+		if err != nil {
+			return err
+		}
+		defer closer()
+
+		jobs, err := queue.List(cctx.Context)
+		if err != nil {
+			return err
+		}
+
+		printJobs(jobs)
+
+		return nil
+	},
+}
+
+var jobStatusCmd = &cli.Command{
+	Name:      "status",
+	Usage:     "Show a retrieval job",
+	ArgsUsage: "<job id>",
+	Action: func(cctx *cli.Context) error {
+		id, err := parseJobID(cctx)
+		if err != nil {
+			return err
+		}
+
+		queue, closer, err := openJobs(cctx.Context)
+		if err != nil {
+			return err
+		}
+		defer closer()
+
+		job, err := queue.Get(cctx.Context, id)
+		if err != nil {
+			return err
+		}
+
+		return printJSON(job)
+	},
+}
+
+var jobCancelCmd = &cli.Command{
+	Name:      "cancel",
+	Usage:     "Cancel a queued or running retrieval job",
+	ArgsUsage: "<job id>",
+	Action: func(cctx *cli.Context) error {
+		id, err := parseJobID(cctx)
+		if err != nil {
+			return err
+		}
+
+		queue, closer, err := openJobs(cctx.Context)
+		if err != nil {
+			return err
+		}
+		defer closer()
+
+		if err := queue.Cancel(cctx.Context, id); err != nil {
+			return err
+		}
+
+		fmt.Printf("Cancelled job %d\n", id)
+
+		return nil
+	},
+}
+
+// The job operations shared by the daemon API client and a job queue opened
+// directly on the datastore.
+type jobService interface {
+	Enqueue(ctx context.Context, req fc.GetRequest, priority int) (*fc.Job, error)
+	List(ctx context.Context) ([]*fc.Job, error)
+	Get(ctx context.Context, id uint64) (*fc.Job, error)
+	Cancel(ctx context.Context, id uint64) error
+}
+
+// Talk to the running daemon if there is one, otherwise open the job queue
+// directly on the datastore. Jobs queued while the daemon isn't running are
+// picked up the next time it starts.
+func openJobs(ctx context.Context) (jobService, func(), error) {
+	client, err := dialDaemon(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if client != nil {
+		return &apiJobs{client: client}, func() {}, nil
+	}
+
+	ds, err := leveldb.NewDatastore(cfg.Node.DatastoreDir, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not open datastore: %w", err)
+	}
+
+	return fc.NewJobQueue(ds, nil, 0), func() { ds.Close() }, nil
+}
+
+type apiJobs struct {
+	client *api.Client
+}
+
+func (j *apiJobs) Enqueue(ctx context.Context, req fc.GetRequest, priority int) (*fc.Job, error) {
+	return j.client.SubmitJob(ctx, req, priority)
+}
+
+func (j *apiJobs) List(ctx context.Context) ([]*fc.Job, error) {
+	return j.client.ListJobs(ctx)
+}
+
+func (j *apiJobs) Get(ctx context.Context, id uint64) (*fc.Job, error) {
+	return j.client.GetJob(ctx, id)
+}
+
+func (j *apiJobs) Cancel(ctx context.Context, id uint64) error {
+	_, err := j.client.CancelJob(ctx, id)
+	return err
+}
+
+func printJobs(jobs []*fc.Job) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "ID\tPRIORITY\tSTATE\tCID\tUPDATED\tERROR\n")
+	for _, job := range jobs {
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\t%s\n",
+			job.ID,
+			job.Priority,
+			job.State,
+			job.Request.Cid,
+			job.Updated.Format(time.RFC3339),
+			job.Error,
+		)
+	}
+	w.Flush()
+}
+
+func printJSON(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(data))
+
+	return nil
+}
@@ -1,31 +1,63 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"fmt"
-	"io"
 	"os"
 	"os/signal"
 	"syscall"
 
 	whypfs "github.com/application-research/whypfs-core"
-	"github.com/ipfs/go-cid"
 	leveldb "github.com/ipfs/go-ds-leveldb"
-	fc "github.com/jlogelin/wormhole/filecoin"
+	"github.com/urfave/cli/v2"
+
+	"github.com/jlogelin/wormhole/config"
 )
 
 var (
 	// OsSignal signal used to shutdown
 	OsSignal chan os.Signal
 	node     *whypfs.Node
+	cfg      *config.Config
+	profile  config.Profile
+
+	// File in the wormhole directory the daemon records its API address in
+	// while it is running
+	apiFile string
 )
 
 func main() {
 	OsSignal = make(chan os.Signal, 1)
-	BootstrapWhyPFS()
-	playtime()
-	LoopForever()
+
+	app := cli.NewApp()
+	app.Name = "wormhole"
+	app.Usage = "WhyPFS node backed by the Filecoin Graphsync Protocol"
+	app.Flags = []cli.Flag{
+		flagConfig,
+		flagChain,
+	}
+	app.Before = loadConfig
+	app.Commands = []*cli.Command{
+		initCmd,
+		daemonCmd,
+		getCmd,
+		queryCmd,
+		jobCmd,
+		pinCmd,
+		paychCmd,
+		walletCmd,
+		addCmd,
+		dealCmd,
+		stagingCmd,
+		askCmd,
+		infoCmd,
+		gcCmd,
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 }
 
 // LoopForever on signal processing
@@ -43,97 +75,40 @@ func BootstrapWhyPFS() {
 	n, err := whypfs.NewNode(
 		whypfs.NewNodeParams{
 			Ctx: context.Background(),
+			// whypfs keeps its flatfs blockstore in <repo>/blocks, whatever
+			// Config.Blockstore says
+			Repo: cfg.Node.Repo,
 			Config: &whypfs.Config{
-				Libp2pKeyFile: "libp2p.key",
-				ListenAddrs:   []string{"/ip4/0.0.0.0/tcp/6746"},
-				AnnounceAddrs: nil,
+				Libp2pKeyFile: cfg.Node.Libp2pKeyFile,
+				ListenAddrs:   cfg.Node.ListenAddrs,
+				AnnounceAddrs: cfg.Node.AnnounceAddrs,
 				DatastoreDir: struct {
 					Directory string
 					Options   leveldb.Options
 				}{
-					Directory: "datastore",
+					Directory: cfg.Node.DatastoreDir,
 					Options:   leveldb.Options{},
 				},
-				Blockstore:        ":flatfs:.whypfs/blocks",
 				NoBlockstoreCache: false,
-				NoLimiter:         true,
 				BitswapConfig: whypfs.BitswapConfig{
-					MaxOutstandingBytesPerPeer: 20 << 20,
-					TargetMessageSize:          2 << 20,
+					MaxOutstandingBytesPerPeer: int64(cfg.Node.BitswapMaxOutstandingBytesPerPeer),
+					TargetMessageSize:          int(cfg.Node.BitswapTargetMessageSize),
 				},
 				ConnectionManagerConfig: whypfs.ConnectionManager{},
 			},
 		})
 	check(err)
 
-	n.BootstrapPeers(whypfs.DefaultBootstrapPeers())
+	peers, err := profile.AddrInfos()
 	check(err)
 
+	n.BootstrapPeers(peers)
+
 	fmt.Printf("Using peer ID: %s \n", n.Host.ID())
 
 	node = n
 }
 
-func playtime() {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	/*
-		c1, _ := cid.Decode("QmbJGGJkjGfYCmHqwoMjLTbUA6bdcFBbNdWChFY6dKNRWx")
-		rsc1, err := node.GetFile(ctx, c1)
-		if err != nil {
-			panic(err)
-		}
-		defer rsc1.Close()
-		content1, err := io.ReadAll(rsc1)
-		if err != nil {
-			panic(err)
-		}
-
-		fmt.Println(string(content1))
-
-	*/
-
-	file, err := node.AddPinFile(context.Background(), bytes.NewReader([]byte("lodgewasheresfdsfdfsdfsd!")), nil)
-	if err != nil {
-		return
-	}
-
-	test, err := node.GetFile(ctx, file.Cid())
-	check(err)
-	defer test.Close()
-	cont1, err := io.ReadAll(test)
-	check(err)
-	fmt.Println("File CID: ", file.Cid().String())
-	ff, err := os.Create(file.Cid().String())
-	check(err)
-	nn2, err := ff.Write(cont1)
-	check(err)
-	fmt.Printf("wrote %d bytes\n", nn2)
-
-	cidStr := "bafybeibyzkigxj527gw7iq5jz6mkd2xgcxhny3ukmvrkrn3vvqpiqiuohe"
-	// cidStr := "bafkreif25pcqu5wo24bf3bxeybbq2snehcqd5nx2ar5b2eez6gey2lwt5q"
-
-	network := fc.NetworkAuto
-	// network := NetworkIPFS
-	err = fc.Get(node, cidStr, network, "", []string{"f010088"})
-	check(err)
-
-	c1, _ := cid.Decode(cidStr)
-	rsc1, err := node.GetFile(ctx, c1)
-	check(err)
-	defer rsc1.Close()
-	content1, err := io.ReadAll(rsc1)
-	check(err)
-
-	f, err := os.Create(cidStr)
-	check(err)
-	n2, err := f.Write(content1)
-	check(err)
-	fmt.Printf("wrote %d bytes\n", n2)
-
-	//fmt.Println(string(content1))
-}
-
 func check(e error) {
 	if e != nil {
 		panic(e)
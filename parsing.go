@@ -0,0 +1,335 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	"github.com/urfave/cli/v2"
+
+	fc "github.com/jlogelin/wormhole/filecoin"
+)
+
+// Split any comma-separated elements of a multi flag list of miners.
+func splitMiners(minerStringsRaw []string) []string {
+	var minerStrings []string
+	for _, raw := range minerStringsRaw {
+		minerStrings = append(minerStrings, strings.Split(raw, ",")...)
+	}
+
+	return minerStrings
+}
+
+// Read a comma-separated or multi flag list of miners from the CLI.
+func parseMiners(cctx *cli.Context) ([]address.Address, error) {
+	var miners []address.Address
+	for _, ms := range splitMiners(cctx.StringSlice(flagMiners.Name)) {
+
+		miner, err := address.NewFromString(ms)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse miner %s: %w", ms, err)
+		}
+
+		miners = append(miners, miner)
+	}
+
+	return miners, nil
+}
+
+// Get the destination file to write the output to, erroring if it can't be
+// written. This early error check is important because you don't want to do
+// a bunch of work, only to end up crashing when you try to write the file.
+func parseOutput(cctx *cli.Context) (string, error) {
+	path := cctx.String(flagOutput.Name)
+	if path == "" {
+		return "", nil
+	}
+
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		return "", fmt.Errorf("output location '%s' is a directory", path)
+	}
+
+	if _, err := os.Stat(filepath.Dir(path)); err != nil {
+		return "", fmt.Errorf("invalid output location '%s': %w", path, err)
+	}
+
+	return path, nil
+}
+
+func parseJobID(cctx *cli.Context) (uint64, error) {
+	if !cctx.Args().Present() {
+		return 0, fmt.Errorf("please specify a job ID")
+	}
+
+	id, err := strconv.ParseUint(cctx.Args().First(), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid job ID '%s'", cctx.Args().First())
+	}
+
+	return id, nil
+}
+
+func parseDealID(cctx *cli.Context) (uint64, error) {
+	if !cctx.Args().Present() {
+		return 0, fmt.Errorf("please specify a deal ID")
+	}
+
+	id, err := strconv.ParseUint(cctx.Args().First(), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid deal ID '%s'", cctx.Args().First())
+	}
+
+	return id, nil
+}
+
+// Build a retrieval request from the CID argument and the get flags.
+func parseGetRequest(cctx *cli.Context) (fc.GetRequest, error) {
+	cidStr := cctx.Args().First()
+	if cidStr == "" {
+		return fc.GetRequest{}, fmt.Errorf("please specify a CID to retrieve")
+	}
+
+	c, err := cid.Decode(cidStr)
+	if err != nil {
+		return fc.GetRequest{}, err
+	}
+
+	miners, err := parseMiners(cctx)
+	if err != nil {
+		return fc.GetRequest{}, err
+	}
+
+	output, err := parseOutput(cctx)
+	if err != nil {
+		return fc.GetRequest{}, err
+	}
+
+	return fc.GetRequest{
+		Cid:      c,
+		Network:  parseNetwork(cctx),
+		Selector: cctx.String(flagDmPathSel.Name),
+		Miners:   miners,
+		Output:   output,
+		Pin:      cctx.Bool(flagPin.Name),
+	}, nil
+}
+
+func parseProvider(cctx *cli.Context) (*fc.Provider, error) {
+	strategy, err := fc.ParseProvideStrategy(cctx.String(flagProvide.Name))
+	if err != nil {
+		return nil, err
+	}
+
+	return fc.NewProvider(node, strategy), nil
+}
+
+func parseSize(cctx *cli.Context, flag *cli.StringFlag) (int64, error) {
+	size, err := humanize.ParseBytes(cctx.String(flag.Name))
+	if err != nil {
+		return 0, fmt.Errorf("invalid --%s: %w", flag.Name, err)
+	}
+
+	return int64(size), nil
+}
+
+func parseCache(cctx *cli.Context, pins *fc.Pinset) (*fc.Cache, error) {
+	policy, err := fc.ParseCachePolicy(cctx.String(flagCachePolicy.Name))
+	if err != nil {
+		return nil, err
+	}
+
+	maxSize, err := parseSize(cctx, flagCacheSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return fc.NewCache(node.Datastore, node.Blockstore, pins, policy, maxSize), nil
+}
+
+func parseCidArg(cctx *cli.Context) (cid.Cid, error) {
+	if !cctx.Args().Present() {
+		return cid.Undef, fmt.Errorf("please specify a CID")
+	}
+
+	c, err := cid.Decode(cctx.Args().First())
+	if err != nil {
+		return cid.Undef, fmt.Errorf("invalid CID '%s': %w", cctx.Args().First(), err)
+	}
+
+	return c, nil
+}
+
+func parseChannelArg(cctx *cli.Context) (address.Address, error) {
+	if !cctx.Args().Present() {
+		return address.Undef, fmt.Errorf("please specify a payment channel address")
+	}
+
+	ch, err := address.NewFromString(cctx.Args().First())
+	if err != nil {
+		return address.Undef, fmt.Errorf("invalid channel address '%s': %w", cctx.Args().First(), err)
+	}
+
+	return ch, nil
+}
+
+func parseAddressArg(cctx *cli.Context, n int) (address.Address, error) {
+	arg := strings.TrimSpace(cctx.Args().Get(n))
+	if arg == "" {
+		return address.Undef, fmt.Errorf("please specify an address")
+	}
+
+	addr, err := address.NewFromString(arg)
+	if err != nil {
+		return address.Undef, fmt.Errorf("invalid address '%s': %w", arg, err)
+	}
+
+	return addr, nil
+}
+
+// Set up a retriever paying from the local wallet, or from a remote signer
+// with --signer
+func parseRetriever(cctx *cli.Context) (*fc.Retriever, func(), error) {
+	maxPrice, err := parseMaxPrice(cctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r, closer, err := newRetriever(cctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	r.MaxPrice = maxPrice
+	r.QueryConcurrency = cfg.Retrieval.QueryConcurrency
+	r.QueryTimeout = time.Duration(cfg.Retrieval.QueryTimeout)
+	if ttl := time.Duration(cfg.Retrieval.QueryCacheTTL); ttl > 0 {
+		r.QueryCache = fc.NewQueryCache(node.Datastore, ttl)
+	}
+
+	return r, closer, nil
+}
+
+func parseMaxPrice(cctx *cli.Context) (abi.TokenAmount, error) {
+	s := cctx.String(flagMaxPrice.Name)
+	if s == "" {
+		return abi.TokenAmount{}, nil
+	}
+
+	price, err := types.ParseFIL(s)
+	if err != nil {
+		return abi.TokenAmount{}, fmt.Errorf("invalid --%s '%s': %w", flagMaxPrice.Name, s, err)
+	}
+
+	return abi.TokenAmount(price), nil
+}
+
+func newRetriever(cctx *cli.Context) (*fc.Retriever, func(), error) {
+	if !cctx.IsSet(flagSigner.Name) {
+		r, err := fc.NewRetriever(node)
+		if err != nil {
+			return nil, nil, err
+		}
+		return r, r.Close, nil
+	}
+
+	if !cctx.IsSet(flagSignerAddress.Name) {
+		return nil, nil, fmt.Errorf("--%s needs --%s", flagSigner.Name, flagSignerAddress.Name)
+	}
+
+	addr, err := address.NewFromString(cctx.String(flagSignerAddress.Name))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid --%s: %w", flagSignerAddress.Name, err)
+	}
+
+	signer, signerCloser, err := fc.NewRemoteSigner(cctx.Context, cctx.String(flagSigner.Name), os.Getenv(fc.SignerTokenEnv))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r, err := fc.NewRetrieverWithSigner(cctx.Context, node, signer, addr)
+	if err != nil {
+		signerCloser()
+		return nil, nil, err
+	}
+
+	return r, func() {
+		r.Close()
+		signerCloser()
+	}, nil
+}
+
+// The candidate finder of the candidates endpoint, nil if there is none
+func parseCandidateFinder(cctx *cli.Context) fc.CandidateFinder {
+	endpoint := cctx.String(flagCandidatesEndpoint.Name)
+	if endpoint == "" {
+		return nil
+	}
+
+	return fc.EndpointCandidateFinder(endpoint)
+}
+
+// The renewer configured in the [renewal] section of the config
+func parseRenewer(r *fc.Retriever, policies *fc.PolicyStore) (*fc.Renewer, error) {
+	rc := cfg.Renewal
+
+	// A renewal proposed later wouldn't start before the deal ends
+	if rc.RenewBefore < int(fc.DealStartDelay) {
+		return nil, fmt.Errorf("renewal renew-before of %d epochs is less than the %d epochs before new deals start", rc.RenewBefore, fc.DealStartDelay)
+	}
+
+	renewer := fc.NewRenewer(r, policies, abi.ChainEpoch(rc.RenewBefore))
+	if rc.Interval > 0 {
+		renewer.Interval = time.Duration(rc.Interval)
+	}
+
+	for _, s := range rc.Miners {
+		miner, err := address.NewFromString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid renewal miner '%s': %w", s, err)
+		}
+		renewer.Miners = append(renewer.Miners, miner)
+	}
+
+	if rc.MaxPrice != "" {
+		price, err := types.ParseFIL(rc.MaxPrice)
+		if err != nil {
+			return nil, fmt.Errorf("invalid renewal max-price '%s': %w", rc.MaxPrice, err)
+		}
+		maxPrice := abi.TokenAmount(price)
+		renewer.MaxPrice = &maxPrice
+	}
+
+	if rc.Budget != "" {
+		budget, err := types.ParseFIL(rc.Budget)
+		if err != nil {
+			return nil, fmt.Errorf("invalid renewal budget '%s': %w", rc.Budget, err)
+		}
+		amount := abi.TokenAmount(budget)
+		renewer.Budget = &amount
+	}
+
+	return renewer, nil
+}
+
+func parseFallbackBlockstore(cctx *cli.Context, r *fc.Retriever) (*fc.FallbackBlockstore, error) {
+	fallback := fc.NewFallbackBlockstore(node.Blockstore, r, parseCandidateFinder(cctx))
+	fallback.RemoteRate = cctx.Int(flagFallbackRemoteRate.Name)
+
+	if s := cctx.String(flagFallbackRemoteBudget.Name); s != "" {
+		budget, err := types.ParseFIL(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --%s '%s': %w", flagFallbackRemoteBudget.Name, s, err)
+		}
+		amount := abi.TokenAmount(budget)
+		fallback.RemoteBudget = &amount
+	}
+
+	return fallback, nil
+}
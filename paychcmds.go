@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	"github.com/urfave/cli/v2"
+
+	"github.com/jlogelin/wormhole/api"
+	fc "github.com/jlogelin/wormhole/filecoin"
+)
+
+var paychCmd = &cli.Command{
+	Name:  "paych",
+	Usage: "Manage the payment channels opened for paid retrievals",
+	Subcommands: []*cli.Command{
+		paychListCmd,
+		paychStatusCmd,
+		paychSettleCmd,
+		paychCollectCmd,
+	},
+}
+
+var paychListCmd = &cli.Command{
+	Name:      "list",
+	Usage:     "List payment channels",
+	ArgsUsage: " ",
+	Action: func(cctx *cli.Context) error {
+		paychs, closer, err := openPaychs(cctx.Context)
+		if err != nil {
+			return err
+		}
+		defer closer()
+
+		statuses, err := paychs.List(cctx.Context)
+		if err != nil {
+			return err
+		}
+
+		printPaychs(statuses)
+
+		return nil
+	},
+}
+
+var paychStatusCmd = &cli.Command{
+	Name:      "status",
+	Usage:     "Show a payment channel",
+	ArgsUsage: "<channel address>",
+	Action: func(cctx *cli.Context) error {
+		ch, err := parseChannelArg(cctx)
+		if err != nil {
+			return err
+		}
+
+		paychs, closer, err := openPaychs(cctx.Context)
+		if err != nil {
+			return err
+		}
+		defer closer()
+
+		status, err := paychs.Status(cctx.Context, ch)
+		if err != nil {
+			return err
+		}
+		if status == nil {
+			return fmt.Errorf("channel %s is inbound", ch)
+		}
+
+		return printJSON(status)
+	},
+}
+
+var paychSettleCmd = &cli.Command{
+	Name:      "settle",
+	Usage:     "Settle a payment channel, giving the provider until the settlement period ends to redeem its vouchers",
+	ArgsUsage: "<channel address>",
+	Flags: []cli.Flag{
+		flagAll,
+	},
+	Action: func(cctx *cli.Context) error {
+		return forEachPaych(cctx, "Settling", func(status *fc.PaychStatus) bool {
+			return !status.Settling
+		}, func(paychs paychService, ch address.Address) (cid.Cid, error) {
+			return paychs.Settle(cctx.Context, ch)
+		})
+	},
+}
+
+var paychCollectCmd = &cli.Command{
+	Name:      "collect",
+	Usage:     "Collect the funds left in a settled payment channel back to the wallet",
+	ArgsUsage: "<channel address>",
+	Flags: []cli.Flag{
+		flagAll,
+	},
+	Action: func(cctx *cli.Context) error {
+		return forEachPaych(cctx, "Collecting", func(status *fc.PaychStatus) bool {
+			return status.Collectable
+		}, func(paychs paychService, ch address.Address) (cid.Cid, error) {
+			return paychs.Collect(cctx.Context, ch)
+		})
+	},
+}
+
+// Apply op to the channel given as argument, or with --all to every channel
+// eligible for it
+func forEachPaych(cctx *cli.Context, verb string, eligible func(*fc.PaychStatus) bool, op func(paychService, address.Address) (cid.Cid, error)) error {
+	var chans []address.Address
+	if !cctx.Bool(flagAll.Name) {
+		ch, err := parseChannelArg(cctx)
+		if err != nil {
+			return err
+		}
+		chans = append(chans, ch)
+	}
+
+	paychs, closer, err := openPaychs(cctx.Context)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	if cctx.Bool(flagAll.Name) {
+		statuses, err := paychs.List(cctx.Context)
+		if err != nil {
+			return err
+		}
+
+		for _, status := range statuses {
+			if eligible(status) {
+				chans = append(chans, status.Channel)
+			}
+		}
+
+		if len(chans) == 0 {
+			fmt.Println("No channels to process")
+			return nil
+		}
+	}
+
+	var failed int
+	for _, ch := range chans {
+		msg, err := op(paychs, ch)
+		if err != nil {
+			fmt.Printf("%s: %v\n", ch, err)
+			failed++
+			continue
+		}
+
+		fmt.Printf("%s %s in message %s\n", verb, ch, msg)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d channels failed", failed, len(chans))
+	}
+
+	return nil
+}
+
+// The payment channel operations shared by the daemon API client and a
+// retriever on a local node.
+type paychService interface {
+	List(ctx context.Context) ([]*fc.PaychStatus, error)
+	Status(ctx context.Context, ch address.Address) (*fc.PaychStatus, error)
+	Settle(ctx context.Context, ch address.Address) (cid.Cid, error)
+	Collect(ctx context.Context, ch address.Address) (cid.Cid, error)
+}
+
+// Talk to the running daemon if there is one, otherwise start a node with a
+// retriever to reach the channels through.
+func openPaychs(ctx context.Context) (paychService, func(), error) {
+	client, err := dialDaemon(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if client != nil {
+		return &apiPaychs{client: client}, func() {}, nil
+	}
+
+	BootstrapWhyPFS()
+
+	r, err := fc.NewRetriever(node)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return r.Paych, r.Close, nil
+}
+
+type apiPaychs struct {
+	client *api.Client
+}
+
+func (p *apiPaychs) List(ctx context.Context) ([]*fc.PaychStatus, error) {
+	return p.client.Paychs(ctx)
+}
+
+func (p *apiPaychs) Status(ctx context.Context, ch address.Address) (*fc.PaychStatus, error) {
+	return p.client.PaychStatus(ctx, ch)
+}
+
+func (p *apiPaychs) Settle(ctx context.Context, ch address.Address) (cid.Cid, error) {
+	return p.client.SettlePaych(ctx, ch)
+}
+
+func (p *apiPaychs) Collect(ctx context.Context, ch address.Address) (cid.Cid, error) {
+	return p.client.CollectPaych(ctx, ch)
+}
+
+func printPaychs(statuses []*fc.PaychStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "CHANNEL\tPROVIDER\tLOCKED\tVOUCHERS\tVOUCHER TOTAL\tREDEEMABLE\tSTATE\n")
+	for _, status := range statuses {
+		state := "open"
+		switch {
+		case status.Collectable:
+			state = "collectable"
+		case status.Settling:
+			state = fmt.Sprintf("settling until %d", status.SettlingAt)
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			status.Channel,
+			status.Provider,
+			types.FIL(status.Balance),
+			status.VouchersSent,
+			types.FIL(status.VoucherTotal),
+			types.FIL(status.Redeemable),
+			state,
+		)
+	}
+	w.Flush()
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/urfave/cli/v2"
+
+	"github.com/jlogelin/wormhole/api"
+	fc "github.com/jlogelin/wormhole/filecoin"
+)
+
+var pinCmd = &cli.Command{
+	Name:  "pin",
+	Usage: "Manage the pinned content that cache GC never evicts",
+	Subcommands: []*cli.Command{
+		pinAddCmd,
+		pinListCmd,
+		pinRemoveCmd,
+		pinVerifyCmd,
+		pinReplicationCmd,
+	},
+}
+
+var pinAddCmd = &cli.Command{
+	Name:      "add",
+	Usage:     "Pin a root, fetching its content over IPFS if it isn't local",
+	ArgsUsage: "<cid>",
+	Flags: []cli.Flag{
+		flagPinName,
+		flagPinDirect,
+	},
+	Action: func(cctx *cli.Context) error {
+		c, err := parseCidArg(cctx)
+		if err != nil {
+			return err
+		}
+
+		typ := fc.PinRecursive
+		if cctx.Bool(flagPinDirect.Name) {
+			typ = fc.PinDirect
+		}
+
+		pins, err := openPins(cctx.Context)
+		if err != nil {
+			return err
+		}
+
+		pin, err := pins.Pin(cctx.Context, c, cctx.String(flagPinName.Name), typ)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Pinned %s (%s)\n", pin.Cid, pin.Type)
+
+		return nil
+	},
+}
+
+var pinListCmd = &cli.Command{
+	Name:      "ls",
+	Usage:     "List pins",
+	ArgsUsage: " ",
+	Flags: []cli.Flag{
+		flagPinType,
+	},
+	Action: func(cctx *cli.Context) error {
+		var typ fc.PinType
+		if cctx.IsSet(flagPinType.Name) {
+			var err error
+			typ, err = fc.ParsePinType(cctx.String(flagPinType.Name))
+			if err != nil {
+				return err
+			}
+		}
+
+		pins, err := openPins(cctx.Context)
+		if err != nil {
+			return err
+		}
+
+		all, err := pins.List(cctx.Context)
+		if err != nil {
+			return err
+		}
+
+		var listed []*fc.Pin
+		for _, pin := range all {
+			if typ == "" || pin.Recursive() == (typ == fc.PinRecursive) {
+				listed = append(listed, pin)
+			}
+		}
+
+		printPins(listed)
+
+		return nil
+	},
+}
+
+var pinRemoveCmd = &cli.Command{
+	Name:      "rm",
+	Usage:     "Unpin a root. Cache GC can then evict its content if it was retrieved or served by the gateway, other content stays.",
+	ArgsUsage: "<cid>",
+	Action: func(cctx *cli.Context) error {
+		c, err := parseCidArg(cctx)
+		if err != nil {
+			return err
+		}
+
+		pins, err := openPins(cctx.Context)
+		if err != nil {
+			return err
+		}
+
+		if err := pins.Remove(cctx.Context, c); err != nil {
+			return err
+		}
+
+		fmt.Printf("Unpinned %s\n", c)
+
+		return nil
+	},
+}
+
+var pinVerifyCmd = &cli.Command{
+	Name:      "verify",
+	Usage:     "Check that the content of the given pins, or of all pins, is in the blockstore",
+	ArgsUsage: "[cid...]",
+	Action: func(cctx *cli.Context) error {
+		var cids []cid.Cid
+		for _, cidStr := range cctx.Args().Slice() {
+			c, err := cid.Decode(cidStr)
+			if err != nil {
+				return fmt.Errorf("invalid CID '%s': %w", cidStr, err)
+			}
+			cids = append(cids, c)
+		}
+
+		pins, err := openPins(cctx.Context)
+		if err != nil {
+			return err
+		}
+
+		statuses, err := pins.Verify(cctx.Context, cids)
+		if err != nil {
+			return err
+		}
+
+		var broken int
+		for _, status := range statuses {
+			switch {
+			case status.Error != "":
+				fmt.Printf("%s: error: %s\n", status.Pin.Cid, status.Error)
+			case !status.Ok:
+				fmt.Printf("%s: %d blocks missing\n", status.Pin.Cid, len(status.Missing))
+			default:
+				fmt.Printf("%s: ok\n", status.Pin.Cid)
+				continue
+			}
+			broken++
+		}
+
+		if broken > 0 {
+			return fmt.Errorf("%d of %d pins are incomplete", broken, len(statuses))
+		}
+
+		return nil
+	},
+}
+
+// The pin operations shared by the daemon API client and a pinset used on a
+// local node.
+type pinService interface {
+	Pin(ctx context.Context, c cid.Cid, name string, typ fc.PinType) (*fc.Pin, error)
+	List(ctx context.Context) ([]*fc.Pin, error)
+	Remove(ctx context.Context, c cid.Cid) error
+	Verify(ctx context.Context, cids []cid.Cid) ([]*fc.PinStatus, error)
+}
+
+// Talk to the running daemon if there is one, otherwise start a node to pin
+// content with.
+func openPins(ctx context.Context) (pinService, error) {
+	client, err := dialDaemon(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if client != nil {
+		return &apiPins{client: client}, nil
+	}
+
+	BootstrapWhyPFS()
+
+	return &localPins{pins: fc.NewPinset(node.Datastore)}, nil
+}
+
+type apiPins struct {
+	client *api.Client
+}
+
+func (p *apiPins) Pin(ctx context.Context, c cid.Cid, name string, typ fc.PinType) (*fc.Pin, error) {
+	return p.client.Pin(ctx, c, name, typ)
+}
+
+func (p *apiPins) List(ctx context.Context) ([]*fc.Pin, error) {
+	return p.client.Pins(ctx)
+}
+
+func (p *apiPins) Remove(ctx context.Context, c cid.Cid) error {
+	return p.client.Unpin(ctx, c)
+}
+
+func (p *apiPins) Verify(ctx context.Context, cids []cid.Cid) ([]*fc.PinStatus, error) {
+	return p.client.VerifyPins(ctx, cids)
+}
+
+type localPins struct {
+	pins *fc.Pinset
+}
+
+func (p *localPins) Pin(ctx context.Context, c cid.Cid, name string, typ fc.PinType) (*fc.Pin, error) {
+	return p.pins.Pin(ctx, node.DAGService, c, name, typ)
+}
+
+func (p *localPins) List(ctx context.Context) ([]*fc.Pin, error) {
+	return p.pins.List(ctx)
+}
+
+func (p *localPins) Remove(ctx context.Context, c cid.Cid) error {
+	return p.pins.Remove(ctx, c)
+}
+
+func (p *localPins) Verify(ctx context.Context, cids []cid.Cid) ([]*fc.PinStatus, error) {
+	return p.pins.Verify(ctx, node.Blockstore, cids)
+}
+
+func printPins(pins []*fc.Pin) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "CID\tTYPE\tNAME\tCREATED\n")
+	for _, pin := range pins {
+		typ := fc.PinRecursive
+		if !pin.Recursive() {
+			typ = fc.PinDirect
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n",
+			pin.Cid,
+			typ,
+			pin.Name,
+			pin.Created.Format(time.RFC3339),
+		)
+	}
+	w.Flush()
+}
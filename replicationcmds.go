@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/builtin"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	"github.com/urfave/cli/v2"
+
+	"github.com/jlogelin/wormhole/api"
+	fc "github.com/jlogelin/wormhole/filecoin"
+)
+
+var pinReplicationCmd = &cli.Command{
+	Name:  "replication",
+	Usage: "Manage how many storage deals pins keep, the daemon making the missing ones",
+	Subcommands: []*cli.Command{
+		pinReplicationSetCmd,
+		pinReplicationListCmd,
+		pinReplicationRemoveCmd,
+	},
+}
+
+var pinReplicationSetCmd = &cli.Command{
+	Name:        "set",
+	Usage:       "Set the replication policy of a pin",
+	Description: "Keep --deals deals for a pinned root, each with a different one of --miners. The running daemon makes new deals whenever deals fail, get slashed, expire or have less than --min-remaining days left.",
+	ArgsUsage:   "<cid>",
+	Flags: []cli.Flag{
+		flagReplicas,
+		flagMiners,
+		flagExcludeMiners,
+		flagStorageMaxPrice,
+		flagVerifiedOnly,
+		flagMinRemaining,
+		flagDealDuration,
+		flagFastRetrieval,
+	},
+	Action: func(cctx *cli.Context) error {
+		policy, err := parsePolicy(cctx)
+		if err != nil {
+			return err
+		}
+
+		policies, err := openPolicies(cctx.Context)
+		if err != nil {
+			return err
+		}
+
+		if err := policies.Set(cctx.Context, policy); err != nil {
+			return err
+		}
+
+		fmt.Printf("Keeping %d deals for %s\n", policy.Deals, policy.Cid)
+
+		return nil
+	},
+}
+
+var pinReplicationListCmd = &cli.Command{
+	Name:      "ls",
+	Usage:     "List replication policies",
+	ArgsUsage: " ",
+	Flags: []cli.Flag{
+		flagJSON,
+	},
+	Action: func(cctx *cli.Context) error {
+		policies, err := openPolicies(cctx.Context)
+		if err != nil {
+			return err
+		}
+
+		list, err := policies.List(cctx.Context)
+		if err != nil {
+			return err
+		}
+
+		if cctx.Bool(flagJSON.Name) {
+			return printJSON(list)
+		}
+
+		printPolicies(list)
+
+		return nil
+	},
+}
+
+var pinReplicationRemoveCmd = &cli.Command{
+	Name:      "rm",
+	Usage:     "Remove the replication policy of a pin, leaving its deals as they are",
+	ArgsUsage: "<cid>",
+	Action: func(cctx *cli.Context) error {
+		c, err := parseCidArg(cctx)
+		if err != nil {
+			return err
+		}
+
+		policies, err := openPolicies(cctx.Context)
+		if err != nil {
+			return err
+		}
+
+		if err := policies.Remove(cctx.Context, c); err != nil {
+			return err
+		}
+
+		fmt.Printf("Removed the replication policy of %s\n", c)
+
+		return nil
+	},
+}
+
+func parsePolicy(cctx *cli.Context) (*fc.ReplicationPolicy, error) {
+	c, err := parseCidArg(cctx)
+	if err != nil {
+		return nil, err
+	}
+
+	miners, err := parseMiners(cctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var excluded []address.Address
+	for _, ms := range splitMiners(cctx.StringSlice(flagExcludeMiners.Name)) {
+		miner, err := address.NewFromString(ms)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse miner %s: %w", ms, err)
+		}
+		excluded = append(excluded, miner)
+	}
+
+	policy := &fc.ReplicationPolicy{
+		Cid:           c,
+		Deals:         cctx.Int(flagReplicas.Name),
+		Miners:        miners,
+		ExcludeMiners: excluded,
+		VerifiedOnly:  cctx.Bool(flagVerifiedOnly.Name),
+		MinRemaining:  abi.ChainEpoch(cctx.Int(flagMinRemaining.Name)) * builtin.EpochsInDay,
+		Duration:      abi.ChainEpoch(cctx.Int(flagDealDuration.Name)) * builtin.EpochsInDay,
+		FastRetrieval: cctx.Bool(flagFastRetrieval.Name),
+	}
+
+	if s := cctx.String(flagStorageMaxPrice.Name); s != "" {
+		price, err := types.ParseFIL(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --%s: %w", flagStorageMaxPrice.Name, err)
+		}
+		amount := abi.TokenAmount(price)
+		policy.MaxPrice = &amount
+	}
+
+	return policy, nil
+}
+
+// The policy operations shared by the daemon API client and a policy store
+// used on a local node
+type policyService interface {
+	Set(ctx context.Context, policy *fc.ReplicationPolicy) error
+	List(ctx context.Context) ([]*fc.ReplicationPolicy, error)
+	Remove(ctx context.Context, c cid.Cid) error
+}
+
+func openPolicies(ctx context.Context) (policyService, error) {
+	client, err := dialDaemon(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if client != nil {
+		return &apiPolicies{client: client}, nil
+	}
+
+	BootstrapWhyPFS()
+
+	return fc.NewPolicyStore(node.Datastore), nil
+}
+
+type apiPolicies struct {
+	client *api.Client
+}
+
+func (p *apiPolicies) Set(ctx context.Context, policy *fc.ReplicationPolicy) error {
+	return p.client.SetPolicy(ctx, policy)
+}
+
+func (p *apiPolicies) List(ctx context.Context) ([]*fc.ReplicationPolicy, error) {
+	return p.client.Policies(ctx)
+}
+
+func (p *apiPolicies) Remove(ctx context.Context, c cid.Cid) error {
+	return p.client.RemovePolicy(ctx, c)
+}
+
+func printPolicies(policies []*fc.ReplicationPolicy) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "CID\tDEALS\tMINERS\tEXCLUDED\tMAX PRICE\tVERIFIED ONLY\tMIN REMAINING\tDURATION\n")
+	for _, policy := range policies {
+		maxPrice := "-"
+		if policy.MaxPrice != nil {
+			maxPrice = types.FIL(*policy.MaxPrice).Short()
+		}
+
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%t\t%dd\t%dd\n",
+			policy.Cid,
+			policy.Deals,
+			joinMiners(policy.Miners),
+			joinMiners(policy.ExcludeMiners),
+			maxPrice,
+			policy.VerifiedOnly,
+			policy.MinRemaining/builtin.EpochsInDay,
+			policy.Duration/builtin.EpochsInDay,
+		)
+	}
+	w.Flush()
+}
+
+func joinMiners(miners []address.Address) string {
+	if len(miners) == 0 {
+		return "-"
+	}
+
+	strs := make([]string, len(miners))
+	for i, miner := range miners {
+		strs[i] = miner.String()
+	}
+
+	return strings.Join(strs, ",")
+}
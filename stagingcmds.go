@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/urfave/cli/v2"
+
+	fc "github.com/jlogelin/wormhole/filecoin"
+)
+
+var stagingCmd = &cli.Command{
+	Name:        "staging",
+	Usage:       "Inspect and flush the small files waiting to be stored in one deal",
+	Description: "With aggregation enabled in the config, added files up to max-file-size are staged. Once enough are staged, the daemon bundles them into one directory, makes a deal for it and indexes where each file went, so that retrieving a file from Filecoin goes through the bundle.",
+	Subcommands: []*cli.Command{
+		stagingListCmd,
+		stagingFlushCmd,
+		stagingLookupCmd,
+	},
+}
+
+var stagingListCmd = &cli.Command{
+	Name:      "ls",
+	Usage:     "List the staged files",
+	ArgsUsage: " ",
+	Flags: []cli.Flag{
+		flagJSON,
+	},
+	Action: func(cctx *cli.Context) error {
+		var staged []*fc.StagedRoot
+
+		client, err := dialDaemon(cctx.Context)
+		if err != nil {
+			return err
+		}
+		if client != nil {
+			staged, err = client.Staged(cctx.Context)
+		} else {
+			BootstrapWhyPFS()
+			staged, err = fc.NewStaging(node.Datastore).Staged(cctx.Context)
+		}
+		if err != nil {
+			return err
+		}
+
+		if cctx.Bool(flagJSON.Name) {
+			return printJSON(staged)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "CID\tSIZE\tSTAGED\n")
+		for _, root := range staged {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", root.Cid, humanize.IBytes(root.Size), root.Staged.Format(time.RFC3339))
+		}
+		w.Flush()
+
+		return nil
+	},
+}
+
+var stagingFlushCmd = &cli.Command{
+	Name:        "flush",
+	Usage:       "Aggregate the staged files and make a deal for them now",
+	Description: "Aggregate the oldest staged files up to the configured target size without waiting for a threshold. Without a running daemon, the command waits for the data transfer to finish.",
+	ArgsUsage:   " ",
+	Flags: []cli.Flag{
+		flagJSON,
+	},
+	Action: func(cctx *cli.Context) error {
+		var agg *fc.Aggregate
+
+		client, err := dialDaemon(cctx.Context)
+		if err != nil {
+			return err
+		}
+		if client != nil {
+			agg, err = client.Flush(cctx.Context)
+			if err != nil {
+				return err
+			}
+		} else {
+			BootstrapWhyPFS()
+
+			r, err := fc.NewRetriever(node)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			r.QueryConcurrency = cfg.Retrieval.QueryConcurrency
+			r.QueryTimeout = time.Duration(cfg.Retrieval.QueryTimeout)
+
+			aggregator, err := parseAggregator(r)
+			if err != nil {
+				return err
+			}
+
+			agg, err = aggregator.Flush(cctx.Context, true)
+			if err != nil {
+				return err
+			}
+
+			if agg != nil {
+				deal, err := r.Deals.Get(cctx.Context, agg.DealID)
+				if err != nil {
+					return err
+				}
+
+				fmt.Printf("Proposed deal %d for aggregate %s, transferring the data...\n", deal.ID, agg.Root)
+
+				if err := r.WaitTransfer(cctx.Context, deal); err != nil {
+					return err
+				}
+			}
+		}
+
+		if cctx.Bool(flagJSON.Name) {
+			return printJSON(agg)
+		}
+
+		if agg == nil {
+			fmt.Println("No files are staged")
+			return nil
+		}
+
+		fmt.Printf("Aggregated %d files of %s into %s, stored with deal %d\n", len(agg.Entries), humanize.IBytes(agg.Size), agg.Root, agg.DealID)
+
+		return nil
+	},
+}
+
+var stagingLookupCmd = &cli.Command{
+	Name:      "lookup",
+	Usage:     "Show the aggregate an added file was stored in",
+	ArgsUsage: "<cid>",
+	Flags: []cli.Flag{
+		flagJSON,
+	},
+	Action: func(cctx *cli.Context) error {
+		c, err := parseCidArg(cctx)
+		if err != nil {
+			return err
+		}
+
+		var entry *fc.AggregateEntry
+
+		client, err := dialDaemon(cctx.Context)
+		if err != nil {
+			return err
+		}
+		if client != nil {
+			entry, err = client.Lookup(cctx.Context, c)
+		} else {
+			BootstrapWhyPFS()
+			entry, err = fc.NewStaging(node.Datastore).Lookup(cctx.Context, c)
+		}
+		if err != nil {
+			return err
+		}
+
+		if cctx.Bool(flagJSON.Name) {
+			return printJSON(entry)
+		}
+
+		fmt.Printf("%s is at %s in aggregate %s, stored with deal %d\n", entry.Cid, entry.Path, entry.Root, entry.DealID)
+
+		return nil
+	},
+}
+
+// The aggregator configured in the [aggregation] section of the config
+func parseAggregator(r *fc.Retriever) (*fc.Aggregator, error) {
+	ac := cfg.Aggregation
+
+	r.Staging.MaxFileSize = uint64(ac.MaxFileSize)
+
+	aggregator := fc.NewAggregator(r)
+	aggregator.TargetSize = uint64(ac.TargetSize)
+	aggregator.MaxFiles = ac.MaxFiles
+	aggregator.MaxAge = time.Duration(ac.MaxAge)
+	aggregator.Duration = abi.ChainEpoch(ac.Duration)
+	aggregator.Verified = ac.Verified
+	aggregator.FastRetrieval = ac.FastRetrieval
+	if ac.Interval > 0 {
+		aggregator.Interval = time.Duration(ac.Interval)
+	}
+
+	for _, s := range ac.Miners {
+		miner, err := address.NewFromString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid aggregation miner '%s': %w", s, err)
+		}
+		aggregator.Miners = append(aggregator.Miners, miner)
+	}
+
+	if ac.MaxPrice != "" {
+		price, err := types.ParseFIL(ac.MaxPrice)
+		if err != nil {
+			return nil, fmt.Errorf("invalid aggregation max-price '%s': %w", ac.MaxPrice, err)
+		}
+		maxPrice := abi.TokenAmount(price)
+		aggregator.MaxPrice = &maxPrice
+	}
+
+	return aggregator, nil
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	lapi "github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/urfave/cli/v2"
+
+	fc "github.com/jlogelin/wormhole/filecoin"
+)
+
+var walletCmd = &cli.Command{
+	Name:  "wallet",
+	Usage: "Manage the wallet retrievals are paid from",
+	Subcommands: []*cli.Command{
+		walletNewCmd,
+		walletListCmd,
+		walletDefaultCmd,
+		walletSetDefaultCmd,
+		walletBalanceCmd,
+		walletExportCmd,
+		walletImportCmd,
+		walletSendCmd,
+		walletEncryptCmd,
+	},
+}
+
+var walletNewCmd = &cli.Command{
+	Name:      "new",
+	Usage:     "Create a new address",
+	ArgsUsage: " ",
+	Flags: []cli.Flag{
+		flagKeyType,
+	},
+	Action: func(cctx *cli.Context) error {
+		typ, err := fc.ParseKeyType(cctx.String(flagKeyType.Name))
+		if err != nil {
+			return err
+		}
+
+		wal, err := fc.OpenWallet()
+		if err != nil {
+			return err
+		}
+
+		addr, err := wal.WalletNew(cctx.Context, typ)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(addr)
+
+		return nil
+	},
+}
+
+var walletListCmd = &cli.Command{
+	Name:      "list",
+	Usage:     "List the wallet's addresses",
+	ArgsUsage: " ",
+	Action: func(cctx *cli.Context) error {
+		wal, err := fc.OpenWallet()
+		if err != nil {
+			return err
+		}
+
+		addrs, err := wal.WalletList(cctx.Context)
+		if err != nil {
+			return err
+		}
+
+		// No default yet is fine, GetDefault errors in that case
+		def, _ := wal.GetDefault()
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "ADDRESS\tDEFAULT\n")
+		for _, addr := range addrs {
+			marker := ""
+			if addr == def {
+				marker = "X"
+			}
+			fmt.Fprintf(w, "%s\t%s\n", addr, marker)
+		}
+		w.Flush()
+
+		return nil
+	},
+}
+
+var walletDefaultCmd = &cli.Command{
+	Name:      "default",
+	Usage:     "Show the default address retrievals are paid from",
+	ArgsUsage: " ",
+	Action: func(cctx *cli.Context) error {
+		wal, err := fc.OpenWallet()
+		if err != nil {
+			return err
+		}
+
+		addr, err := wal.GetDefault()
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(addr)
+
+		return nil
+	},
+}
+
+var walletSetDefaultCmd = &cli.Command{
+	Name:      "set-default",
+	Usage:     "Set the default address retrievals are paid from",
+	ArgsUsage: "<address>",
+	Action: func(cctx *cli.Context) error {
+		addr, err := parseAddressArg(cctx, 0)
+		if err != nil {
+			return err
+		}
+
+		wal, err := fc.OpenWallet()
+		if err != nil {
+			return err
+		}
+
+		return wal.SetDefault(addr)
+	},
+}
+
+var walletBalanceCmd = &cli.Command{
+	Name:      "balance",
+	Usage:     "Show the balance of an address, the default one if none is given",
+	ArgsUsage: "[address]",
+	Action: func(cctx *cli.Context) error {
+		wal, err := fc.OpenWallet()
+		if err != nil {
+			return err
+		}
+
+		var addr address.Address
+		if cctx.Args().Present() {
+			addr, err = parseAddressArg(cctx, 0)
+		} else {
+			addr, err = wal.GetDefault()
+		}
+		if err != nil {
+			return err
+		}
+
+		gw, closer, err := fc.GatewayAPI()
+		if err != nil {
+			return err
+		}
+		defer closer()
+
+		balance, err := fc.Balance(cctx.Context, gw, addr)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s: %s\n", addr, types.FIL(balance))
+
+		return nil
+	},
+}
+
+var walletExportCmd = &cli.Command{
+	Name:      "export",
+	Usage:     "Print the private key of an address, hex encoded like 'lotus wallet export'",
+	ArgsUsage: "<address>",
+	Action: func(cctx *cli.Context) error {
+		addr, err := parseAddressArg(cctx, 0)
+		if err != nil {
+			return err
+		}
+
+		wal, err := fc.OpenWallet()
+		if err != nil {
+			return err
+		}
+
+		exported, err := fc.ExportKey(cctx.Context, wal, addr)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(exported)
+
+		return nil
+	},
+}
+
+var walletImportCmd = &cli.Command{
+	Name:      "import",
+	Usage:     "Import a private key exported with 'lotus wallet export', from a file or stdin",
+	ArgsUsage: "[file]",
+	Action: func(cctx *cli.Context) error {
+		var data []byte
+		var err error
+		if path := cctx.Args().First(); path != "" && path != "-" {
+			data, err = os.ReadFile(path)
+		} else {
+			data, err = io.ReadAll(os.Stdin)
+		}
+		if err != nil {
+			return err
+		}
+
+		wal, err := fc.OpenWallet()
+		if err != nil {
+			return err
+		}
+
+		addr, err := fc.ImportKey(cctx.Context, wal, string(data))
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Imported %s\n", addr)
+
+		return nil
+	},
+}
+
+var walletSendCmd = &cli.Command{
+	Name:      "send",
+	Usage:     "Send FIL from the wallet",
+	ArgsUsage: "<to address> <amount in FIL>",
+	Flags: []cli.Flag{
+		flagFrom,
+		flagWait,
+	},
+	Action: func(cctx *cli.Context) error {
+		if cctx.NArg() != 2 {
+			return fmt.Errorf("please specify the address to send to and the amount")
+		}
+
+		to, err := parseAddressArg(cctx, 0)
+		if err != nil {
+			return err
+		}
+
+		amount, err := types.ParseFIL(cctx.Args().Get(1))
+		if err != nil {
+			return fmt.Errorf("invalid amount '%s': %w", cctx.Args().Get(1), err)
+		}
+
+		wal, err := fc.OpenWallet()
+		if err != nil {
+			return err
+		}
+
+		var from address.Address
+		if cctx.IsSet(flagFrom.Name) {
+			from, err = address.NewFromString(cctx.String(flagFrom.Name))
+			if err != nil {
+				return fmt.Errorf("invalid --%s address: %w", flagFrom.Name, err)
+			}
+		} else {
+			from, err = wal.GetDefault()
+			if err != nil {
+				return err
+			}
+		}
+
+		gw, closer, err := fc.GatewayAPI()
+		if err != nil {
+			return err
+		}
+		defer closer()
+
+		msg, err := fc.Send(cctx.Context, gw, wal, from, to, abi.TokenAmount(amount))
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Sent %s from %s to %s in message %s\n", amount, from, to, msg)
+
+		if !cctx.Bool(flagWait.Name) {
+			return nil
+		}
+
+		fmt.Println("Waiting for the message to land on chain...")
+
+		lookup, err := gw.StateWaitMsg(cctx.Context, msg, 1, lapi.LookbackNoLimit, true)
+		if err != nil {
+			return err
+		}
+		if lookup.Receipt.ExitCode.IsError() {
+			return fmt.Errorf("message failed with exit code %d", lookup.Receipt.ExitCode)
+		}
+
+		fmt.Printf("Message landed at epoch %d\n", lookup.Height)
+
+		return nil
+	},
+}
+
+var walletEncryptCmd = &cli.Command{
+	Name:      "encrypt",
+	Usage:     "Move the keys of a plaintext keystore into a new passphrase-encrypted one. Stop the daemon first.",
+	ArgsUsage: " ",
+	Action: func(cctx *cli.Context) error {
+		passphrase, err := fc.ReadPassphrase("New keystore passphrase: ")
+		if err != nil {
+			return err
+		}
+		if len(passphrase) == 0 {
+			return fc.ErrEmptyPassphrase
+		}
+
+		// Only a typed passphrase can have typos in it
+		if _, fromEnv := os.LookupEnv(fc.PassphraseEnv); !fromEnv && os.Getenv(fc.PassphraseFileEnv) == "" {
+			confirm, err := fc.ReadPassphrase("Repeat the passphrase: ")
+			if err != nil {
+				return err
+			}
+			if string(confirm) != string(passphrase) {
+				return fmt.Errorf("the passphrases don't match")
+			}
+		}
+
+		n, err := fc.EncryptWallet(passphrase)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Encrypted %d keys, unlock the keystore with a prompt, %s or %s from now on\n", n, fc.PassphraseEnv, fc.PassphraseFileEnv)
+
+		return nil
+	},
+}